@@ -0,0 +1,159 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// Formats of access logs.
+const (
+	// accessLogCommon is the Common Log Format, as used by Apache & nginx.
+	accessLogCommon = "common"
+	// accessLogJSON writes one JSON object per request, with the savename and
+	// shot ID when known.
+	accessLogJSON = "json"
+)
+
+// requestInfo collects what handlers learn about a request, for the access
+// log.
+type requestInfo struct {
+	m        sync.Mutex
+	user     string
+	savename string
+	shotID   string
+}
+
+type requestInfoKey struct{}
+
+// getRequestInfo returns the information attached to the request, or nil when
+// access logs are disabled.
+func getRequestInfo(req *http.Request) *requestInfo {
+	ri, _ := req.Context().Value(requestInfoKey{}).(*requestInfo)
+	return ri
+}
+
+// noteUser records the authenticated user of the request.
+func noteUser(req *http.Request, user string) {
+	if ri := getRequestInfo(req); ri != nil {
+		ri.m.Lock()
+		defer ri.m.Unlock()
+		ri.user = user
+	}
+}
+
+// noteSave records which save the request is about.
+func noteSave(req *http.Request, savename string) {
+	if ri := getRequestInfo(req); ri != nil {
+		ri.m.Lock()
+		defer ri.m.Unlock()
+		ri.savename = savename
+	}
+}
+
+// noteShot records which shot the request is about.
+func noteShot(req *http.Request, si *shotInfo) {
+	if ri := getRequestInfo(req); ri != nil {
+		ri.m.Lock()
+		defer ri.m.Unlock()
+		ri.savename = si.savename
+		ri.shotID = si.id
+	}
+}
+
+// accessLogger writes a line per request served.
+type accessLogger struct {
+	format string
+	// Protects writes of Common Log Format lines.
+	m sync.Mutex
+	w io.Writer
+	// Used for JSON output.
+	logger *slog.Logger
+}
+
+// newAccessLogger creates a logger writing to the given file; "-" is stdout.
+func newAccessLogger(filename string, format string) (*accessLogger, error) {
+	var w io.Writer = os.Stdout
+	if filename != "-" {
+		f, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			return nil, fmt.Errorf("unable to open access log: %w", err)
+		}
+		w = f
+	}
+	al := &accessLogger{format: format, w: w}
+	switch format {
+	case accessLogCommon:
+	case accessLogJSON:
+		al.logger = slog.New(slog.NewJSONHandler(w, nil))
+	default:
+		return nil, fmt.Errorf("unknown access log format %q; expected %s or %s", format, accessLogCommon, accessLogJSON)
+	}
+	return al, nil
+}
+
+// wrap logs the requests served by h.
+func (al *accessLogger) wrap(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		start := time.Now()
+		ri := &requestInfo{}
+		sw := &statusWriter{ResponseWriter: w, code: http.StatusOK}
+		h.ServeHTTP(sw, req.WithContext(context.WithValue(req.Context(), requestInfoKey{}, ri)))
+		ri.m.Lock()
+		defer ri.m.Unlock()
+		al.log(req, start, sw, ri)
+	})
+}
+
+func (al *accessLogger) log(req *http.Request, start time.Time, sw *statusWriter, ri *requestInfo) {
+	host := req.RemoteAddr
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	if al.logger != nil {
+		attrs := []slog.Attr{
+			slog.String("remote", host),
+			slog.String("method", req.Method),
+			slog.String("uri", req.RequestURI),
+			slog.String("proto", req.Proto),
+			slog.Int("status", sw.code),
+			slog.Int64("bytes", sw.written),
+			slog.Float64("duration_ms", float64(time.Since(start).Microseconds())/1000),
+			slog.String("route", routeClass(req.URL.Path)),
+		}
+		for _, a := range []struct{ key, value string }{
+			{"user", ri.user},
+			{"savename", ri.savename},
+			{"shot_id", ri.shotID},
+			{"referer", req.Referer()},
+			{"user_agent", req.UserAgent()},
+		} {
+			if a.value != "" {
+				attrs = append(attrs, slog.String(a.key, a.value))
+			}
+		}
+		al.logger.LogAttrs(req.Context(), slog.LevelInfo, "request", attrs...)
+		return
+	}
+
+	user := "-"
+	if ri.user != "" {
+		user = ri.user
+	}
+	size := "-"
+	if sw.written > 0 {
+		size = fmt.Sprint(sw.written)
+	}
+	line := fmt.Sprintf("%s - %s [%s] %q %d %s\n",
+		host, user, start.Format("02/Jan/2006:15:04:05 -0700"),
+		req.Method+" "+req.RequestURI+" "+req.Proto, sw.code, size)
+	al.m.Lock()
+	defer al.m.Unlock()
+	io.WriteString(al.w, line)
+}
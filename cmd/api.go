@@ -0,0 +1,243 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/Palats/mapshot/shot"
+)
+
+// The types below are the stable representation of the v1 API. They are
+// independent of shots.json, which is shaped for the UI and can change at any
+// time. Fields can be added, but not removed or changed.
+
+// APISave describes a single save.
+type APISave struct {
+	// Root the save comes from; only set when serving multiple roots.
+	Root     string `json:"root,omitempty"`
+	Savename string `json:"savename"`
+	// Number of shots for that save, including incomplete ones.
+	ShotCount int `json:"shot_count"`
+	// Most recent complete shot, if any.
+	Latest *APIShot `json:"latest,omitempty"`
+}
+
+// APIShot describes a single shot.
+type APIShot struct {
+	// Unique ID of the render, as found in mapshot.json.
+	UniqueID string `json:"unique_id"`
+	// Root the shot comes from; only set when serving multiple roots.
+	Root     string `json:"root,omitempty"`
+	Savename string `json:"savename"`
+	// Path of the shot relative to the served directory; always with slashes.
+	Name string `json:"name"`
+	// URL path of the shot content; mapshot.json & tiles are found under it.
+	EncodedPath string `json:"encoded_path"`
+	// URL path of the viewer for that shot.
+	ViewerPath  string `json:"viewer_path"`
+	TicksPlayed int64  `json:"ticks_played"`
+	// One of "complete", "in-progress" or "abandoned".
+	Status string `json:"status"`
+	// URL paths of preview images, keyed by surface name. Only for complete
+	// shots, when thumbnails are enabled.
+	Thumbnails map[string]string `json:"thumbnails,omitempty"`
+	// Full content of mapshot.json, normalized. Only provided when requesting
+	// a single shot.
+	Mapshot *shot.Mapshot `json:"mapshot,omitempty"`
+}
+
+// APISavesResponse is returned when listing saves.
+type APISavesResponse struct {
+	Saves []*APISave `json:"saves"`
+}
+
+// APIShotsResponse is returned when listing the shots of a save.
+type APIShotsResponse struct {
+	Savename string     `json:"savename"`
+	Shots    []*APIShot `json:"shots"`
+}
+
+// APIError is returned with any non-200 status.
+type APIError struct {
+	Error string `json:"error"`
+}
+
+// apiV1 serves the JSON API under /api/v1/. Endpoints:
+//
+//	GET /api/v1/saves                     List all saves.
+//	GET /api/v1/saves/<savename>/shots    List the shots of a save.
+//	GET /api/v1/saves/<savename>/latest   Latest complete shot of a save.
+//	GET /api/v1/shots/<unique_id>         A single shot, with its mapshot.json.
+//	GET /api/v1/schema/mapshot.json       JSON Schema of mapshot.json.
+//
+// Savenames are a single path segment: they must be escaped with
+// url.PathEscape, as they can contain slashes. Incomplete shots are only
+// listed when query parameter `incomplete` is true.
+type apiV1 struct {
+	idx *shotIndex
+}
+
+// newAPIShot describes the shot, with paths under the URL prefix of the
+// request.
+func (a *apiV1) newAPIShot(req *http.Request, si *shotInfo) *APIShot {
+	prefix := requestPrefix(req)
+	resp := &APIShot{
+		UniqueID:    si.id,
+		Root:        si.root,
+		Savename:    si.savename,
+		Name:        si.name,
+		EncodedPath: prefix + si.encodedPath,
+		ViewerPath:  prefix + "/map/?path=" + url.QueryEscape(prefix+si.encodedPath),
+		TicksPlayed: si.json.TicksPlayed,
+		Status:      string(si.status),
+	}
+	if a.idx.thumbnails != nil && si.status == shotComplete {
+		resp.Thumbnails = map[string]string{}
+		for _, surface := range si.json.Surfaces {
+			resp.Thumbnails[surface.SurfaceName] = prefix + si.encodedPath + a.idx.thumbnails.name(surface)
+		}
+	}
+	return resp
+}
+
+func (a *apiV1) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		a.writeError(w, http.StatusMethodNotAllowed, "method %s not allowed", req.Method)
+		return
+	}
+	segments, ok := apiSegments(req.URL.EscapedPath())
+	switch {
+	case !ok:
+		a.writeError(w, http.StatusNotFound, "unknown API endpoint %q", req.URL.Path)
+	case len(segments) == 1 && segments[0] == "saves":
+		a.listSaves(w, req)
+	case len(segments) == 3 && segments[0] == "saves" && segments[2] == "shots":
+		a.listShots(w, req, segments[1])
+	case len(segments) == 3 && segments[0] == "saves" && segments[2] == "latest":
+		a.latest(w, req, segments[1])
+	case len(segments) == 2 && segments[0] == "schema" && segments[1] == "mapshot.json":
+		a.schema(w, req)
+	case len(segments) == 2 && segments[0] == "shots":
+		a.getShot(w, req, segments[1])
+	default:
+		a.writeError(w, http.StatusNotFound, "unknown API endpoint %q", req.URL.Path)
+	}
+}
+
+// apiSegments splits the escaped path of an API request into its unescaped
+// segments, after /api/v1/. Splitting before unescaping keeps a savename with
+// slashes - escaped as %2F - in a single segment.
+func apiSegments(escapedPath string) ([]string, bool) {
+	segments := strings.Split(strings.TrimPrefix(escapedPath, "/api/v1/"), "/")
+	for i, s := range segments {
+		unescaped, err := url.PathUnescape(s)
+		if err != nil {
+			return nil, false
+		}
+		segments[i] = unescaped
+	}
+	return segments, true
+}
+
+func (a *apiV1) listSaves(w http.ResponseWriter, req *http.Request) {
+	resp := &APISavesResponse{Saves: []*APISave{}}
+	acc := requestAccess(req)
+	for _, savename := range a.idx.savenames() {
+		if !acc.allowed(savename) {
+			continue
+		}
+		shots := a.idx.saveShots(savename)
+		save := &APISave{
+			Savename:  savename,
+			ShotCount: len(shots),
+		}
+		if len(shots) > 0 {
+			save.Root = shots[0].root
+		}
+		if latest := a.idx.latestShot(savename); latest != nil {
+			save.Latest = a.newAPIShot(req, latest)
+		}
+		resp.Saves = append(resp.Saves, save)
+	}
+	a.writeJSON(w, req, resp)
+}
+
+func (a *apiV1) listShots(w http.ResponseWriter, req *http.Request, savename string) {
+	shots := a.idx.saveShots(savename)
+	if shots == nil || !requestAccess(req).allowed(savename) {
+		a.writeError(w, http.StatusNotFound, "unknown save %q", savename)
+		return
+	}
+	noteSave(req, savename)
+	incomplete, _ := strconv.ParseBool(req.URL.Query().Get("incomplete"))
+	resp := &APIShotsResponse{
+		Savename: savename,
+		Shots:    []*APIShot{},
+	}
+	for _, si := range shots {
+		if si.status != shotComplete && !incomplete {
+			continue
+		}
+		resp.Shots = append(resp.Shots, a.newAPIShot(req, si))
+	}
+	a.writeJSON(w, req, resp)
+}
+
+func (a *apiV1) latest(w http.ResponseWriter, req *http.Request, savename string) {
+	si := a.idx.latestShot(savename)
+	if si == nil || !requestAccess(req).allowed(savename) {
+		a.writeError(w, http.StatusNotFound, "no complete shot for save %q", savename)
+		return
+	}
+	noteShot(req, si)
+	a.writeJSON(w, req, a.newAPIShot(req, si))
+}
+
+func (a *apiV1) getShot(w http.ResponseWriter, req *http.Request, id string) {
+	si := a.idx.shotByID(id)
+	if si == nil || !requestAccess(req).allowed(si.savename) {
+		a.writeError(w, http.StatusNotFound, "unknown shot %q", id)
+		return
+	}
+	noteShot(req, si)
+	// mapshot.json is read on demand - it can be large, so only a summary is
+	// kept in memory.
+	data, err := si.loadMapshot()
+	if err != nil {
+		slog.Error("unable to read mapshot", "shot", si.name, "err", err)
+		a.writeError(w, http.StatusInternalServerError, "unable to read mapshot.json")
+		return
+	}
+	resp := a.newAPIShot(req, si)
+	resp.Mapshot = data
+	a.writeJSON(w, req, resp)
+}
+
+func (a *apiV1) schema(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/schema+json")
+	w.Header().Set("Cache-Control", cacheBuiltin)
+	w.Write(shot.Schema)
+}
+
+func (a *apiV1) writeJSON(w http.ResponseWriter, req *http.Request, data interface{}) {
+	raw, err := json.Marshal(data)
+	if err != nil {
+		slog.Error("unable to encode API response", "err", err)
+		a.writeError(w, http.StatusInternalServerError, "unable to encode response")
+		return
+	}
+	newCachedJSON(raw).serve(w, req)
+}
+
+func (a *apiV1) writeError(w http.ResponseWriter, code int, format string, args ...interface{}) {
+	raw, _ := json.Marshal(&APIError{Error: fmt.Sprintf(format, args...)})
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", cacheNone)
+	w.WriteHeader(code)
+	w.Write(raw)
+}
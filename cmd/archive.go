@@ -0,0 +1,435 @@
+package cmd
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/flate"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/fs"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/Palats/mapshot/shot"
+	"github.com/Palats/mapshot/storage"
+)
+
+// Kinds of archives which can contain a shot.
+const (
+	archiveZip   = "zip"
+	archiveTar   = "tar"
+	archiveTarGz = "tar.gz"
+)
+
+// archiveExtensions maps the file extensions of archived shots to their kind.
+var archiveExtensions = []struct {
+	ext  string
+	kind string
+}{
+	{".zip", archiveZip},
+	{".tar.gz", archiveTarGz},
+	{".tgz", archiveTarGz},
+	{".tar", archiveTar},
+}
+
+// archiveKind returns the kind of archive and the name of the shot directory
+// it replaces - e.g., `d-1234` for `d-1234.zip`. Returns "" if the file is
+// not a shot archive.
+func archiveKind(filename string) (string, string) {
+	base := path.Base(filename)
+	if !strings.HasPrefix(base, "d-") {
+		return "", ""
+	}
+	for _, e := range archiveExtensions {
+		if strings.HasSuffix(base, e.ext) {
+			return e.kind, strings.TrimSuffix(base, e.ext)
+		}
+	}
+	return "", ""
+}
+
+// archivedShotDir returns the location of the shot directory the archive
+// replaces, or "" if the file is not a shot archive.
+func archivedShotDir(location string) string {
+	kind, dirname := archiveKind(location)
+	if kind == "" {
+		return ""
+	}
+	return path.Join(path.Dir(location), dirname)
+}
+
+// shotArchives lists the existing archives of a shot directory.
+func shotArchives(store storage.Storage, location string) []string {
+	var found []string
+	for _, e := range archiveExtensions {
+		if info, err := store.Stat(location + e.ext); err == nil && !info.IsDir() {
+			found = append(found, location+e.ext)
+		}
+	}
+	return found
+}
+
+// archiveEntry locates a file within an archive.
+type archiveEntry struct {
+	// Offset of the data in the archive.
+	offset int64
+	// Size of the data in the archive.
+	size int64
+	// Zip compression method; the content is stored as is when zip.Store.
+	method uint16
+	// Size of the content once decompressed; same as size when stored as is.
+	contentSize int64
+}
+
+// shotArchive serves the content of a shot stored in an archive. The archive
+// is indexed once; files are then read directly from it, without extraction.
+//
+// Zip and plain tar archives allow random access. Gzipped tar archives do
+// not - they would have to be decompressed up to each requested file - so
+// they are decompressed once in the archive cache directory, and the plain
+// tar archive is used instead.
+type shotArchive struct {
+	store    storage.Storage
+	location string
+	kind     string
+	modTime  time.Time
+	// Decompressed copy of a gzipped tar archive, in the archive cache
+	// directory; empty for other kinds.
+	cached string
+	// Content of the shot, keyed by path relative to the shot directory.
+	entries map[string]*archiveEntry
+}
+
+// openArchiveFile opens the archive for random access.
+func openArchiveFile(store storage.Storage, location string) (archiveFile, error) {
+	f, err := store.Open(location)
+	if err != nil {
+		return nil, err
+	}
+	af, ok := f.(archiveFile)
+	if !ok {
+		f.Close()
+		return nil, fmt.Errorf("%s: storage does not support random access", location)
+	}
+	return af, nil
+}
+
+// archiveFile is an opened archive. Files of all storages support it.
+type archiveFile interface {
+	fs.File
+	io.ReaderAt
+	io.ReadSeeker
+}
+
+// decompressArchive decompresses a gzipped tar archive in the archive cache
+// directory, unless already done, and returns the location of the plain tar
+// archive. The name of the copy is derived from the location, size and
+// modification time of the archive, so a replaced archive is decompressed
+// again.
+func decompressArchive(store storage.Storage, location string, info fs.FileInfo) (string, error) {
+	if flagArchiveCache == "" {
+		return "", fmt.Errorf("%s: gzipped tar archives must be decompressed, and no --archive_cache is set", location)
+	}
+	key := fmt.Sprintf("%s\x00%s\x00%d\x00%d", store, location, info.Size(), info.ModTime().UnixNano())
+	sum := sha256.Sum256([]byte(key))
+	cached := filepath.Join(flagArchiveCache, hex.EncodeToString(sum[:16])+".tar")
+	if _, err := os.Stat(cached); err == nil {
+		return cached, nil
+	}
+
+	if err := os.MkdirAll(flagArchiveCache, 0755); err != nil {
+		return "", err
+	}
+	f, err := store.Open(location)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		return "", fmt.Errorf("%s: %w", location, err)
+	}
+	// Written under a temporary name, so an interrupted decompression is
+	// never used.
+	tmp, err := os.CreateTemp(flagArchiveCache, ".tmp-*.tar")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := io.Copy(tmp, gz); err != nil {
+		tmp.Close()
+		return "", fmt.Errorf("unable to decompress %s: %w", location, err)
+	}
+	if err := tmp.Close(); err != nil {
+		return "", err
+	}
+	if err := os.Rename(tmp.Name(), cached); err != nil {
+		return "", err
+	}
+	slog.Info("archive decompressed", "location", location, "cached", cached)
+	return cached, nil
+}
+
+// openShotArchive indexes the archive. The content of the shot is either at
+// the root of the archive, or in a single directory - typically `d-<hash>/`.
+func openShotArchive(store storage.Storage, location string) (*shotArchive, error) {
+	kind, _ := archiveKind(location)
+	info, err := store.Stat(location)
+	if err != nil {
+		return nil, err
+	}
+	a := &shotArchive{
+		store:    store,
+		location: location,
+		kind:     kind,
+		modTime:  info.ModTime(),
+	}
+	if kind == archiveTarGz {
+		if a.cached, err = decompressArchive(store, location, info); err != nil {
+			return nil, err
+		}
+	}
+	f, err := a.openFile()
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	entries := map[string]*archiveEntry{}
+	switch kind {
+	case archiveZip:
+		err = indexZip(f, info.Size(), entries)
+	case archiveTar, archiveTarGz:
+		err = indexTar(f, entries)
+	default:
+		err = fmt.Errorf("unknown archive type")
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to index %s: %w", location, err)
+	}
+
+	// Find where the shot is within the archive.
+	prefix := ""
+	if entries[shot.Filename] == nil {
+		for name := range entries {
+			if path.Base(name) == shot.Filename && strings.Count(name, "/") == 1 {
+				prefix = path.Dir(name) + "/"
+				break
+			}
+		}
+		if prefix == "" {
+			return nil, fmt.Errorf("no %s found in %s", shot.Filename, location)
+		}
+	}
+	a.entries = map[string]*archiveEntry{}
+	for name, entry := range entries {
+		if strings.HasPrefix(name, prefix) {
+			a.entries[strings.TrimPrefix(name, prefix)] = entry
+		}
+	}
+	return a, nil
+}
+
+func indexZip(f io.ReaderAt, size int64, entries map[string]*archiveEntry) error {
+	zr, err := zip.NewReader(f, size)
+	if err != nil {
+		return err
+	}
+	for _, zf := range zr.File {
+		if zf.FileInfo().IsDir() {
+			continue
+		}
+		if zf.Method != zip.Store && zf.Method != zip.Deflate {
+			return fmt.Errorf("%s: unsupported compression method %d", zf.Name, zf.Method)
+		}
+		offset, err := zf.DataOffset()
+		if err != nil {
+			return err
+		}
+		entries[path.Clean(zf.Name)] = &archiveEntry{
+			offset:      offset,
+			size:        int64(zf.CompressedSize64),
+			method:      zf.Method,
+			contentSize: int64(zf.UncompressedSize64),
+		}
+	}
+	return nil
+}
+
+// countingReader keeps track of the position in the underlying reader.
+type countingReader struct {
+	r   io.Reader
+	pos int64
+}
+
+func (c *countingReader) Read(b []byte) (int, error) {
+	n, err := c.r.Read(b)
+	c.pos += int64(n)
+	return n, err
+}
+
+// indexTar records the position of the content of each regular file. It
+// relies on archive/tar reading exactly up to the start of the file content
+// when returning a header.
+func indexTar(r io.Reader, entries map[string]*archiveEntry) error {
+	cr := &countingReader{r: r}
+	tr := tar.NewReader(cr)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		entries[path.Clean(hdr.Name)] = &archiveEntry{
+			offset:      cr.pos,
+			size:        hdr.Size,
+			contentSize: hdr.Size,
+		}
+	}
+}
+
+// openFile opens the archive, or its decompressed copy.
+func (a *shotArchive) openFile() (archiveFile, error) {
+	if a.cached == "" {
+		return openArchiveFile(a.store, a.location)
+	}
+	f, err := os.Open(a.cached)
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// open gives access to a file of the shot. Files stored without compression
+// are read directly from the archive; others are decompressed as they are
+// read.
+func (a *shotArchive) open(name string) (io.ReadSeeker, io.Closer, error) {
+	entry := a.entries[name]
+	if entry == nil {
+		return nil, nil, os.ErrNotExist
+	}
+	f, err := a.openFile()
+	if err != nil {
+		return nil, nil, err
+	}
+	section := io.NewSectionReader(f, entry.offset, entry.size)
+	if entry.method == zip.Deflate {
+		inf := &inflater{f: f, section: section, size: entry.contentSize}
+		return inf, inf, nil
+	}
+	return section, f, nil
+}
+
+// inflater streams the content of a deflated zip entry. Seeking is supported,
+// as http.ServeContent needs it: the position is only applied on the next
+// read, by skipping content - restarting from the beginning of the entry when
+// going backward. Finding the size, as done by seeking to the end, is free.
+type inflater struct {
+	f       archiveFile
+	section *io.SectionReader
+	// Size of the decompressed content.
+	size int64
+	// Decompressor, created on first read.
+	r io.ReadCloser
+	// Position of r in the decompressed content.
+	pos int64
+	// Position requested by Seek.
+	target int64
+}
+
+func (inf *inflater) Read(b []byte) (int, error) {
+	if inf.r == nil || inf.target < inf.pos {
+		if inf.r != nil {
+			inf.r.Close()
+		}
+		if _, err := inf.section.Seek(0, io.SeekStart); err != nil {
+			return 0, err
+		}
+		inf.r = flate.NewReader(inf.section)
+		inf.pos = 0
+	}
+	if inf.target > inf.pos {
+		n, err := io.CopyN(ioutil.Discard, inf.r, inf.target-inf.pos)
+		inf.pos += n
+		if err != nil {
+			return 0, err
+		}
+	}
+	n, err := inf.r.Read(b)
+	inf.pos += int64(n)
+	inf.target = inf.pos
+	return n, err
+}
+
+func (inf *inflater) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += inf.target
+	case io.SeekEnd:
+		offset += inf.size
+	default:
+		return 0, fmt.Errorf("invalid whence %d", whence)
+	}
+	if offset < 0 {
+		return 0, fmt.Errorf("negative position %d", offset)
+	}
+	inf.target = offset
+	return offset, nil
+}
+
+func (inf *inflater) Close() error {
+	if inf.r != nil {
+		inf.r.Close()
+	}
+	return inf.f.Close()
+}
+
+// loadMapshot reads mapshot.json from the archive.
+func (a *shotArchive) loadMapshot() (*shot.Mapshot, error) {
+	r, closer, err := a.open(shot.Filename)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read %s from %s: %w", shot.Filename, a.location, err)
+	}
+	defer closer.Close()
+	raw, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read %s from %s: %w", shot.Filename, a.location, err)
+	}
+	m, err := shot.Parse(raw)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", a.location, err)
+	}
+	return m, nil
+}
+
+// ServeHTTP serves the files of the shot; paths are relative to the shot
+// directory.
+func (a *shotArchive) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	name := strings.TrimPrefix(path.Clean(req.URL.Path), "/")
+	content, closer, err := a.open(name)
+	if os.IsNotExist(err) {
+		http.NotFound(w, req)
+		return
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("unable to read %s: %v", name, err), http.StatusInternalServerError)
+		return
+	}
+	defer closer.Close()
+	http.ServeContent(w, req, name, a.modTime, content)
+}
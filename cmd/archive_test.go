@@ -0,0 +1,372 @@
+package cmd
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/Palats/mapshot/storage"
+)
+
+// testArchiveFile is a file to put in a test archive.
+type testArchiveFile struct {
+	name    string
+	content string
+	// Zip only.
+	method uint16
+}
+
+// testShotFiles returns the content of a shot, with files of various sizes to
+// check that offsets are right.
+func testShotFiles(prefix string) []testArchiveFile {
+	return []testArchiveFile{
+		{name: prefix + "mapshot.json", content: `{"unique_id": "1234", "savename": "test", "surfaces": {}}`},
+		{name: prefix + "s1zoom_0/tile_0_0.jpg", content: "tile00"},
+		{name: prefix + "s1zoom_0/tile_-1_0.jpg", content: strings.Repeat("x", 511), method: zip.Deflate},
+		{name: prefix + "s1zoom_1/tile_0_0.jpg", content: strings.Repeat("0123456789", 1000), method: zip.Deflate},
+		{name: prefix + "s1zoom_1/tile_1_0.jpg", content: ""},
+		// Long enough to need a PAX or GNU header in tar.
+		{name: prefix + "s1zoom_1/" + strings.Repeat("long", 40) + ".jpg", content: "long name"},
+	}
+}
+
+func buildZip(t *testing.T, files []testArchiveFile) []byte {
+	t.Helper()
+	var b bytes.Buffer
+	zw := zip.NewWriter(&b)
+	for _, f := range files {
+		w, err := zw.CreateHeader(&zip.FileHeader{Name: f.name, Method: f.method})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write([]byte(f.content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return b.Bytes()
+}
+
+func buildTar(t *testing.T, files []testArchiveFile) []byte {
+	t.Helper()
+	var b bytes.Buffer
+	tw := tar.NewWriter(&b)
+	dirs := map[string]bool{}
+	for _, f := range files {
+		// Directory entries must be skipped by the index.
+		if dir := filepath.ToSlash(filepath.Dir(f.name)); dir != "." && !dirs[dir] {
+			dirs[dir] = true
+			if err := tw.WriteHeader(&tar.Header{Typeflag: tar.TypeDir, Name: dir + "/", Mode: 0o755}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := tw.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: f.name, Size: int64(len(f.content)), Mode: 0o644}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(f.content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return b.Bytes()
+}
+
+// buildTarGz builds a gzipped tar archive.
+func buildTarGz(t *testing.T, files []testArchiveFile) []byte {
+	t.Helper()
+	var b bytes.Buffer
+	gw := gzip.NewWriter(&b)
+	if _, err := gw.Write(buildTar(t, files)); err != nil {
+		t.Fatal(err)
+	}
+	if err := gw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return b.Bytes()
+}
+
+// setArchiveCache uses a temporary archive cache directory for the duration of
+// the test, and returns it.
+func setArchiveCache(t *testing.T) string {
+	t.Helper()
+	old := flagArchiveCache
+	t.Cleanup(func() { flagArchiveCache = old })
+	flagArchiveCache = t.TempDir()
+	return flagArchiveCache
+}
+
+// writeArchive writes the archive in a temporary directory and returns a
+// storage for it.
+func writeArchive(t *testing.T, name string, content []byte) storage.Storage {
+	t.Helper()
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, name), content, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	store, err := storage.NewLocal(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return store
+}
+
+func TestShotArchive(t *testing.T) {
+	tests := []struct {
+		desc     string
+		filename string
+		prefix   string
+		build    func(*testing.T, []testArchiveFile) []byte
+	}{
+		{desc: "zip", filename: "d-1234.zip", build: buildZip},
+		{desc: "zip with directory", filename: "d-1234.zip", prefix: "d-1234/", build: buildZip},
+		{desc: "tar", filename: "d-1234.tar", build: buildTar},
+		{desc: "tar with directory", filename: "d-1234.tar", prefix: "d-1234/", build: buildTar},
+		{desc: "gzipped tar", filename: "d-1234.tar.gz", build: buildTarGz},
+		{desc: "tgz with directory", filename: "d-1234.tgz", prefix: "d-1234/", build: buildTarGz},
+	}
+	for _, tc := range tests {
+		t.Run(tc.desc, func(t *testing.T) {
+			setArchiveCache(t)
+			files := testShotFiles(tc.prefix)
+			store := writeArchive(t, tc.filename, tc.build(t, files))
+			a, err := openShotArchive(store, tc.filename)
+			if err != nil {
+				t.Fatalf("openShotArchive() failed: %v", err)
+			}
+			if len(a.entries) != len(files) {
+				t.Errorf("got %d entries, want %d", len(a.entries), len(files))
+			}
+			for _, f := range files {
+				name := strings.TrimPrefix(f.name, tc.prefix)
+				r, closer, err := a.open(name)
+				if err != nil {
+					t.Errorf("open(%q) failed: %v", name, err)
+					continue
+				}
+				content, err := ioutil.ReadAll(r)
+				closer.Close()
+				if err != nil {
+					t.Errorf("unable to read %q: %v", name, err)
+					continue
+				}
+				if string(content) != f.content {
+					t.Errorf("content of %q = %.20q (%d bytes), want %.20q (%d bytes)", name, content, len(content), f.content, len(f.content))
+				}
+			}
+			if _, _, err := a.open("missing.jpg"); !os.IsNotExist(err) {
+				t.Errorf("open(missing.jpg) = %v, want a not exist error", err)
+			}
+			m, err := a.loadMapshot()
+			if err != nil {
+				t.Fatalf("loadMapshot() failed: %v", err)
+			}
+			if m.UniqueID != "1234" {
+				t.Errorf("unique ID = %q, want 1234", m.UniqueID)
+			}
+		})
+	}
+}
+
+func TestShotArchiveErrors(t *testing.T) {
+	// Cut in the middle of the content of the largest tile.
+	fullTar := buildTar(t, testShotFiles(""))
+	truncatedTar := fullTar[:len(fullTar)/2]
+
+	tests := []struct {
+		desc     string
+		filename string
+		content  []byte
+	}{
+		{desc: "not gzipped", filename: "d-1234.tar.gz", content: fullTar},
+		{desc: "truncated gzipped tar", filename: "d-1234.tgz", content: buildTarGz(t, testShotFiles(""))[:200]},
+		{desc: "no mapshot.json", filename: "d-1234.zip", content: buildZip(t, testShotFiles("")[1:])},
+		{desc: "mapshot.json too deep", filename: "d-1234.tar", content: buildTar(t, testShotFiles("a/b/"))},
+		{desc: "not a zip", filename: "d-1234.zip", content: []byte("not a zip")},
+		{desc: "truncated tar", filename: "d-1234.tar", content: truncatedTar},
+	}
+	for _, tc := range tests {
+		t.Run(tc.desc, func(t *testing.T) {
+			cache := setArchiveCache(t)
+			store := writeArchive(t, tc.filename, tc.content)
+			if _, err := openShotArchive(store, tc.filename); err == nil {
+				t.Errorf("openShotArchive() succeeded, expected an error")
+			}
+			// Failed decompressions leave nothing behind.
+			if entries, err := os.ReadDir(cache); err != nil || len(entries) != 0 {
+				t.Errorf("archive cache content = %v, %v; want nothing", entries, err)
+			}
+		})
+	}
+}
+
+func TestShotArchiveCache(t *testing.T) {
+	cache := setArchiveCache(t)
+	dir := t.TempDir()
+	location := filepath.Join(dir, "d-1234.tar.gz")
+	if err := os.WriteFile(location, buildTarGz(t, testShotFiles("")), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	store, err := storage.NewLocal(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cachedFiles := func() []string {
+		entries, err := os.ReadDir(cache)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var names []string
+		for _, e := range entries {
+			names = append(names, e.Name())
+		}
+		return names
+	}
+
+	a1, err := openShotArchive(store, "d-1234.tar.gz")
+	if err != nil {
+		t.Fatalf("openShotArchive() failed: %v", err)
+	}
+	// Opening again reuses the decompressed copy.
+	a2, err := openShotArchive(store, "d-1234.tar.gz")
+	if err != nil {
+		t.Fatalf("openShotArchive() failed: %v", err)
+	}
+	if a1.cached == "" || a1.cached != a2.cached {
+		t.Errorf("decompressed copies = %q and %q, want the same one", a1.cached, a2.cached)
+	}
+	if got := cachedFiles(); len(got) != 1 {
+		t.Errorf("archive cache content = %q, want a single file", got)
+	}
+
+	// A replaced archive is decompressed again.
+	files := testShotFiles("")
+	files[0].content = `{"unique_id": "5678", "surfaces": {}}`
+	if err := os.WriteFile(location, buildTarGz(t, files), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	a3, err := openShotArchive(store, "d-1234.tar.gz")
+	if err != nil {
+		t.Fatalf("openShotArchive() failed: %v", err)
+	}
+	m, err := a3.loadMapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.UniqueID != "5678" {
+		t.Errorf("unique ID after replacing the archive = %q, want 5678", m.UniqueID)
+	}
+
+	// Without cache directory, gzipped archives cannot be read.
+	flagArchiveCache = ""
+	if _, err := openShotArchive(store, "d-1234.tar.gz"); err == nil {
+		t.Errorf("openShotArchive() without cache directory succeeded, expected an error")
+	}
+}
+
+// TestShotArchiveServeRange checks that ranges work on all kinds of entries,
+// as http.ServeContent seeks around.
+func TestShotArchiveServeRange(t *testing.T) {
+	content := strings.Repeat("0123456789", 1000)
+	for _, method := range []uint16{zip.Store, zip.Deflate} {
+		t.Run(fmt.Sprintf("method %d", method), func(t *testing.T) {
+			files := []testArchiveFile{
+				{name: "mapshot.json", content: `{}`},
+				{name: "tile.jpg", content: content, method: method},
+			}
+			store := writeArchive(t, "d-1234.zip", buildZip(t, files))
+			a, err := openShotArchive(store, "d-1234.zip")
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, rng := range []struct {
+				header     string
+				start, end int
+			}{
+				{"", 0, len(content)},
+				{"bytes=5000-5009", 5000, 5010},
+				{"bytes=-10", len(content) - 10, len(content)},
+				{"bytes=3-7", 3, 8},
+			} {
+				req := httptest.NewRequest(http.MethodGet, "/tile.jpg", nil)
+				if rng.header != "" {
+					req.Header.Set("Range", rng.header)
+				}
+				rec := httptest.NewRecorder()
+				a.ServeHTTP(rec, req)
+				if rec.Code != http.StatusOK && rec.Code != http.StatusPartialContent {
+					t.Fatalf("range %q: got status %d", rng.header, rec.Code)
+				}
+				if got, want := rec.Body.String(), content[rng.start:rng.end]; got != want {
+					t.Errorf("range %q: got %.20q (%d bytes), want %.20q (%d bytes)", rng.header, got, len(got), want, len(want))
+				}
+			}
+		})
+	}
+}
+
+func TestInflaterSeek(t *testing.T) {
+	content := strings.Repeat("abcdefghij", 100)
+	store := writeArchive(t, "d-1234.zip", buildZip(t, []testArchiveFile{
+		{name: "mapshot.json", content: `{}`},
+		{name: "tile.jpg", content: content, method: zip.Deflate},
+	}))
+	a, err := openShotArchive(store, "d-1234.zip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, closer, err := a.open("tile.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closer.Close()
+
+	size, err := r.Seek(0, io.SeekEnd)
+	if err != nil || size != int64(len(content)) {
+		t.Fatalf("Seek(0, SeekEnd) = %d, %v; want %d", size, err, len(content))
+	}
+	buf := make([]byte, 4)
+	for _, step := range []struct {
+		offset int64
+		whence int
+		want   string
+	}{
+		{500, io.SeekStart, "abcd"},
+		{2, io.SeekCurrent, "ghij"},
+		// Backward.
+		{1, io.SeekStart, "bcde"},
+		{-4, io.SeekEnd, "ghij"},
+	} {
+		if _, err := r.Seek(step.offset, step.whence); err != nil {
+			t.Fatalf("Seek(%d, %d) failed: %v", step.offset, step.whence, err)
+		}
+		if _, err := io.ReadFull(r, buf); err != nil {
+			t.Fatalf("read after Seek(%d, %d) failed: %v", step.offset, step.whence, err)
+		}
+		if string(buf) != step.want {
+			t.Errorf("read after Seek(%d, %d) = %q, want %q", step.offset, step.whence, buf, step.want)
+		}
+	}
+	if _, err := r.Seek(-1, io.SeekStart); err == nil {
+		t.Errorf("Seek(-1, SeekStart) succeeded, expected an error")
+	}
+	if _, err := r.Seek(10, io.SeekEnd); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := r.Read(buf); n != 0 || err != io.EOF {
+		t.Errorf("Read() past the end = %d, %v; want 0, EOF", n, err)
+	}
+}
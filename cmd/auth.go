@@ -0,0 +1,327 @@
+package cmd
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// AuthConfig is the content of the file given with --auth_config. It
+// describes how users are authenticated and which saves they can see.
+type AuthConfig struct {
+	// Users which can authenticate with HTTP basic auth.
+	Users []*AuthUser `json:"users,omitempty"`
+	// File containing bearer tokens, one per line, in the form
+	// `<name> <token>`. Empty lines and lines starting with `#` are ignored.
+	// Relative to the directory of the config file.
+	TokensFile string `json:"tokens_file,omitempty"`
+	// Trust a header set by a reverse proxy to identify the user.
+	TrustedProxy *AuthTrustedProxy `json:"trusted_proxy,omitempty"`
+	// Savenames visible by each user, token or proxy identified user, keyed by
+	// name. Entries are patterns, using shell syntax (e.g., `mapshot/*`); `*`
+	// alone gives access to all saves.
+	Access map[string][]string `json:"access,omitempty"`
+	// Savenames visible without authentication, same syntax as `access`. If
+	// empty, authentication is required for everything.
+	Public []string `json:"public,omitempty"`
+}
+
+// AuthUser is a user for HTTP basic auth.
+type AuthUser struct {
+	Name string `json:"name"`
+	// Either the password itself, or its hex encoded SHA-256.
+	Password       string `json:"password,omitempty"`
+	PasswordSHA256 string `json:"password_sha256,omitempty"`
+}
+
+// AuthTrustedProxy describes a reverse proxy which authenticates users.
+type AuthTrustedProxy struct {
+	// Header containing the user name, e.g., `X-Forwarded-User`.
+	Header string `json:"header"`
+	// Addresses of the proxy, in CIDR notation. The header is ignored on
+	// requests coming from anywhere else. Defaults to loopback addresses.
+	Networks []string `json:"networks,omitempty"`
+}
+
+// authenticator identifies the user behind each request and decides which
+// saves it can access.
+type authenticator struct {
+	// SHA-256 of passwords, keyed by user name.
+	users map[string][]byte
+	// Token names, keyed by SHA-256 of the token.
+	tokens      map[string]string
+	proxyHeader string
+	proxyNets   []*net.IPNet
+	access      map[string][]string
+	public      []string
+}
+
+func loadAuthConfig(filename string) (*authenticator, error) {
+	raw, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read auth config: %w", err)
+	}
+	cfg := &AuthConfig{}
+	if err := json.Unmarshal(raw, cfg); err != nil {
+		return nil, fmt.Errorf("unable to parse auth config %s: %w", filename, err)
+	}
+
+	a := &authenticator{
+		users:  map[string][]byte{},
+		tokens: map[string]string{},
+		access: cfg.Access,
+		public: cfg.Public,
+	}
+	for _, u := range cfg.Users {
+		if u.Name == "" {
+			return nil, fmt.Errorf("%s: user without name", filename)
+		}
+		switch {
+		case u.PasswordSHA256 != "":
+			h, err := hex.DecodeString(u.PasswordSHA256)
+			if err != nil || len(h) != sha256.Size {
+				return nil, fmt.Errorf("%s: invalid password_sha256 for user %q", filename, u.Name)
+			}
+			a.users[u.Name] = h
+		case u.Password != "":
+			h := sha256.Sum256([]byte(u.Password))
+			a.users[u.Name] = h[:]
+		default:
+			return nil, fmt.Errorf("%s: no password for user %q", filename, u.Name)
+		}
+	}
+
+	if cfg.TokensFile != "" {
+		tokensFile := cfg.TokensFile
+		if !filepath.IsAbs(tokensFile) {
+			tokensFile = filepath.Join(filepath.Dir(filename), tokensFile)
+		}
+		if err := a.loadTokens(tokensFile); err != nil {
+			return nil, err
+		}
+	}
+
+	if p := cfg.TrustedProxy; p != nil {
+		if p.Header == "" {
+			return nil, fmt.Errorf("%s: trusted_proxy requires a header", filename)
+		}
+		a.proxyHeader = p.Header
+		networks := p.Networks
+		if len(networks) == 0 {
+			networks = []string{"127.0.0.0/8", "::1/128"}
+		}
+		nets, err := parseNetworks(networks)
+		if err != nil {
+			return nil, fmt.Errorf("%s: invalid trusted_proxy network: %w", filename, err)
+		}
+		a.proxyNets = nets
+	}
+
+	var patterns []string
+	patterns = append(patterns, a.public...)
+	for _, p := range a.access {
+		patterns = append(patterns, p...)
+	}
+	for _, pattern := range patterns {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("%s: invalid pattern %q: %w", filename, pattern, err)
+		}
+	}
+	slog.Info("auth config loaded", "users", len(a.users), "tokens", len(a.tokens), "access_entries", len(a.access), "public_patterns", len(a.public))
+	return a, nil
+}
+
+func (a *authenticator) loadTokens(filename string) error {
+	f, err := os.Open(filename)
+	if err != nil {
+		return fmt.Errorf("unable to read tokens: %w", err)
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	lineno := 0
+	for scanner.Scan() {
+		lineno++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return fmt.Errorf("%s:%d: expected `<name> <token>`", filename, lineno)
+		}
+		h := sha256.Sum256([]byte(fields[1]))
+		a.tokens[string(h[:])] = fields[0]
+	}
+	return scanner.Err()
+}
+
+// errBadCredentials is returned when the request has credentials, but they are
+// not valid.
+var errBadCredentials = fmt.Errorf("invalid credentials")
+
+// authenticate returns the name of the user making the request, or "" if the
+// request is anonymous.
+func (a *authenticator) authenticate(req *http.Request) (string, error) {
+	if a.proxyHeader != "" {
+		if name := req.Header.Get(a.proxyHeader); name != "" && a.fromProxy(req) {
+			return name, nil
+		}
+	}
+	// Client certificates are only present when verified against
+	// --tls_client_ca.
+	if req.TLS != nil && len(req.TLS.VerifiedChains) > 0 {
+		if name := req.TLS.VerifiedChains[0][0].Subject.CommonName; name != "" {
+			return name, nil
+		}
+	}
+	authz := req.Header.Get("Authorization")
+	if authz == "" {
+		return "", nil
+	}
+	if name, password, ok := req.BasicAuth(); ok {
+		expected := a.users[name]
+		h := sha256.Sum256([]byte(password))
+		if expected == nil || subtle.ConstantTimeCompare(h[:], expected) != 1 {
+			return "", errBadCredentials
+		}
+		return name, nil
+	}
+	if token := strings.TrimPrefix(authz, "Bearer "); token != authz {
+		// Tokens are looked up by hash, to avoid leaking them through timing.
+		h := sha256.Sum256([]byte(strings.TrimSpace(token)))
+		if name, ok := a.tokens[string(h[:])]; ok {
+			return name, nil
+		}
+	}
+	return "", errBadCredentials
+}
+
+// fromProxy indicates whether the request comes from a trusted proxy.
+func (a *authenticator) fromProxy(req *http.Request) bool {
+	return fromNetworks(req, a.proxyNets)
+}
+
+// challenge asks the client for credentials.
+func (a *authenticator) challenge(w http.ResponseWriter, req *http.Request) {
+	if len(a.users) > 0 {
+		w.Header().Set("WWW-Authenticate", `Basic realm="mapshot", charset="UTF-8"`)
+	} else {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="mapshot"`)
+	}
+	w.Header().Set("Cache-Control", cacheNone)
+	http.Error(w, "authentication required", http.StatusUnauthorized)
+}
+
+// wrap authenticates requests before passing them to the handler, along with
+// the list of saves they can access.
+//
+// Anonymous requests are only accepted when some saves are public; `/login`
+// forces browsers to ask for credentials in that case.
+func (a *authenticator) wrap(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		name, err := a.authenticate(req)
+		if err != nil || (name == "" && (len(a.public) == 0 || req.URL.Path == "/login")) {
+			a.challenge(w, req)
+			return
+		}
+		if req.URL.Path == "/login" {
+			http.Redirect(w, req, requestPrefix(req)+"/", http.StatusFound)
+			return
+		}
+		noteUser(req, name)
+		acc := &saveAccess{patterns: a.public}
+		if name != "" {
+			acc.patterns = append(append([]string{}, a.public...), a.access[name]...)
+		}
+		ctx := context.WithValue(req.Context(), saveAccessKey{}, acc)
+		// Responses depend on the user; shared caches must not keep them.
+		h.ServeHTTP(&privateCacheWriter{ResponseWriter: w}, req.WithContext(ctx))
+	})
+}
+
+type saveAccessKey struct{}
+
+// saveAccess describes which saves a request can see.
+type saveAccess struct {
+	patterns []string
+}
+
+// requestAccess returns the access of the request. It is nil when
+// authentication is not enabled, giving access to everything.
+func requestAccess(req *http.Request) *saveAccess {
+	acc, _ := req.Context().Value(saveAccessKey{}).(*saveAccess)
+	return acc
+}
+
+// all indicates whether all saves are visible.
+func (acc *saveAccess) all() bool {
+	if acc == nil {
+		return true
+	}
+	for _, pattern := range acc.patterns {
+		if pattern == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+// allowed indicates whether the save can be seen.
+func (acc *saveAccess) allowed(savename string) bool {
+	if acc.all() {
+		return true
+	}
+	for _, pattern := range acc.patterns {
+		if ok, _ := path.Match(pattern, savename); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// privateCacheWriter turns public Cache-Control headers into private ones.
+type privateCacheWriter struct {
+	http.ResponseWriter
+	wroteHeader bool
+}
+
+func (w *privateCacheWriter) WriteHeader(code int) {
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+	if cc := w.Header().Get("Cache-Control"); strings.HasPrefix(cc, "public") {
+		w.Header().Set("Cache-Control", "private"+strings.TrimPrefix(cc, "public"))
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+// Unwrap gives access to the underlying writer, for http.ResponseController.
+func (w *privateCacheWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+func (w *privateCacheWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *privateCacheWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
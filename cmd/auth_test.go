@@ -0,0 +1,288 @@
+package cmd
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeAuthConfig writes an auth config and its tokens file in a temporary
+// directory, and loads it.
+func writeAuthConfig(t *testing.T, config string, tokens string) *authenticator {
+	t.Helper()
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "tokens.txt"), []byte(tokens), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	filename := filepath.Join(dir, "auth.json")
+	if err := os.WriteFile(filename, []byte(config), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	a, err := loadAuthConfig(filename)
+	if err != nil {
+		t.Fatalf("loadAuthConfig() failed: %v", err)
+	}
+	return a
+}
+
+func TestSaveAccessAllowed(t *testing.T) {
+	tests := []struct {
+		desc     string
+		patterns []string
+		savename string
+		want     bool
+	}{
+		{desc: "exact", patterns: []string{"mysave"}, savename: "mysave", want: true},
+		{desc: "other save", patterns: []string{"mysave"}, savename: "other", want: false},
+		{desc: "star matches all", patterns: []string{"*"}, savename: "mapshot/deep/save", want: true},
+		{desc: "glob within a directory", patterns: []string{"mapshot/*"}, savename: "mapshot/save1", want: true},
+		{desc: "glob does not cross slashes", patterns: []string{"mapshot/*"}, savename: "mapshot/a/b", want: false},
+		{desc: "glob does not match the prefix alone", patterns: []string{"mapshot/*"}, savename: "mapshot", want: false},
+		{desc: "character class", patterns: []string{"save[0-9]"}, savename: "save3", want: true},
+		{desc: "question mark", patterns: []string{"save?"}, savename: "save10", want: false},
+		{desc: "any of several", patterns: []string{"a", "b/*"}, savename: "b/c", want: true},
+		{desc: "no pattern", patterns: nil, savename: "mysave", want: false},
+	}
+	for _, tc := range tests {
+		t.Run(tc.desc, func(t *testing.T) {
+			acc := &saveAccess{patterns: tc.patterns}
+			if got := acc.allowed(tc.savename); got != tc.want {
+				t.Errorf("allowed(%q) with %q = %v, want %v", tc.savename, tc.patterns, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestSaveAccessNil(t *testing.T) {
+	var acc *saveAccess
+	if !acc.all() || !acc.allowed("anything") {
+		t.Errorf("without authentication, all saves must be visible")
+	}
+}
+
+func TestLoadAuthConfigErrors(t *testing.T) {
+	tests := []struct {
+		desc   string
+		config string
+	}{
+		{desc: "invalid JSON", config: `{`},
+		{desc: "user without name", config: `{"users": [{"password": "a"}]}`},
+		{desc: "user without password", config: `{"users": [{"name": "a"}]}`},
+		{desc: "invalid hash", config: `{"users": [{"name": "a", "password_sha256": "1234"}]}`},
+		{desc: "proxy without header", config: `{"trusted_proxy": {}}`},
+		{desc: "invalid network", config: `{"trusted_proxy": {"header": "X-User", "networks": ["nope"]}}`},
+		{desc: "invalid pattern", config: `{"public": ["save["]}`},
+		{desc: "invalid access pattern", config: `{"access": {"a": ["[x"]}}`},
+		{desc: "missing tokens file", config: `{"tokens_file": "missing.txt"}`},
+		{desc: "invalid tokens file", config: `{"tokens_file": "tokens.txt"}`},
+	}
+	for _, tc := range tests {
+		t.Run(tc.desc, func(t *testing.T) {
+			dir := t.TempDir()
+			if err := os.WriteFile(filepath.Join(dir, "tokens.txt"), []byte("only-one-field\n"), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			filename := filepath.Join(dir, "auth.json")
+			if err := os.WriteFile(filename, []byte(tc.config), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := loadAuthConfig(filename); err == nil {
+				t.Errorf("loadAuthConfig(%s) succeeded, expected an error", tc.config)
+			}
+		})
+	}
+}
+
+func TestAuthenticate(t *testing.T) {
+	hashed := sha256.Sum256([]byte("secret2"))
+	a := writeAuthConfig(t, `{
+		"users": [
+			{"name": "alice", "password": "secret1"},
+			{"name": "bob", "password_sha256": "`+hex.EncodeToString(hashed[:])+`"}
+		],
+		"tokens_file": "tokens.txt",
+		"trusted_proxy": {"header": "X-Forwarded-User", "networks": ["10.0.0.0/8"]}
+	}`, "# Comment.\n\nbot sometoken\n")
+
+	tests := []struct {
+		desc       string
+		remoteAddr string
+		header     map[string]string
+		basicUser  string
+		basicPass  string
+		want       string
+		wantErr    bool
+	}{
+		{desc: "anonymous", want: ""},
+		{desc: "basic auth", basicUser: "alice", basicPass: "secret1", want: "alice"},
+		{desc: "basic auth with hashed password", basicUser: "bob", basicPass: "secret2", want: "bob"},
+		{desc: "wrong password", basicUser: "alice", basicPass: "secret2", wantErr: true},
+		{desc: "unknown user", basicUser: "carol", basicPass: "secret1", wantErr: true},
+		{desc: "token", header: map[string]string{"Authorization": "Bearer sometoken"}, want: "bot"},
+		{desc: "unknown token", header: map[string]string{"Authorization": "Bearer other"}, wantErr: true},
+		{desc: "token line is not a token", header: map[string]string{"Authorization": "Bearer bot"}, wantErr: true},
+		{desc: "unknown scheme", header: map[string]string{"Authorization": "Digest foo"}, wantErr: true},
+		{
+			desc:       "trusted proxy",
+			remoteAddr: "10.1.2.3:4567",
+			header:     map[string]string{"X-Forwarded-User": "dave"},
+			want:       "dave",
+		},
+		{
+			desc:       "proxy header from elsewhere is ignored",
+			remoteAddr: "192.0.2.1:4567",
+			header:     map[string]string{"X-Forwarded-User": "dave"},
+			want:       "",
+		},
+		{
+			desc:       "proxy header from elsewhere falls back to credentials",
+			remoteAddr: "192.0.2.1:4567",
+			header:     map[string]string{"X-Forwarded-User": "dave"},
+			basicUser:  "alice",
+			basicPass:  "secret1",
+			want:       "alice",
+		},
+		{
+			desc:       "trusted proxy without header uses credentials",
+			remoteAddr: "10.1.2.3:4567",
+			basicUser:  "alice",
+			basicPass:  "secret1",
+			want:       "alice",
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.desc, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			if tc.remoteAddr != "" {
+				req.RemoteAddr = tc.remoteAddr
+			}
+			for k, v := range tc.header {
+				req.Header.Set(k, v)
+			}
+			if tc.basicUser != "" {
+				req.SetBasicAuth(tc.basicUser, tc.basicPass)
+			}
+			got, err := a.authenticate(req)
+			if tc.wantErr {
+				if err == nil {
+					t.Fatalf("authenticate() = %q, expected an error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("authenticate() failed: %v", err)
+			}
+			if got != tc.want {
+				t.Errorf("authenticate() = %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestTrustedProxyDefaultsToLoopback(t *testing.T) {
+	a := writeAuthConfig(t, `{"trusted_proxy": {"header": "X-User"}}`, "")
+	for _, tc := range []struct {
+		remoteAddr string
+		want       string
+	}{
+		{"127.0.0.1:1234", "eve"},
+		{"[::1]:1234", "eve"},
+		{"192.0.2.1:1234", ""},
+		{"not-an-address", ""},
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.RemoteAddr = tc.remoteAddr
+		req.Header.Set("X-User", "eve")
+		got, err := a.authenticate(req)
+		if err != nil {
+			t.Fatalf("authenticate() from %s failed: %v", tc.remoteAddr, err)
+		}
+		if got != tc.want {
+			t.Errorf("authenticate() from %s = %q, want %q", tc.remoteAddr, got, tc.want)
+		}
+	}
+}
+
+func TestAuthenticatorWrap(t *testing.T) {
+	a := writeAuthConfig(t, `{
+		"users": [{"name": "alice", "password": "secret"}],
+		"access": {"alice": ["private/*"]},
+		"public": ["public/*"]
+	}`, "")
+	// The handler reports which saves the request can see.
+	h := a.wrap(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Cache-Control", "public, max-age=60")
+		var visible []string
+		for _, savename := range []string{"public/a", "private/b", "other"} {
+			if requestAccess(req).allowed(savename) {
+				visible = append(visible, savename)
+			}
+		}
+		w.Write([]byte(strings.Join(visible, ",")))
+	}))
+
+	tests := []struct {
+		desc         string
+		path         string
+		user         string
+		password     string
+		wantCode     int
+		wantBody     string
+		wantLocation string
+	}{
+		{desc: "anonymous sees public saves", path: "/", wantCode: http.StatusOK, wantBody: "public/a"},
+		{desc: "user sees its saves too", path: "/", user: "alice", password: "secret", wantCode: http.StatusOK, wantBody: "public/a,private/b"},
+		{desc: "bad credentials", path: "/", user: "alice", password: "nope", wantCode: http.StatusUnauthorized},
+		{desc: "login asks anonymous for credentials", path: "/login", wantCode: http.StatusUnauthorized},
+		{desc: "login redirects once authenticated", path: "/login", user: "alice", password: "secret", wantCode: http.StatusFound, wantLocation: "/"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.desc, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, tc.path, nil)
+			if tc.user != "" {
+				req.SetBasicAuth(tc.user, tc.password)
+			}
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+			if rec.Code != tc.wantCode {
+				t.Fatalf("got status %d, want %d", rec.Code, tc.wantCode)
+			}
+			switch tc.wantCode {
+			case http.StatusOK:
+				if got := rec.Body.String(); got != tc.wantBody {
+					t.Errorf("visible saves = %q, want %q", got, tc.wantBody)
+				}
+				if got, want := rec.Header().Get("Cache-Control"), "private, max-age=60"; got != want {
+					t.Errorf("Cache-Control = %q, want %q", got, want)
+				}
+			case http.StatusUnauthorized:
+				if got := rec.Header().Get("WWW-Authenticate"); !strings.HasPrefix(got, "Basic ") {
+					t.Errorf("WWW-Authenticate = %q, want a basic auth challenge", got)
+				}
+			case http.StatusFound:
+				if got := rec.Header().Get("Location"); got != tc.wantLocation {
+					t.Errorf("Location = %q, want %q", got, tc.wantLocation)
+				}
+			}
+		})
+	}
+}
+
+func TestAuthenticatorWrapNoPublic(t *testing.T) {
+	a := writeAuthConfig(t, `{"tokens_file": "tokens.txt"}`, "bot tok\n")
+	h := a.wrap(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {}))
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusUnauthorized {
+		t.Fatalf("anonymous request: got status %d, want %d", rec.Code, http.StatusUnauthorized)
+	}
+	if got := rec.Header().Get("WWW-Authenticate"); !strings.HasPrefix(got, "Bearer ") {
+		t.Errorf("WWW-Authenticate = %q, want a bearer challenge", got)
+	}
+}
@@ -0,0 +1,165 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+)
+
+// normalizeBasePath validates the value of --base_path. The result has a
+// leading slash and no trailing slash; it is empty when serving at the root.
+func normalizeBasePath(p string) (string, error) {
+	if p == "" || p == "/" {
+		return "", nil
+	}
+	if !strings.HasPrefix(p, "/") {
+		return "", fmt.Errorf("invalid base path %q: must start with /", p)
+	}
+	return path.Clean(p), nil
+}
+
+// parseNetworks parses a list of networks in CIDR notation.
+func parseNetworks(networks []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, n := range networks {
+		_, ipnet, err := net.ParseCIDR(n)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, ipnet)
+	}
+	return nets, nil
+}
+
+// fromNetworks indicates whether the request comes from one of the networks.
+func fromNetworks(req *http.Request, nets []*net.IPNet) bool {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+type externalKey struct{}
+
+// external is how clients reach the server.
+type external struct {
+	// Scheme and host, e.g., `https://example.org`.
+	origin string
+	// See requestPrefix.
+	prefix string
+}
+
+// requestPrefix returns the URL path under which clients see the server for
+// that request, without trailing slash; it is empty when the server is at the
+// root. Paths generated for clients - e.g., encoded paths of shots - must be
+// prefixed with it.
+func requestPrefix(req *http.Request) string {
+	ext, _ := req.Context().Value(externalKey{}).(*external)
+	if ext == nil {
+		return ""
+	}
+	return ext.prefix
+}
+
+// requestBaseURL returns the absolute URL of the server as seen by the client,
+// without trailing slash - e.g., for links shared outside of the UI.
+func requestBaseURL(req *http.Request) string {
+	ext, _ := req.Context().Value(externalKey{}).(*external)
+	if ext == nil {
+		return ""
+	}
+	return ext.origin + ext.prefix
+}
+
+// firstForwarded returns the first value of a X-Forwarded-* header, as set by
+// the proxy closest to the client.
+func firstForwarded(req *http.Request, header string) string {
+	return strings.TrimSpace(strings.Split(req.Header.Get(header), ",")[0])
+}
+
+// trimRawPath removes the base path from the escaped path of a request, as
+// sent by the client. The base path can be escaped in different ways, so
+// segments are compared once unescaped. It returns "" if the raw path does not
+// start with the base path.
+func trimRawPath(rawPath string, basePath string) string {
+	count := strings.Count(basePath, "/")
+	segments := strings.SplitN(rawPath, "/", count+2)
+	if len(segments) < count+2 {
+		return ""
+	}
+	if prefix, err := url.PathUnescape(strings.Join(segments[:count+1], "/")); err != nil || prefix != basePath {
+		return ""
+	}
+	return "/" + segments[count+1]
+}
+
+// withBasePath serves h under basePath, as normalized by normalizeBasePath:
+// handlers see paths without it. Requests outside of it are rejected.
+//
+// Reverse proxies which remove a prefix before forwarding requests can
+// indicate it with X-Forwarded-Prefix; along with X-Forwarded-Proto and
+// X-Forwarded-Host, it is only trusted from the given networks. The full
+// prefix seen by the client is available to handlers through requestPrefix.
+func withBasePath(h http.Handler, basePath string, trusted []*net.IPNet) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		ext := &external{prefix: basePath}
+		scheme, host := "http", req.Host
+		if req.TLS != nil {
+			scheme = "https"
+		}
+		if fromNetworks(req, trusted) {
+			if fwd := firstForwarded(req, "X-Forwarded-Prefix"); strings.HasPrefix(fwd, "/") {
+				if fwd = path.Clean(fwd); fwd != "/" {
+					ext.prefix = fwd + basePath
+				}
+			}
+			if fwd := firstForwarded(req, "X-Forwarded-Proto"); fwd == "http" || fwd == "https" {
+				scheme = fwd
+			}
+			if fwd := firstForwarded(req, "X-Forwarded-Host"); fwd != "" {
+				host = fwd
+			}
+		}
+		ext.origin = scheme + "://" + host
+
+		if basePath != "" {
+			if req.URL.Path == basePath {
+				// Frontends use relative URLs, which requires the trailing
+				// slash.
+				target := ext.prefix + "/"
+				if req.URL.RawQuery != "" {
+					target += "?" + req.URL.RawQuery
+				}
+				http.Redirect(w, req, target, http.StatusMovedPermanently)
+				return
+			}
+			p := strings.TrimPrefix(req.URL.Path, basePath)
+			if p == req.URL.Path || !strings.HasPrefix(p, "/") {
+				http.NotFound(w, req)
+				return
+			}
+			r := req.Clone(req.Context())
+			r.URL.Path = p
+			r.URL.RawPath = ""
+			if req.URL.RawPath != "" {
+				r.URL.RawPath = trimRawPath(req.URL.RawPath, basePath)
+			}
+			req = r
+		}
+		h.ServeHTTP(w, req.WithContext(context.WithValue(req.Context(), externalKey{}, ext)))
+	})
+}
@@ -0,0 +1,276 @@
+package cmd
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestNormalizeBasePath(t *testing.T) {
+	tests := []struct {
+		input   string
+		want    string
+		wantErr bool
+	}{
+		{input: "", want: ""},
+		{input: "/", want: ""},
+		{input: "/mapshot", want: "/mapshot"},
+		{input: "/mapshot/", want: "/mapshot"},
+		{input: "/a//b/../c/", want: "/a/c"},
+		{input: "mapshot", wantErr: true},
+	}
+	for _, tc := range tests {
+		got, err := normalizeBasePath(tc.input)
+		if tc.wantErr {
+			if err == nil {
+				t.Errorf("normalizeBasePath(%q) = %q, expected an error", tc.input, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("normalizeBasePath(%q) failed: %v", tc.input, err)
+			continue
+		}
+		if got != tc.want {
+			t.Errorf("normalizeBasePath(%q) = %q, want %q", tc.input, got, tc.want)
+		}
+	}
+}
+
+func TestWithBasePath(t *testing.T) {
+	trusted, err := parseNetworks([]string{"10.0.0.0/8"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		desc       string
+		basePath   string
+		target     string
+		remoteAddr string
+		header     map[string]string
+
+		wantCode     int
+		wantLocation string
+		// What the handler sees.
+		wantPath    string
+		wantRawPath string
+		wantPrefix  string
+		wantBaseURL string
+	}{
+		{
+			desc:        "no base path",
+			target:      "/data/x",
+			wantCode:    http.StatusOK,
+			wantPath:    "/data/x",
+			wantPrefix:  "",
+			wantBaseURL: "http://example.org",
+		},
+		{
+			desc:        "base path removed",
+			basePath:    "/mapshot",
+			target:      "/mapshot/data/x",
+			wantCode:    http.StatusOK,
+			wantPath:    "/data/x",
+			wantPrefix:  "/mapshot",
+			wantBaseURL: "http://example.org/mapshot",
+		},
+		{
+			desc:        "root under base path",
+			basePath:    "/mapshot",
+			target:      "/mapshot/",
+			wantCode:    http.StatusOK,
+			wantPath:    "/",
+			wantPrefix:  "/mapshot",
+			wantBaseURL: "http://example.org/mapshot",
+		},
+		{
+			desc:         "base path without trailing slash",
+			basePath:     "/mapshot",
+			target:       "/mapshot?path=a",
+			wantCode:     http.StatusMovedPermanently,
+			wantLocation: "/mapshot/?path=a",
+		},
+		{
+			desc:     "outside of base path",
+			basePath: "/mapshot",
+			target:   "/other/data",
+			wantCode: http.StatusNotFound,
+		},
+		{
+			desc:     "base path as a prefix of a segment",
+			basePath: "/mapshot",
+			target:   "/mapshots/data",
+			wantCode: http.StatusNotFound,
+		},
+		{
+			desc:        "escaped path keeps its raw form",
+			basePath:    "/mapshot",
+			target:      "/mapshot/api/v1/saves/a%2Fb/shots",
+			wantCode:    http.StatusOK,
+			wantPath:    "/api/v1/saves/a/b/shots",
+			wantRawPath: "/api/v1/saves/a%2Fb/shots",
+			wantPrefix:  "/mapshot",
+			wantBaseURL: "http://example.org/mapshot",
+		},
+		{
+			desc:        "base path encoded differently",
+			basePath:    "/map shot",
+			target:      "/map%20shot/a%2Fb",
+			wantCode:    http.StatusOK,
+			wantPath:    "/a/b",
+			wantRawPath: "/a%2Fb",
+			wantPrefix:  "/map shot",
+			wantBaseURL: "http://example.org/map shot",
+		},
+		{
+			desc:       "forwarded headers from a trusted proxy",
+			basePath:   "/mapshot",
+			target:     "/mapshot/data/x",
+			remoteAddr: "10.1.2.3:1234",
+			header: map[string]string{
+				"X-Forwarded-Prefix": "/proxied/",
+				"X-Forwarded-Proto":  "https",
+				"X-Forwarded-Host":   "public.example.org",
+			},
+			wantCode:    http.StatusOK,
+			wantPath:    "/data/x",
+			wantPrefix:  "/proxied/mapshot",
+			wantBaseURL: "https://public.example.org/proxied/mapshot",
+		},
+		{
+			desc:       "closest proxy wins",
+			target:     "/data/x",
+			remoteAddr: "10.1.2.3:1234",
+			header: map[string]string{
+				"X-Forwarded-Prefix": "/first, /second",
+				"X-Forwarded-Host":   "first.example.org, second.example.org",
+			},
+			wantCode:    http.StatusOK,
+			wantPath:    "/data/x",
+			wantPrefix:  "/first",
+			wantBaseURL: "http://first.example.org/first",
+		},
+		{
+			desc:       "forwarded headers from elsewhere are ignored",
+			basePath:   "/mapshot",
+			target:     "/mapshot/data/x",
+			remoteAddr: "192.0.2.1:1234",
+			header: map[string]string{
+				"X-Forwarded-Prefix": "/proxied",
+				"X-Forwarded-Proto":  "https",
+				"X-Forwarded-Host":   "public.example.org",
+			},
+			wantCode:    http.StatusOK,
+			wantPath:    "/data/x",
+			wantPrefix:  "/mapshot",
+			wantBaseURL: "http://example.org/mapshot",
+		},
+		{
+			desc:       "invalid forwarded values are ignored",
+			target:     "/data/x",
+			remoteAddr: "10.1.2.3:1234",
+			header: map[string]string{
+				"X-Forwarded-Prefix": "relative",
+				"X-Forwarded-Proto":  "gopher",
+			},
+			wantCode:    http.StatusOK,
+			wantPath:    "/data/x",
+			wantPrefix:  "",
+			wantBaseURL: "http://example.org",
+		},
+		{
+			desc:       "forwarded root prefix",
+			basePath:   "/mapshot",
+			target:     "/mapshot/data/x",
+			remoteAddr: "10.1.2.3:1234",
+			header: map[string]string{
+				"X-Forwarded-Prefix": "/",
+			},
+			wantCode:    http.StatusOK,
+			wantPath:    "/data/x",
+			wantPrefix:  "/mapshot",
+			wantBaseURL: "http://example.org/mapshot",
+		},
+		{
+			desc:       "redirect uses the forwarded prefix",
+			basePath:   "/mapshot",
+			target:     "/mapshot",
+			remoteAddr: "10.1.2.3:1234",
+			header: map[string]string{
+				"X-Forwarded-Prefix": "/proxied",
+			},
+			wantCode:     http.StatusMovedPermanently,
+			wantLocation: "/proxied/mapshot/",
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.desc, func(t *testing.T) {
+			var gotPath, gotRawPath, gotPrefix, gotBaseURL string
+			h := withBasePath(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				gotPath = req.URL.Path
+				gotRawPath = req.URL.RawPath
+				gotPrefix = requestPrefix(req)
+				gotBaseURL = requestBaseURL(req)
+			}), tc.basePath, trusted)
+
+			req := httptest.NewRequest(http.MethodGet, "http://example.org"+tc.target, nil)
+			if tc.remoteAddr != "" {
+				req.RemoteAddr = tc.remoteAddr
+			}
+			for k, v := range tc.header {
+				req.Header.Set(k, v)
+			}
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+
+			if rec.Code != tc.wantCode {
+				t.Fatalf("got status %d, want %d", rec.Code, tc.wantCode)
+			}
+			if tc.wantLocation != "" {
+				if got := rec.Header().Get("Location"); got != tc.wantLocation {
+					t.Errorf("Location = %q, want %q", got, tc.wantLocation)
+				}
+			}
+			if tc.wantCode != http.StatusOK {
+				return
+			}
+			if gotPath != tc.wantPath {
+				t.Errorf("path = %q, want %q", gotPath, tc.wantPath)
+			}
+			if gotRawPath != tc.wantRawPath {
+				t.Errorf("raw path = %q, want %q", gotRawPath, tc.wantRawPath)
+			}
+			if gotPrefix != tc.wantPrefix {
+				t.Errorf("requestPrefix() = %q, want %q", gotPrefix, tc.wantPrefix)
+			}
+			if gotBaseURL != tc.wantBaseURL {
+				t.Errorf("requestBaseURL() = %q, want %q", gotBaseURL, tc.wantBaseURL)
+			}
+		})
+	}
+}
+
+func TestTrimRawPath(t *testing.T) {
+	tests := []struct {
+		rawPath  string
+		basePath string
+		want     string
+	}{
+		{"/mapshot/a%2Fb", "/mapshot", "/a%2Fb"},
+		{"/map%20shot/a%2Fb", "/map shot", "/a%2Fb"},
+		{"/m%61pshot/a%2Fb", "/mapshot", "/a%2Fb"},
+		{"/a/b/c%2Fd/e", "/a/b", "/c%2Fd/e"},
+		{"/mapshot/", "/mapshot", "/"},
+		{"/mapshot", "/mapshot", ""},
+		{"/other/a%2Fb", "/mapshot", ""},
+		// An escaped slash is not a segment separator.
+		{"/a%2Fb/c", "/a/b", ""},
+		{"/%zz/a", "/mapshot", ""},
+	}
+	for _, tc := range tests {
+		if got := trimRawPath(tc.rawPath, tc.basePath); got != tc.want {
+			t.Errorf("trimRawPath(%q, %q) = %q, want %q", tc.rawPath, tc.basePath, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,95 @@
+package cmd
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"regexp"
+	"time"
+)
+
+// Values of Cache-Control header.
+const (
+	// For content which never changes - content of complete mapshots, and
+	// frontend files with a hash in their name.
+	cacheImmutable = "public, max-age=31536000, immutable"
+	// For built-in frontend files without hash in their name; they only change
+	// with new releases.
+	cacheBuiltin = "public, max-age=3600"
+	// For content which changes in place when new mapshots are created -
+	// shots.json, latest, API.
+	cacheShort = "public, max-age=10, must-revalidate"
+	// For content which can change at any time - e.g., mapshots still being
+	// rendered.
+	cacheNone = "no-cache"
+)
+
+// hashedFilename matches frontend files names which contain a hash of their
+// content, as generated by rollup.
+var hashedFilename = regexp.MustCompile(`-[0-9a-f]{8,}\.[a-z]+$`)
+
+// cachedJSON is a JSON document along with its ETag.
+type cachedJSON struct {
+	data []byte
+	etag string
+}
+
+func newCachedJSON(data []byte) *cachedJSON {
+	h := sha256.Sum256(data)
+	return &cachedJSON{
+		data: data,
+		etag: `"` + hex.EncodeToString(h[:16]) + `"`,
+	}
+}
+
+// serve sends the document, taking care of conditional requests.
+func (c *cachedJSON) serve(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", cacheShort)
+	w.Header().Set("ETag", c.etag)
+	http.ServeContent(w, req, "", time.Time{}, bytes.NewReader(c.data))
+}
+
+// cacheControlWriter sets the Cache-Control header on successful responses
+// only - errors, such as missing tiles, must not be cached for long. Missing
+// tiles known from the manifest of their shot are answered with 204 No
+// Content, which is as definitive as the tiles themselves.
+type cacheControlWriter struct {
+	http.ResponseWriter
+	value       string
+	wroteHeader bool
+}
+
+func (w *cacheControlWriter) WriteHeader(code int) {
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+	if code == http.StatusOK || code == http.StatusNoContent || code == http.StatusPartialContent || code == http.StatusNotModified {
+		w.Header().Set("Cache-Control", w.value)
+	} else {
+		w.Header().Set("Cache-Control", cacheNone)
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+// Unwrap gives access to the underlying writer, for http.ResponseController.
+func (w *cacheControlWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+func (w *cacheControlWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// withCacheControl wraps the handler to set the Cache-Control header on
+// successful responses.
+func withCacheControl(h http.Handler, value string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		h.ServeHTTP(&cacheControlWriter{ResponseWriter: w, value: value}, req)
+	})
+}
@@ -0,0 +1,177 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	_ "image/jpeg" // Tiles are JPEG.
+	"io/fs"
+	"math"
+
+	"github.com/Palats/mapshot/shot"
+	xdraw "golang.org/x/image/draw"
+	"golang.org/x/image/math/f64"
+)
+
+// readTile decodes a tile of the shot. It returns an error satisfying
+// errors.Is(err, fs.ErrNotExist) when the tile does not exist - the mod does
+// not write tiles which would only contain empty areas. Tiles pruned by
+// `mapshot optimize` are recreated from their color.
+func readTile(si *shotInfo, surface *shot.Surface, zoom, x, y int) (image.Image, error) {
+	name := surface.TilePath(zoom, x, y)
+	r, err := si.open(name)
+	if errors.Is(err, fs.ErrNotExist) {
+		if t, ok := si.uniformTile(name); ok {
+			return t.image(), nil
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	img, _, err := image.Decode(r)
+	if err != nil {
+		return nil, fmt.Errorf("unable to decode %s of %s: %w", name, si.name, err)
+	}
+	return img, nil
+}
+
+// drawArea draws an area of the surface, in world coordinates, onto the full
+// bounds of dst, using the tiles of the given zoom level. Tiles are scaled as
+// needed. As in the viewer, missing tiles are replaced by the matching part of
+// less detailed tiles; parts of dst without any tile are left untouched.
+func drawArea(si *shotInfo, surface *shot.Surface, zoom int, area shot.BoundingBox, dst draw.Image) error {
+	b := dst.Bounds()
+	width := area.RightBottom.X - area.LeftTop.X
+	height := area.RightBottom.Y - area.LeftTop.Y
+	if width <= 0 || height <= 0 || b.Empty() {
+		return nil
+	}
+	c := &compositor{
+		si:      si,
+		surface: surface,
+		area:    area,
+		dst:     dst,
+		origin:  b.Min,
+		sx:      float64(b.Dx()) / width,
+		sy:      float64(b.Dy()) / height,
+	}
+	return c.drawTiles(zoom, b)
+}
+
+// compositor draws an area of a surface onto an image.
+type compositor struct {
+	si      *shotInfo
+	surface *shot.Surface
+	area    shot.BoundingBox
+	dst     draw.Image
+	// Coordinates in dst of the left top corner of the area. Parts of the area
+	// can be outside of dst - e.g., when drawing a large image in bands.
+	origin image.Point
+	// Pixels of dst per world unit.
+	sx, sy float64
+}
+
+// toPixel converts world coordinates to coordinates in dst.
+func (c *compositor) toPixel(x, y float64) (float64, float64) {
+	return (x-c.area.LeftTop.X)*c.sx + float64(c.origin.X), (y-c.area.LeftTop.Y)*c.sy + float64(c.origin.Y)
+}
+
+// toWorld converts coordinates in dst to world coordinates.
+func (c *compositor) toWorld(px, py int) (float64, float64) {
+	return float64(px-c.origin.X)/c.sx + c.area.LeftTop.X, float64(py-c.origin.Y)/c.sy + c.area.LeftTop.Y
+}
+
+// drawTiles draws the tiles of the zoom level onto the clip rectangle of dst.
+func (c *compositor) drawTiles(zoom int, clip image.Rectangle) error {
+	ts := c.surface.TileSizeAt(zoom)
+	minX, minY, maxX, maxY := c.surface.TileRange(zoom)
+	// Only the tiles overlapping the clip rectangle are needed.
+	wx0, wy0 := c.toWorld(clip.Min.X, clip.Min.Y)
+	wx1, wy1 := c.toWorld(clip.Max.X, clip.Max.Y)
+	minX = max(minX, int(math.Floor(wx0/ts)))
+	minY = max(minY, int(math.Floor(wy0/ts)))
+	maxX = min(maxX, int(math.Ceil(wx1/ts))-1)
+	maxY = min(maxY, int(math.Ceil(wy1/ts))-1)
+
+	dst, ok := c.dst.(interface {
+		SubImage(image.Rectangle) image.Image
+	})
+	if !ok {
+		return fmt.Errorf("image type %T not supported", c.dst)
+	}
+	clipped := dst.SubImage(clip).(draw.Image)
+	for y := minY; y <= maxY; y++ {
+		for x := minX; x <= maxX; x++ {
+			px0, py0 := c.toPixel(float64(x)*ts, float64(y)*ts)
+			px1, py1 := c.toPixel(float64(x+1)*ts, float64(y+1)*ts)
+			tile, err := readTile(c.si, c.surface, zoom, x, y)
+			if errors.Is(err, fs.ErrNotExist) {
+				if zoom > c.surface.ZoomMin {
+					r := image.Rect(int(math.Round(px0)), int(math.Round(py0)), int(math.Round(px1)), int(math.Round(py1))).Intersect(clip)
+					if !r.Empty() {
+						if err := c.drawTiles(zoom-1, r); err != nil {
+							return err
+						}
+					}
+				}
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			tb := tile.Bounds()
+			// Pixels of dst per pixel of the tile.
+			kx := (px1 - px0) / float64(tb.Dx())
+			ky := (py1 - py0) / float64(tb.Dy())
+			s2d := f64.Aff3{
+				kx, 0, px0 - float64(tb.Min.X)*kx,
+				0, ky, py0 - float64(tb.Min.Y)*ky,
+			}
+			// Catmull-Rom gives good results when downscaling, which is the
+			// common case.
+			xdraw.CatmullRom.Transform(clipped, s2d, tile, tb, xdraw.Src, nil)
+		}
+	}
+	return nil
+}
+
+// viewport is a view of a surface as shown by the viewer: the position of the
+// center, in world coordinates, and the Leaflet zoom level - as in the `x`,
+// `y` and `z` query parameters of the viewer.
+type viewport struct {
+	x, y, z float64
+}
+
+// area returns the part of the world visible in the viewport, when displayed
+// with the given size in pixels.
+func (v viewport) area(surface *shot.Surface, width, height int) shot.BoundingBox {
+	// Pixels per world unit; at zoom 0, a tile of the least detailed level is
+	// render_size pixels wide.
+	scale := float64(surface.RenderSize) / surface.TileSize * math.Pow(2, v.z)
+	halfW := float64(width) / 2 / scale
+	halfH := float64(height) / 2 / scale
+	return shot.BoundingBox{
+		LeftTop:     shot.Position{X: v.x - halfW, Y: v.y - halfH},
+		RightBottom: shot.Position{X: v.x + halfW, Y: v.y + halfH},
+	}
+}
+
+// tileZoom returns the zoom level of the tiles to use to display the viewport,
+// the same way as the viewer.
+func (v viewport) tileZoom(surface *shot.Surface) int {
+	return min(max(int(math.Round(v.z)), surface.ZoomMin), surface.ZoomMax)
+}
+
+// renderViewport draws what the viewer shows of the surface in a window of the
+// given size. Areas without tiles are black.
+func renderViewport(si *shotInfo, surface *shot.Surface, v viewport, width, height int) (*image.RGBA, error) {
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.Draw(img, img.Bounds(), image.NewUniform(color.Black), image.Point{}, draw.Src)
+	if err := drawArea(si, surface, v.tileZoom(surface), v.area(surface, width, height), img); err != nil {
+		return nil, err
+	}
+	return img, nil
+}
@@ -0,0 +1,288 @@
+package cmd
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/andybalholm/brotli"
+)
+
+// compressMinSize is the minimal size of a response to bother compressing it,
+// when the size is known.
+const compressMinSize = 1024
+
+// Supported content encodings.
+const (
+	encodingGzip   = "gzip"
+	encodingBrotli = "br"
+)
+
+// compressibleTypes lists the content types worth compressing. Images (JPEG
+// tiles, PNG) are already compressed.
+var compressibleTypes = map[string]bool{
+	"application/json":          true,
+	"application/schema+json":   true,
+	"application/javascript":    true,
+	"application/manifest+json": true,
+	"text/javascript":           true,
+	"text/html":                 true,
+	"text/css":                  true,
+	"text/plain":                true,
+	"image/svg+xml":             true,
+}
+
+func isCompressible(contentType string) bool {
+	mediatype, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	return compressibleTypes[mediatype]
+}
+
+// acceptedEncoding picks the encoding to use for the response, based on the
+// Accept-Encoding request header. Returns "" if no compression should be
+// used.
+func acceptedEncoding(req *http.Request, allowBrotli bool) string {
+	var gz, br bool
+	for _, part := range strings.Split(req.Header.Get("Accept-Encoding"), ",") {
+		fields := strings.Split(part, ";")
+		name := strings.ToLower(strings.TrimSpace(fields[0]))
+		// Ignore encodings explicitly refused with q=0.
+		refused := false
+		for _, f := range fields[1:] {
+			if q := strings.TrimSpace(f); strings.HasPrefix(q, "q=") {
+				if v, err := strconv.ParseFloat(q[2:], 64); err == nil && v == 0 {
+					refused = true
+				}
+			}
+		}
+		if refused {
+			continue
+		}
+		switch name {
+		case encodingGzip:
+			gz = true
+		case encodingBrotli:
+			br = true
+		}
+	}
+	if br && allowBrotli {
+		return encodingBrotli
+	}
+	if gz {
+		return encodingGzip
+	}
+	return ""
+}
+
+// compress returns the compressed version of data, for precompressed content.
+func compress(data []byte, encoding string) []byte {
+	var b bytes.Buffer
+	var w io.WriteCloser
+	if encoding == encodingBrotli {
+		w = brotli.NewWriterLevel(&b, brotli.BestCompression)
+	} else {
+		w, _ = gzip.NewWriterLevel(&b, gzip.BestCompression)
+	}
+	w.Write(data)
+	w.Close()
+	return b.Bytes()
+}
+
+// etagSuffix modifies an ETag to be specific to an encoding, as the content
+// differs.
+func etagSuffix(etag string, encoding string) string {
+	if strings.HasSuffix(etag, `"`) {
+		return etag[:len(etag)-1] + "-" + encoding + `"`
+	}
+	return etag
+}
+
+// compressWriter compresses the response on the fly, if its content type is
+// suitable. The decision is taken when the headers are written.
+type compressWriter struct {
+	http.ResponseWriter
+	encoding string
+	// encodedValidator is true when If-None-Match of the request had the ETag
+	// of the compressed version.
+	encodedValidator bool
+	w                io.WriteCloser
+	wroteHeader      bool
+}
+
+func (cw *compressWriter) WriteHeader(code int) {
+	if cw.wroteHeader {
+		return
+	}
+	cw.wroteHeader = true
+	h := cw.Header()
+	// Content already encoded - e.g., precompressed - is sent as is.
+	if h.Get("Content-Encoding") != "" {
+		cw.ResponseWriter.WriteHeader(code)
+		return
+	}
+	// Not modified responses have no content type to decide on; they must
+	// confirm the version the client has, with the same headers as the
+	// original response.
+	if code == http.StatusNotModified {
+		if cw.encoding != "" {
+			h.Add("Vary", "Accept-Encoding")
+		}
+		if etag := h.Get("ETag"); etag != "" && cw.encodedValidator {
+			h.Set("ETag", etagSuffix(etag, cw.encoding))
+		}
+		cw.ResponseWriter.WriteHeader(code)
+		return
+	}
+	if !isCompressible(h.Get("Content-Type")) {
+		cw.ResponseWriter.WriteHeader(code)
+		return
+	}
+	h.Add("Vary", "Accept-Encoding")
+	if cw.encoding == "" || code != http.StatusOK {
+		cw.ResponseWriter.WriteHeader(code)
+		return
+	}
+	if l, err := strconv.Atoi(h.Get("Content-Length")); err == nil && l < compressMinSize {
+		cw.ResponseWriter.WriteHeader(code)
+		return
+	}
+
+	h.Del("Content-Length")
+	h.Set("Content-Encoding", cw.encoding)
+	if etag := h.Get("ETag"); etag != "" {
+		h.Set("ETag", etagSuffix(etag, cw.encoding))
+	}
+	if cw.encoding == encodingBrotli {
+		cw.w = brotli.NewWriter(cw.ResponseWriter)
+	} else {
+		cw.w = gzip.NewWriter(cw.ResponseWriter)
+	}
+	cw.ResponseWriter.WriteHeader(code)
+}
+
+// Unwrap gives access to the underlying writer, for http.ResponseController.
+func (cw *compressWriter) Unwrap() http.ResponseWriter {
+	return cw.ResponseWriter
+}
+
+func (cw *compressWriter) Write(b []byte) (int, error) {
+	if !cw.wroteHeader {
+		if cw.Header().Get("Content-Type") == "" {
+			cw.Header().Set("Content-Type", http.DetectContentType(b))
+		}
+		cw.WriteHeader(http.StatusOK)
+	}
+	if cw.w != nil {
+		return cw.w.Write(b)
+	}
+	return cw.ResponseWriter.Write(b)
+}
+
+func (cw *compressWriter) Flush() {
+	if f, ok := cw.w.(interface{ Flush() error }); ok {
+		f.Flush()
+	}
+	if f, ok := cw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (cw *compressWriter) close() {
+	if cw.w != nil {
+		cw.w.Close()
+	}
+}
+
+// withCompression compresses responses on the fly when the client supports
+// it. Responses which already have a Content-Encoding - e.g., precompressed
+// content - are left untouched.
+func withCompression(h http.Handler, allowBrotli bool) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		encoding := acceptedEncoding(req, allowBrotli)
+		// Partial content is not compressed, as ranges would apply to the
+		// compressed content.
+		if req.Header.Get("Range") != "" {
+			encoding = ""
+		}
+		// Conditional requests carry the ETag of the compressed version;
+		// handlers only know about the uncompressed one.
+		cw := &compressWriter{ResponseWriter: w, encoding: encoding}
+		if inm := req.Header.Get("If-None-Match"); inm != "" && encoding != "" {
+			stripped := strings.ReplaceAll(inm, "-"+encoding+`"`, `"`)
+			cw.encodedValidator = stripped != inm
+			req = req.Clone(req.Context())
+			req.Header.Set("If-None-Match", stripped)
+		}
+		// The writer is used even when not compressing, to get the Vary header
+		// right for caches.
+		defer cw.close()
+		h.ServeHTTP(cw, req)
+	})
+}
+
+// precompressed holds a static content along with its compressed variants,
+// computed once.
+type precompressed struct {
+	content     []byte
+	contentType string
+	etag        string
+	variants    map[string][]byte
+}
+
+func newPrecompressed(content []byte, contentType string, etag string, gz bool, br bool) *precompressed {
+	p := &precompressed{
+		content:     content,
+		contentType: contentType,
+		etag:        etag,
+		variants:    map[string][]byte{},
+	}
+	if !isCompressible(contentType) || len(content) < compressMinSize {
+		return p
+	}
+	if gz {
+		p.variants[encodingGzip] = compress(content, encodingGzip)
+	}
+	if br {
+		p.variants[encodingBrotli] = compress(content, encodingBrotli)
+	}
+	return p
+}
+
+// serve sends the best variant for the client. It must be called after
+// withCompression, which takes care of rewriting If-None-Match.
+func (p *precompressed) serve(w http.ResponseWriter, req *http.Request) {
+	h := w.Header()
+	h.Set("Content-Type", p.contentType)
+	var encoding string
+	if req.Header.Get("Range") == "" {
+		encoding = acceptedEncoding(req, p.variants[encodingBrotli] != nil)
+	}
+	variant := p.variants[encoding]
+	if variant == nil {
+		h.Set("ETag", p.etag)
+		// No modification time: the ETag is enough, and the time would change
+		// on each restart.
+		http.ServeContent(w, req, "", time.Time{}, bytes.NewReader(p.content))
+		return
+	}
+
+	h.Set("Content-Encoding", encoding)
+	h.Add("Vary", "Accept-Encoding")
+	h.Set("ETag", etagSuffix(p.etag, encoding))
+	if inm := req.Header.Get("If-None-Match"); inm == "*" || strings.Contains(inm, p.etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	h.Set("Content-Length", strconv.Itoa(len(variant)))
+	w.WriteHeader(http.StatusOK)
+	if req.Method != http.MethodHead {
+		w.Write(variant)
+	}
+}
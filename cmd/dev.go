@@ -3,13 +3,14 @@ package cmd
 import (
 	"context"
 	"fmt"
+	"log/slog"
 	"net/http"
 	"os"
 	"path"
 	"path/filepath"
 
 	"github.com/Palats/mapshot/factorio"
-	"github.com/golang/glog"
+	"github.com/Palats/mapshot/storage"
 	"github.com/spf13/cobra"
 	"golang.org/x/sync/errgroup"
 )
@@ -30,7 +31,7 @@ func devFactorio(ctx context.Context, fact *factorio.Factorio, checkoutDir strin
 	if err := os.Symlink(modDir, dstMapshot); err != nil {
 		return fmt.Errorf("unable to symlink %q: %w", modDir, err)
 	}
-	glog.Infof("mod linked at %q", dstMapshot)
+	slog.Info("mod linked", "path", dstMapshot)
 
 	factorioArgs := []string{
 		"--disable-audio",
@@ -47,16 +48,22 @@ func devFactorio(ctx context.Context, fact *factorio.Factorio, checkoutDir strin
 func devServe(ctx context.Context, fact *factorio.Factorio, checkoutDir string) error {
 	baseDir := fact.ScriptOutput()
 	fmt.Printf("Serving data from %s\n", baseDir)
-	s := newServer(
-		baseDir,
+	store, err := storage.NewLocal(baseDir)
+	if err != nil {
+		return err
+	}
+	viewerDir := path.Join(checkoutDir, "frontend", "dist", "viewer")
+	s, err := newServer(
+		[]*serveRoot{{location: baseDir, storage: store}},
 		http.FileServer(http.Dir(path.Join(checkoutDir, "frontend", "dist", "listing"))),
-		http.FileServer(http.Dir(path.Join(checkoutDir, "frontend", "dist", "viewer"))),
+		http.FileServer(http.Dir(viewerDir)),
+		func() ([]byte, error) { return os.ReadFile(path.Join(viewerDir, "index.html")) },
 	)
+	if err != nil {
+		return err
+	}
 	go s.watch(ctx)
-
-	addr := fmt.Sprintf(":%d", port)
-	fmt.Printf("Listening on %s ...\n", addr)
-	return http.ListenAndServe(addr, s)
+	return listenAndServe(ctx, s, s.idx.events.close)
 }
 
 var cmdDev = &cobra.Command{
@@ -0,0 +1,166 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Types of events sent on /events.
+const (
+	// A shot appeared in shots.json.
+	eventShotAdded = "shot-added"
+	// A shot disappeared from shots.json.
+	eventShotRemoved = "shot-removed"
+	// The latest complete shot of a save changed.
+	eventLatestChanged = "latest-changed"
+)
+
+// sseHeartbeat is how often a comment is sent on idle event streams, to keep
+// proxies from closing the connection.
+const sseHeartbeat = 30 * time.Second
+
+// ShotEvent is the payload of the events sent on /events. Shot fields are the
+// same as in shots.json. For latest-changed, they describe the new latest
+// shot; they are absent if the save has no complete shot anymore.
+type ShotEvent struct {
+	Savename string `json:"savename"`
+	*ShotsJSONInfo
+}
+
+// shotEvent is an event waiting to be sent.
+type shotEvent struct {
+	kind string
+	data *ShotEvent
+}
+
+// eventBroker dispatches events to all connected clients.
+type eventBroker struct {
+	m    sync.Mutex
+	subs map[chan shotEvent]bool
+	// Set when the server is shutting down; no new clients are accepted.
+	closed bool
+}
+
+func newEventBroker() *eventBroker {
+	return &eventBroker{
+		subs: map[chan shotEvent]bool{},
+	}
+}
+
+// subscribe registers a new client. It returns nil when shutting down.
+func (b *eventBroker) subscribe() chan shotEvent {
+	ch := make(chan shotEvent, 64)
+	b.m.Lock()
+	defer b.m.Unlock()
+	if b.closed {
+		return nil
+	}
+	b.subs[ch] = true
+	return ch
+}
+
+func (b *eventBroker) unsubscribe(ch chan shotEvent) {
+	b.m.Lock()
+	defer b.m.Unlock()
+	if b.subs[ch] {
+		delete(b.subs, ch)
+		close(ch)
+	}
+}
+
+// close disconnects all clients, so the server can shut down: event streams
+// never end otherwise.
+func (b *eventBroker) close() {
+	b.m.Lock()
+	defer b.m.Unlock()
+	b.closed = true
+	for ch := range b.subs {
+		delete(b.subs, ch)
+		close(ch)
+	}
+}
+
+// publish sends the events to all clients. Clients which are too slow to keep
+// up are disconnected; EventSource reconnects automatically and the UI reloads
+// its state when it does.
+func (b *eventBroker) publish(events []shotEvent) {
+	if len(events) == 0 {
+		return
+	}
+	b.m.Lock()
+	defer b.m.Unlock()
+	for ch := range b.subs {
+		for _, ev := range events {
+			select {
+			case ch <- ev:
+			default:
+				slog.Warn("event client too slow, disconnecting")
+				delete(b.subs, ch)
+				close(ch)
+			}
+			if !b.subs[ch] {
+				break
+			}
+		}
+	}
+}
+
+// ServeHTTP streams events as Server-Sent Events.
+func (b *eventBroker) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming not supported", http.StatusInternalServerError)
+		return
+	}
+	ch := b.subscribe()
+	if ch == nil {
+		http.Error(w, "shutting down", http.StatusServiceUnavailable)
+		return
+	}
+	defer b.unsubscribe(ch)
+	// The stream lasts as long as the client is there; the write timeout of
+	// the server does not apply.
+	http.NewResponseController(w).SetWriteDeadline(time.Time{})
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	// Disable response buffering on nginx.
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprint(w, ": mapshot events\n\n")
+	flusher.Flush()
+
+	acc := requestAccess(req)
+	prefix := requestPrefix(req)
+	heartbeat := time.NewTicker(sseHeartbeat)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-req.Context().Done():
+			return
+		case <-heartbeat.C:
+			fmt.Fprint(w, ": heartbeat\n\n")
+		case ev, ok := <-ch:
+			if !ok {
+				return
+			}
+			if !acc.allowed(ev.data.Savename) {
+				continue
+			}
+			data := ev.data
+			if prefix != "" && data.ShotsJSONInfo != nil {
+				data = &ShotEvent{data.Savename, data.withPrefix(prefix)}
+			}
+			raw, err := json.Marshal(data)
+			if err != nil {
+				slog.Error("unable to encode event", "err", err)
+				continue
+			}
+			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", ev.kind, raw)
+		}
+		flusher.Flush()
+	}
+}
@@ -0,0 +1,472 @@
+package cmd
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/jpeg"
+	"image/png"
+	"math"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/Palats/mapshot/shot"
+	"github.com/Palats/mapshot/storage"
+	"github.com/spf13/cobra"
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/gofont/goregular"
+	"golang.org/x/image/font/opentype"
+	"golang.org/x/image/math/fixed"
+)
+
+// Format of exported images, in addition to imageJPEG and imagePNG.
+const imageTIFF = "tiff"
+
+// posterBandBytes is roughly the maximum memory used for the pixels of a band
+// of a poster.
+const posterBandBytes = 256 << 20
+
+// poster draws an area of a surface, at the full resolution of a zoom level,
+// along with overlays. It is drawn a band of rows at a time, so arbitrarily
+// large images can be generated with bounded memory.
+type poster struct {
+	c             *compositor
+	zoom          int
+	width, height int
+	// Height of bands, in pixels; a multiple of tiffTileSize.
+	bandHeight int
+
+	face   font.Face
+	labels []*posterLabel
+	// Position of grid lines, in pixels, and their width.
+	gridX, gridY []int
+	gridWidth    int
+}
+
+// posterLabel is a text drawn on the poster, in a box.
+type posterLabel struct {
+	text string
+	box  image.Rectangle
+	dot  fixed.Point26_6
+}
+
+func newPoster(si *shotInfo, surface *shot.Surface, zoom int, area shot.BoundingBox) (*poster, error) {
+	// Tiles are drawn at their own resolution.
+	scale := float64(surface.RenderSize) / surface.TileSizeAt(zoom)
+	width := int(math.Ceil((area.RightBottom.X - area.LeftTop.X) * scale))
+	height := int(math.Ceil((area.RightBottom.Y - area.LeftTop.Y) * scale))
+	if width <= 0 || height <= 0 {
+		return nil, fmt.Errorf("empty area")
+	}
+	p := &poster{
+		c: &compositor{
+			si:      si,
+			surface: surface,
+			area:    area,
+			sx:      scale,
+			sy:      scale,
+		},
+		zoom:   zoom,
+		width:  width,
+		height: height,
+	}
+	// Bands of the height of a tile avoid reading tiles many times.
+	p.bandHeight = (surface.RenderSize + tiffTileSize - 1) / tiffTileSize * tiffTileSize
+	for p.bandHeight > tiffTileSize && width*p.bandHeight*4 > posterBandBytes {
+		p.bandHeight -= tiffTileSize
+	}
+	return p, nil
+}
+
+// setLabelSize prepares drawing labels, with text of the given size in pixels.
+func (p *poster) setLabelSize(size float64) error {
+	f, err := opentype.Parse(goregular.TTF)
+	if err != nil {
+		return err
+	}
+	p.face, err = opentype.NewFace(f, &opentype.FaceOptions{Size: size, DPI: 72, Hinting: font.HintingFull})
+	return err
+}
+
+// addLabel adds a text at the given world position. When centered, the text
+// is centered on the position; otherwise, its box starts there.
+func (p *poster) addLabel(text string, pos shot.Position, centered bool) {
+	text = strings.TrimSpace(text)
+	if text == "" {
+		return
+	}
+	px, py := p.c.toPixel(pos.X, pos.Y)
+	m := p.face.Metrics()
+	pad := m.Height / 4
+	w := font.MeasureString(p.face, text) + 2*pad
+	h := m.Ascent + m.Descent + 2*pad
+	corner := fixed.Point26_6{X: fixed.Int26_6(px * 64), Y: fixed.Int26_6(py * 64)}
+	if centered {
+		corner = corner.Sub(fixed.Point26_6{X: w / 2, Y: h / 2})
+	}
+	p.labels = append(p.labels, &posterLabel{
+		text: text,
+		box:  image.Rect(corner.X.Floor(), corner.Y.Floor(), (corner.X + w).Ceil(), (corner.Y + h).Ceil()),
+		dot:  corner.Add(fixed.Point26_6{X: pad, Y: pad + m.Ascent}),
+	})
+}
+
+// addStations labels train stations, at the center of the stop.
+func (p *poster) addStations(surface *shot.Surface) {
+	for _, station := range surface.Stations {
+		bb := station.BoundingBox
+		p.addLabel(station.BackerName, shot.Position{
+			X: (bb.LeftTop.X + bb.RightBottom.X) / 2,
+			Y: (bb.LeftTop.Y + bb.RightBottom.Y) / 2,
+		}, true)
+	}
+}
+
+// addTags labels the map tags which have a text.
+func (p *poster) addTags(surface *shot.Surface) {
+	for _, tag := range surface.Tags {
+		p.addLabel(tag.Text, tag.Position, true)
+	}
+}
+
+// addGrid adds lines every spacing world units, with their coordinates along
+// the top and left edges.
+func (p *poster) addGrid(spacing float64) {
+	area := p.c.area
+	p.gridWidth = max(1, int(p.face.Metrics().Height.Round()/12))
+	for x := math.Ceil(area.LeftTop.X/spacing) * spacing; x <= area.RightBottom.X; x += spacing {
+		px, _ := p.c.toPixel(x, 0)
+		p.gridX = append(p.gridX, int(math.Round(px)))
+		p.addLabel(strconv.FormatFloat(x, 'f', -1, 64), shot.Position{X: x, Y: area.LeftTop.Y}, false)
+	}
+	// Coordinates along the left edge are kept below those along the top edge.
+	m := p.face.Metrics()
+	minY := area.LeftTop.Y + float64(m.Ascent+m.Descent+m.Height/2)/64/p.c.sy
+	for y := math.Ceil(area.LeftTop.Y/spacing) * spacing; y <= area.RightBottom.Y; y += spacing {
+		_, py := p.c.toPixel(0, y)
+		p.gridY = append(p.gridY, int(math.Round(py)))
+		p.addLabel(strconv.FormatFloat(y, 'f', -1, 64), shot.Position{X: area.LeftTop.X, Y: math.Max(y, minY)}, false)
+	}
+}
+
+// band returns the image for the band containing the row, without content.
+func (p *poster) band(y int) *image.RGBA {
+	y0 := y / p.bandHeight * p.bandHeight
+	return image.NewRGBA(image.Rect(0, y0, p.width, min(y0+p.bandHeight, p.height)))
+}
+
+// draw draws the part of the poster covered by the image.
+func (p *poster) draw(img *image.RGBA) error {
+	b := img.Bounds()
+	draw.Draw(img, b, image.NewUniform(color.Black), image.Point{}, draw.Src)
+	p.c.dst = img
+	if err := p.c.drawTiles(p.zoom, b); err != nil {
+		return err
+	}
+
+	line := image.NewUniform(color.NRGBA{255, 255, 255, 128})
+	for _, x := range p.gridX {
+		r := image.Rect(x-p.gridWidth/2, b.Min.Y, x-p.gridWidth/2+p.gridWidth, b.Max.Y)
+		draw.Draw(img, r.Intersect(b), line, image.Point{}, draw.Over)
+	}
+	for _, y := range p.gridY {
+		r := image.Rect(b.Min.X, y-p.gridWidth/2, b.Max.X, y-p.gridWidth/2+p.gridWidth)
+		draw.Draw(img, r.Intersect(b), line, image.Point{}, draw.Over)
+	}
+
+	// Same look as the labels of the viewer.
+	background := image.NewUniform(color.NRGBA{0, 0, 0, 160})
+	for _, l := range p.labels {
+		if !l.box.Overlaps(b) {
+			continue
+		}
+		draw.Draw(img, l.box.Intersect(b), background, image.Point{}, draw.Over)
+		d := &font.Drawer{Dst: img, Src: image.White, Face: p.face, Dot: l.dot}
+		d.DrawString(l.text)
+	}
+	return nil
+}
+
+// bandedImage is an image whose content is drawn on demand, a band at a time.
+// Encoders reading it row by row - as the PNG and JPEG ones do - only need
+// one band in memory.
+type bandedImage struct {
+	p       *poster
+	current *image.RGBA
+	// Called when a band is drawn.
+	progress func(y int)
+	// First error when drawing a band.
+	err error
+}
+
+func (b *bandedImage) ColorModel() color.Model { return color.RGBAModel }
+func (b *bandedImage) Bounds() image.Rectangle { return image.Rect(0, 0, b.p.width, b.p.height) }
+
+// Opaque avoids a full scan by the PNG encoder.
+func (b *bandedImage) Opaque() bool { return true }
+
+func (b *bandedImage) At(x, y int) color.Color {
+	if b.current == nil || !image.Pt(x, y).In(b.current.Rect) {
+		if !image.Pt(x, y).In(b.Bounds()) {
+			return color.RGBA{}
+		}
+		b.current = b.p.band(y)
+		if err := b.p.draw(b.current); err != nil && b.err == nil {
+			b.err = err
+		}
+		b.progress(b.current.Rect.Max.Y)
+	}
+	return b.current.RGBAAt(x, y)
+}
+
+// export writes the poster to the file.
+func (p *poster) export(filename string, format string, quality int) error {
+	f, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	next := 0
+	progress := func(y int) {
+		// Roughly every 10%.
+		if pct := y * 100 / p.height; pct >= next || y == p.height {
+			fmt.Printf("%d%% (%d/%d rows)\n", pct, y, p.height)
+			next = pct/10*10 + 10
+		}
+	}
+
+	if format == imageTIFF {
+		err = p.exportTIFF(f, progress)
+	} else {
+		w := bufio.NewWriter(f)
+		img := &bandedImage{p: p, progress: progress}
+		if format == imagePNG {
+			err = png.Encode(w, img)
+		} else {
+			err = jpeg.Encode(w, img, &jpeg.Options{Quality: quality})
+		}
+		if err == nil {
+			err = img.err
+		}
+		if err == nil {
+			err = w.Flush()
+		}
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		// Do not leave a truncated image behind.
+		os.Remove(filename)
+	}
+	return err
+}
+
+func (p *poster) exportTIFF(f *os.File, progress func(y int)) error {
+	t, err := newTiledTIFF(f, p.width, p.height)
+	if err != nil {
+		return err
+	}
+	for y := 0; y < p.height; y += p.bandHeight {
+		band := p.band(y)
+		if err := p.draw(band); err != nil {
+			return err
+		}
+		if err := t.writeRows(band); err != nil {
+			return err
+		}
+		progress(band.Rect.Max.Y)
+	}
+	return t.close()
+}
+
+// parseBBox parses an area given as x1,y1,x2,y2 in world coordinates.
+func parseBBox(value string) (shot.BoundingBox, error) {
+	parts := strings.Split(value, ",")
+	if len(parts) != 4 {
+		return shot.BoundingBox{}, fmt.Errorf("invalid area %q; expected x1,y1,x2,y2", value)
+	}
+	var v [4]float64
+	for i, part := range parts {
+		f, err := strconv.ParseFloat(strings.TrimSpace(part), 64)
+		if err != nil || math.IsNaN(f) || math.IsInf(f, 0) {
+			return shot.BoundingBox{}, fmt.Errorf("invalid area %q: bad coordinate %q", value, part)
+		}
+		v[i] = f
+	}
+	bb := shot.BoundingBox{
+		LeftTop:     shot.Position{X: math.Min(v[0], v[2]), Y: math.Min(v[1], v[3])},
+		RightBottom: shot.Position{X: math.Max(v[0], v[2]), Y: math.Max(v[1], v[3])},
+	}
+	if bb.LeftTop.X == bb.RightBottom.X || bb.LeftTop.Y == bb.RightBottom.Y {
+		return shot.BoundingBox{}, fmt.Errorf("invalid area %q: empty", value)
+	}
+	return bb, nil
+}
+
+// exportFormat returns the format to use for the file.
+func exportFormat(filename string, format string) (string, error) {
+	if format == "" {
+		switch strings.ToLower(filepath.Ext(filename)) {
+		case ".png":
+			format = imagePNG
+		case ".jpg", ".jpeg":
+			format = imageJPEG
+		case ".tif", ".tiff":
+			format = imageTIFF
+		default:
+			return "", fmt.Errorf("unable to guess the format of %s; use --format", filename)
+		}
+	}
+	if format != imageTIFF {
+		if err := checkImageFormat(format); err != nil {
+			return "", fmt.Errorf("%w, or %s", err, imageTIFF)
+		}
+	}
+	return format, nil
+}
+
+// openShot loads the mapshot given on the command line: a mapshot directory
+// or archive, relative to source when set - a directory or an S3 URL - or as a
+// local path otherwise.
+func openShot(ctx context.Context, source string, arg string) (*shotInfo, error) {
+	if source != "" {
+		store, err := storage.New(ctx, source, s3Settings)
+		if err != nil {
+			return nil, err
+		}
+		location, err := publishLocation(store, arg)
+		if err != nil {
+			return nil, err
+		}
+		return loadShot(&serveRoot{location: source, storage: store}, location)
+	}
+	abs, err := filepath.Abs(arg)
+	if err != nil {
+		return nil, err
+	}
+	store, err := storage.NewLocal(filepath.Dir(abs))
+	if err != nil {
+		return nil, err
+	}
+	return loadShot(&serveRoot{location: filepath.Dir(abs), storage: store}, path.Base(filepath.ToSlash(abs)))
+}
+
+var cmdExport = &cobra.Command{
+	Use:   "export <shot> <output>",
+	Short: "Write a single large image of a mapshot, e.g., for printing.",
+	Long: `Write a single large image of a mapshot, e.g., for printing.
+
+The tiles of a zoom level - the most detailed one by default - are stitched
+together at their full resolution. The image is generated a band of rows at a
+time, so even images much larger than the available memory can be written.
+
+The format is given by the extension of the output file: PNG, JPEG or TIFF. JPEG
+is limited to 65535 pixels in each dimension; TIFF images are tiled, which most
+image editors and printing tools handle efficiently.
+
+The shot is the mapshot directory (the one of the form d-<hash>) or its archive.
+With --source, it is relative to that location instead, which can be an S3
+bucket. Station names, map tags and a coordinate grid can be drawn over the map.
+`,
+	Args: cobra.ExactArgs(2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		ctx := cmd.Context()
+		filename := args[1]
+		format, err := exportFormat(filename, flagExportImageFormat)
+		if err != nil {
+			return err
+		}
+
+		si, err := openShot(ctx, flagExportImageSource, args[0])
+		if err != nil {
+			return err
+		}
+		if si.status != shotComplete {
+			fmt.Printf("Warning: rendering of %s is not complete (%s); some tiles might be missing.\n", args[0], si.status)
+		}
+		// The summary kept by loadShot does not have the stations & tags.
+		data, err := si.loadMapshot()
+		if err != nil {
+			return err
+		}
+		if len(data.Surfaces) == 0 {
+			return fmt.Errorf("%s has no surface", args[0])
+		}
+		surface := data.Surfaces[0]
+		if flagExportImageSurface != "" {
+			if surface = data.Surface(flagExportImageSurface); surface == nil {
+				return fmt.Errorf("unknown surface %q in %s", flagExportImageSurface, args[0])
+			}
+		}
+
+		zoom := surface.ZoomMax
+		if flagExportImageZoom >= 0 {
+			zoom = flagExportImageZoom
+			if zoom < surface.ZoomMin || zoom > surface.ZoomMax {
+				return fmt.Errorf("invalid zoom level %d; available levels are %d to %d", zoom, surface.ZoomMin, surface.ZoomMax)
+			}
+		}
+		area := shot.BoundingBox{LeftTop: surface.WorldMin, RightBottom: surface.WorldMax}
+		if flagExportImageBBox != "" {
+			if area, err = parseBBox(flagExportImageBBox); err != nil {
+				return err
+			}
+		}
+
+		p, err := newPoster(si, surface, zoom, area)
+		if err != nil {
+			return err
+		}
+		if format == imageJPEG && (p.width > 65535 || p.height > 65535) {
+			return fmt.Errorf("image of %dx%d pixels is too large for JPEG; use PNG or TIFF, a lower zoom level or a smaller area", p.width, p.height)
+		}
+		if err := p.setLabelSize(flagExportImageLabelSize); err != nil {
+			return err
+		}
+		if flagExportImageGrid > 0 {
+			p.addGrid(flagExportImageGrid)
+		}
+		if flagExportImageTags {
+			p.addTags(surface)
+		}
+		if flagExportImageStations {
+			p.addStations(surface)
+		}
+
+		fmt.Printf("Writing %s: %dx%d pixels, zoom level %d of %s\n", filename, p.width, p.height, zoom, surface.DisplayName())
+		return p.export(filename, format, flagExportImageQuality)
+	},
+}
+
+var (
+	flagExportImageSource    string
+	flagExportImageSurface   string
+	flagExportImageZoom      int
+	flagExportImageBBox      string
+	flagExportImageFormat    string
+	flagExportImageQuality   int
+	flagExportImageStations  bool
+	flagExportImageTags      bool
+	flagExportImageGrid      float64
+	flagExportImageLabelSize float64
+)
+
+func init() {
+	cmdExport.PersistentFlags().StringVar(&flagExportImageSource, "source", "", "Where to find the mapshot; a directory or s3://<bucket>/<prefix>. If empty, the mapshot is a local path.")
+	cmdExport.PersistentFlags().StringVar(&flagExportImageSurface, "surface", "", "Surface to export, by name or index. Defaults to the first one.")
+	cmdExport.PersistentFlags().IntVar(&flagExportImageZoom, "zoom", -1, "Zoom level whose tiles are used; higher is more detailed. Defaults to the most detailed one.")
+	cmdExport.PersistentFlags().StringVar(&flagExportImageBBox, "bbox", "", "Area to export, in game coordinates, as x1,y1,x2,y2. Defaults to the whole rendered area.")
+	cmdExport.PersistentFlags().StringVar(&flagExportImageFormat, "format", "", "Format of the image: png, jpeg or tiff. Defaults to the one of the extension of the output file.")
+	cmdExport.PersistentFlags().IntVar(&flagExportImageQuality, "quality", 90, "Quality of JPEG images, from 1 to 100.")
+	cmdExport.PersistentFlags().BoolVar(&flagExportImageStations, "stations", false, "Draw the names of train stations.")
+	cmdExport.PersistentFlags().BoolVar(&flagExportImageTags, "tags", false, "Draw the text of map tags.")
+	cmdExport.PersistentFlags().Float64Var(&flagExportImageGrid, "grid", 0, "Draw a grid with lines every that many game units - e.g., 32 for chunks - along with their coordinates. Disabled if 0.")
+	cmdExport.PersistentFlags().Float64Var(&flagExportImageLabelSize, "label_size", 24, "Height of the text of stations, tags and grid coordinates, in pixels.")
+	cmdRoot.AddCommand(cmdExport)
+}
@@ -0,0 +1,466 @@
+package cmd
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// shotIndex keeps track of all known mapshots and of the data derived from
+// them (shots.json, latest pointers). It can be updated either fully - from a
+// complete scan - or incrementally, one shot at a time. Incremental updates
+// only rebuild the entries of the affected save.
+//
+// Changes visible from the UI are published as events.
+type shotIndex struct {
+	m sync.Mutex
+	// All known shots, keyed by shotInfo.key().
+	shots map[string]*shotInfo
+	// Same shots, keyed by mux path.
+	byMuxPath map[string]*shotInfo
+	// Same shots, keyed by unique ID.
+	byID map[string]*shotInfo
+	// Per save derived information, keyed by savename.
+	saves map[string]*saveEntry
+	// Serialized shots.json.
+	shotsJSON *cachedJSON
+	// If true, shots which are not complete are included in shots.json.
+	showIncomplete bool
+	// Provides thumbnails of the shots; nil if disabled.
+	thumbnails *thumbnailer
+	// Answers requests for tiles which do not exist according to the
+	// manifest of their shot; nil if manifests are not used.
+	missingTile http.Handler
+	// Receives changes.
+	events *eventBroker
+}
+
+// saveEntry is the derived information for a single save.
+type saveEntry struct {
+	// Shots of that save, most recent first.
+	shots []*shotInfo
+	// Part of shots.json for that save; nil if no shots are to be listed.
+	listing *ShotsJSONSave
+	// Serialized MapshotConfigJSON of the latest complete shot; nil if there is
+	// none.
+	latest *cachedJSON
+	// Description of the latest complete shot; nil if there is none.
+	latestInfo *ShotsJSONInfo
+}
+
+func newShotIndex(showIncomplete bool, thumbnails *thumbnailer, missingTile http.Handler) *shotIndex {
+	idx := &shotIndex{
+		shots:          map[string]*shotInfo{},
+		byMuxPath:      map[string]*shotInfo{},
+		byID:           map[string]*shotInfo{},
+		saves:          map[string]*saveEntry{},
+		showIncomplete: showIncomplete,
+		thumbnails:     thumbnails,
+		missingTile:    missingTile,
+		events:         newEventBroker(),
+	}
+	idx.rebuildListing()
+	return idx
+}
+
+// reset replaces the full content of the index for the given root.
+func (idx *shotIndex) reset(root string, shots []*shotInfo) {
+	idx.m.Lock()
+	affected := map[string]bool{}
+	for p, shot := range idx.shots {
+		if shot.root != root {
+			continue
+		}
+		delete(idx.shots, p)
+		delete(idx.byMuxPath, shot.muxPath)
+		if idx.byID[shot.id] == shot {
+			delete(idx.byID, shot.id)
+		}
+		affected[shot.savename] = true
+	}
+	for _, shot := range shots {
+		idx.shots[shot.key()] = shot
+		idx.byMuxPath[shot.muxPath] = shot
+		idx.byID[shot.id] = shot
+		affected[shot.savename] = true
+	}
+	events := idx.rebuild(affected)
+	idx.m.Unlock()
+	idx.events.publish(events)
+}
+
+// put adds or replaces a single shot.
+func (idx *shotIndex) put(shot *shotInfo) {
+	idx.m.Lock()
+	affected := map[string]bool{shot.savename: true}
+	if old := idx.shots[shot.key()]; old != nil {
+		delete(idx.byMuxPath, old.muxPath)
+		if idx.byID[old.id] == old {
+			delete(idx.byID, old.id)
+		}
+		affected[old.savename] = true
+	}
+	idx.shots[shot.key()] = shot
+	idx.byMuxPath[shot.muxPath] = shot
+	idx.byID[shot.id] = shot
+	events := idx.rebuild(affected)
+	idx.m.Unlock()
+	idx.events.publish(events)
+}
+
+// remove drops all shots located at or below the given key.
+func (idx *shotIndex) remove(key string) {
+	idx.m.Lock()
+	affected := map[string]bool{}
+	prefix := key + "/"
+	for p, shot := range idx.shots {
+		if p != key && !strings.HasPrefix(p, prefix) {
+			continue
+		}
+		slog.Info("removing shot", "shot", shot.name)
+		delete(idx.shots, p)
+		delete(idx.byMuxPath, shot.muxPath)
+		if idx.byID[shot.id] == shot {
+			delete(idx.byID, shot.id)
+		}
+		affected[shot.savename] = true
+	}
+	if len(affected) == 0 {
+		idx.m.Unlock()
+		return
+	}
+	events := idx.rebuild(affected)
+	idx.m.Unlock()
+	idx.events.publish(events)
+}
+
+// isShot indicates whether the key is a known shot.
+func (idx *shotIndex) isShot(key string) bool {
+	idx.m.Lock()
+	defer idx.m.Unlock()
+	return idx.shots[key] != nil
+}
+
+// rebuild updates the derived data of the affected saves and returns the
+// corresponding events. Must be called with the lock held.
+func (idx *shotIndex) rebuild(affected map[string]bool) []shotEvent {
+	var savenames []string
+	for savename := range affected {
+		savenames = append(savenames, savename)
+	}
+	sort.Strings(savenames)
+
+	var events []shotEvent
+	for _, savename := range savenames {
+		old := idx.saves[savename]
+		idx.rebuildSave(savename)
+		events = append(events, diffSave(savename, old, idx.saves[savename])...)
+	}
+	idx.rebuildListing()
+	return events
+}
+
+// diffSave generates the events corresponding to a change of the save
+// derived data. Either entry can be nil.
+func diffSave(savename string, old, current *saveEntry) []shotEvent {
+	versions := func(entry *saveEntry) []*ShotsJSONInfo {
+		if entry == nil || entry.listing == nil {
+			return nil
+		}
+		return entry.listing.Versions
+	}
+	var events []shotEvent
+
+	oldVersions := map[string]*ShotsJSONInfo{}
+	for _, info := range versions(old) {
+		oldVersions[info.Name] = info
+	}
+	newVersions := map[string]bool{}
+	for _, info := range versions(current) {
+		newVersions[info.Name] = true
+		if prev := oldVersions[info.Name]; prev == nil || *prev != *info {
+			events = append(events, shotEvent{eventShotAdded, &ShotEvent{savename, info}})
+		}
+	}
+	for _, info := range versions(old) {
+		if !newVersions[info.Name] {
+			events = append(events, shotEvent{eventShotRemoved, &ShotEvent{savename, info}})
+		}
+	}
+
+	var oldLatest, newLatest *ShotsJSONInfo
+	if old != nil {
+		oldLatest = old.latestInfo
+	}
+	if current != nil {
+		newLatest = current.latestInfo
+	}
+	if (oldLatest == nil) != (newLatest == nil) || (oldLatest != nil && *oldLatest != *newLatest) {
+		events = append(events, shotEvent{eventLatestChanged, &ShotEvent{savename, newLatest}})
+	}
+	return events
+}
+
+// rebuildSave recomputes the derived data of a single save. Must be called
+// with the lock held.
+func (idx *shotIndex) rebuildSave(savename string) {
+	var shots []*shotInfo
+	for _, shot := range idx.shots {
+		if shot.savename == savename {
+			shots = append(shots, shot)
+		}
+	}
+	if len(shots) == 0 {
+		delete(idx.saves, savename)
+		return
+	}
+	sort.Slice(shots, func(i, j int) bool {
+		if shots[i].json.TicksPlayed != shots[j].json.TicksPlayed {
+			return shots[i].json.TicksPlayed > shots[j].json.TicksPlayed
+		}
+		return shots[i].name < shots[j].name
+	})
+
+	entry := &saveEntry{
+		shots: shots,
+		listing: &ShotsJSONSave{
+			Root:     shots[0].root,
+			Savename: savename,
+		},
+	}
+	var latest *shotInfo
+	for _, shot := range shots {
+		if shot.status == shotComplete && latest == nil {
+			latest = shot
+		}
+		if shot.status != shotComplete && !idx.showIncomplete {
+			continue
+		}
+		info := &ShotsJSONInfo{
+			Name:         shot.name,
+			EncodedPath:  shot.encodedPath,
+			TicksPlayed:  shot.json.TicksPlayed,
+			ThumbnailURL: idx.thumbnailURL(shot),
+		}
+		if shot.status != shotComplete {
+			info.Status = string(shot.status)
+		}
+		entry.listing.Versions = append(entry.listing.Versions, info)
+	}
+	if len(entry.listing.Versions) == 0 {
+		// Nothing visible for that save, e.g., only a render in progress.
+		entry.listing = nil
+	}
+
+	if latest != nil {
+		entry.latestInfo = &ShotsJSONInfo{
+			Name:         latest.name,
+			EncodedPath:  latest.encodedPath,
+			TicksPlayed:  latest.json.TicksPlayed,
+			ThumbnailURL: idx.thumbnailURL(latest),
+		}
+		jsonCfg, err := json.Marshal(&MapshotConfigJSON{
+			EncodedPath: latest.encodedPath,
+		})
+		if err != nil {
+			slog.Error("unable to build mapshot config", "err", err)
+		}
+		entry.latest = newCachedJSON(jsonCfg)
+	}
+	idx.saves[savename] = entry
+}
+
+// thumbnailURL returns the URL path of the thumbnail of the first surface of
+// the shot - typically, Nauvis. It is empty if there is none.
+func (idx *shotIndex) thumbnailURL(shot *shotInfo) string {
+	if idx.thumbnails == nil || shot.status != shotComplete || len(shot.json.Surfaces) == 0 {
+		return ""
+	}
+	return shot.encodedPath + idx.thumbnails.name(shot.json.Surfaces[0])
+}
+
+// rebuildListing re-generates shots.json from the per-save data. Must be
+// called with the lock held.
+func (idx *shotIndex) rebuildListing() {
+	var data ShotsJSON
+	for _, savename := range idx.sortedSavenames() {
+		if listing := idx.saves[savename].listing; listing != nil {
+			data.All = append(data.All, listing)
+		}
+	}
+	jsonData, err := json.Marshal(data)
+	if err != nil {
+		jsonData = nil
+		slog.Error("unable to build shots.json", "err", err)
+	}
+	idx.shotsJSON = newCachedJSON(jsonData)
+}
+
+// listing returns the serialized shots.json.
+func (idx *shotIndex) listing() *cachedJSON {
+	idx.m.Lock()
+	defer idx.m.Unlock()
+	return idx.shotsJSON
+}
+
+// listingFor returns shots.json restricted to the saves the request can
+// access, with encoded paths under the given URL prefix.
+func (idx *shotIndex) listingFor(acc *saveAccess, prefix string) *cachedJSON {
+	if acc.all() && prefix == "" {
+		return idx.listing()
+	}
+	idx.m.Lock()
+	var data ShotsJSON
+	for _, savename := range idx.sortedSavenames() {
+		listing := idx.saves[savename].listing
+		if listing == nil || !acc.allowed(savename) {
+			continue
+		}
+		if prefix != "" {
+			prefixed := *listing
+			prefixed.Versions = nil
+			for _, info := range listing.Versions {
+				prefixed.Versions = append(prefixed.Versions, info.withPrefix(prefix))
+			}
+			listing = &prefixed
+		}
+		data.All = append(data.All, listing)
+	}
+	jsonData, err := json.Marshal(data)
+	idx.m.Unlock()
+	if err != nil {
+		jsonData = nil
+		slog.Error("unable to build shots.json", "err", err)
+	}
+	return newCachedJSON(jsonData)
+}
+
+// latest returns the serialized config of the latest shot of the save, with
+// its encoded path under the given URL prefix. It returns nil if the save is
+// not known.
+func (idx *shotIndex) latest(savename string, prefix string) *cachedJSON {
+	idx.m.Lock()
+	defer idx.m.Unlock()
+	entry := idx.saves[savename]
+	if entry == nil {
+		return nil
+	}
+	if prefix == "" || entry.latestInfo == nil {
+		return entry.latest
+	}
+	jsonCfg, err := json.Marshal(&MapshotConfigJSON{
+		EncodedPath: prefix + entry.latestInfo.EncodedPath,
+	})
+	if err != nil {
+		slog.Error("unable to build mapshot config", "err", err)
+	}
+	return newCachedJSON(jsonCfg)
+}
+
+// counts returns the number of saves and shots in the index.
+func (idx *shotIndex) counts() (int, int) {
+	idx.m.Lock()
+	defer idx.m.Unlock()
+	return len(idx.saves), len(idx.shots)
+}
+
+// savenames returns the list of known saves, sorted.
+func (idx *shotIndex) savenames() []string {
+	idx.m.Lock()
+	defer idx.m.Unlock()
+	return idx.sortedSavenames()
+}
+
+// sortedSavenames returns the list of known saves, sorted. Must be called with
+// the lock held.
+func (idx *shotIndex) sortedSavenames() []string {
+	var savenames []string
+	for savename := range idx.saves {
+		savenames = append(savenames, savename)
+	}
+	sort.Strings(savenames)
+	return savenames
+}
+
+// saveShots returns all the shots of a save, including incomplete ones, most
+// recent first. Returns nil if the save is not known.
+func (idx *shotIndex) saveShots(savename string) []*shotInfo {
+	idx.m.Lock()
+	defer idx.m.Unlock()
+	entry := idx.saves[savename]
+	if entry == nil {
+		return nil
+	}
+	return entry.shots
+}
+
+// latestShot returns the most recent complete shot of a save, or nil.
+func (idx *shotIndex) latestShot(savename string) *shotInfo {
+	for _, shot := range idx.saveShots(savename) {
+		if shot.status == shotComplete {
+			return shot
+		}
+	}
+	return nil
+}
+
+// shotByID finds a shot from its unique ID.
+func (idx *shotIndex) shotByID(id string) *shotInfo {
+	idx.m.Lock()
+	defer idx.m.Unlock()
+	return idx.byID[id]
+}
+
+// lookup finds the shot serving the given URL path, and returns it along with
+// the remaining part of the path.
+func (idx *shotIndex) lookup(urlPath string) (*shotInfo, string) {
+	idx.m.Lock()
+	defer idx.m.Unlock()
+	for i := 0; i < len(urlPath); i++ {
+		if urlPath[i] != '/' {
+			continue
+		}
+		if shot := idx.byMuxPath[urlPath[:i+1]]; shot != nil {
+			return shot, urlPath[i:]
+		}
+	}
+	return nil, ""
+}
+
+// ServeHTTP serves the content of the shots, for paths under `/data/`.
+func (idx *shotIndex) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	shot, rest := idx.lookup(req.URL.Path)
+	if shot == nil || !requestAccess(req).allowed(shot.savename) {
+		http.NotFound(w, req)
+		return
+	}
+	noteShot(req, shot)
+	name := strings.TrimPrefix(rest, "/")
+	if idx.thumbnails != nil && isThumbnail(name) {
+		idx.thumbnails.serve(w, req, shot, name)
+		return
+	}
+	// Content of a mapshot never changes once complete.
+	cache := cacheNone
+	if shot.status == shotComplete {
+		cache = cacheImmutable
+	}
+	if tile, ok := shot.uniformTile(name); ok {
+		withCacheControl(tile, cache).ServeHTTP(w, req)
+		return
+	}
+	// Spares the storage the many requests for tiles the mod did not write.
+	// The manifest is rewritten when tiles are added - e.g., by `mapshot
+	// pyramid` - so the answer must not be kept for long.
+	if idx.missingTile != nil && shot.tileMissing(name) {
+		withCacheControl(idx.missingTile, cacheShort).ServeHTTP(w, req)
+		return
+	}
+	r := req.Clone(req.Context())
+	r.URL.Path = rest
+	r.URL.RawPath = ""
+	withCacheControl(shot.handler, cache).ServeHTTP(w, r)
+}
@@ -0,0 +1,291 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/Palats/mapshot/shot"
+	"github.com/Palats/mapshot/storage"
+)
+
+// testMapshotJSON returns the content of mapshot.json of a shot with a single
+// surface. The unique ID is derived from the directory name, as the mod does.
+func testMapshotJSON(location string, ticks int64, status string) string {
+	id := strings.TrimPrefix(path.Base(location), "d-")
+	for _, e := range archiveExtensions {
+		id = strings.TrimSuffix(id, e.ext)
+	}
+	return fmt.Sprintf(`{
+		"unique_id": %q, "map_id": "map", "ticks_played": %d, "status": %q,
+		"surfaces": [{
+			"surface_name": "nauvis", "surface_idx": 1, "file_prefix": "s1zoom_",
+			"tile_size": 64, "render_size": 16,
+			"world_min": {"x": -32, "y": -32}, "world_max": {"x": 32, "y": 32},
+			"zoom_min": 0, "zoom_max": 0
+		}]
+	}`, id, ticks, status)
+}
+
+// writeTestShot writes the mapshot.json of a shot directory.
+func writeTestShot(t *testing.T, dir, location string, ticks int64, status string) {
+	t.Helper()
+	p := filepath.Join(dir, filepath.FromSlash(location))
+	if err := os.MkdirAll(p, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	// Written under another name then renamed, as a partially written
+	// mapshot.json could be seen otherwise.
+	tmp := filepath.Join(p, ".mapshot.json.tmp")
+	if err := os.WriteFile(tmp, []byte(testMapshotJSON(location, ticks, status)), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(tmp, filepath.Join(p, shot.Filename)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// writeTestShotArchive writes a zip archive of a complete shot.
+func writeTestShotArchive(t *testing.T, dir, location string, ticks int64) {
+	t.Helper()
+	content := buildZip(t, []testArchiveFile{{name: shot.Filename, content: testMapshotJSON(location, ticks, shot.StatusComplete)}})
+	p := filepath.Join(dir, filepath.FromSlash(location))
+	if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	tmp := p + ".tmp"
+	if err := os.WriteFile(tmp, content, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(tmp, p); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// newTestRoot returns a root on a temporary directory.
+func newTestRoot(t *testing.T) (*serveRoot, string) {
+	t.Helper()
+	dir := t.TempDir()
+	store, err := storage.NewLocal(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Symlinks, e.g., in the temporary directory path, are resolved by the
+	// storage; the watcher must use the same path.
+	return &serveRoot{location: store.Dir(), storage: store}, store.Dir()
+}
+
+// mustLoadShot loads the shot at the location of the root.
+func mustLoadShot(t *testing.T, root *serveRoot, location string) *shotInfo {
+	t.Helper()
+	si, err := loadShot(root, location)
+	if err != nil {
+		t.Fatalf("loadShot(%q) failed: %v", location, err)
+	}
+	return si
+}
+
+// drainEvents returns the events received so far, as `<kind> <savename>
+// <shot name>`.
+func drainEvents(ch chan shotEvent) []string {
+	var got []string
+	for {
+		select {
+		case ev := <-ch:
+			name := ""
+			if ev.data.ShotsJSONInfo != nil {
+				name = ev.data.Name
+			}
+			got = append(got, strings.TrimSpace(fmt.Sprintf("%s %s %s", ev.kind, ev.data.Savename, name)))
+		default:
+			return got
+		}
+	}
+}
+
+// indexState summarizes the content of the index: the listed shots of each
+// save and the latest one.
+func indexState(idx *shotIndex) (listed map[string][]string, latest map[string]string) {
+	listed, latest = map[string][]string{}, map[string]string{}
+	for _, savename := range idx.savenames() {
+		idx.m.Lock()
+		if listing := idx.saves[savename].listing; listing != nil {
+			for _, info := range listing.Versions {
+				listed[savename] = append(listed[savename], info.Name)
+			}
+		}
+		idx.m.Unlock()
+		if si := idx.latestShot(savename); si != nil {
+			latest[savename] = si.name
+		}
+	}
+	return listed, latest
+}
+
+func TestShotIndex(t *testing.T) {
+	root, dir := newTestRoot(t)
+	writeTestShot(t, dir, "save/d-1", 100, shot.StatusComplete)
+	writeTestShot(t, dir, "save/d-2", 200, shot.StatusInProgress)
+	writeTestShot(t, dir, "other/d-3", 50, shot.StatusComplete)
+	writeTestShotArchive(t, dir, "save/d-1.zip", 100)
+
+	idx := newShotIndex(false, nil, nil)
+	events := idx.events.subscribe()
+
+	steps := []struct {
+		desc string
+		do   func()
+
+		wantEvents []string
+		wantListed map[string][]string
+		wantLatest map[string]string
+		// Expected shot for some unique IDs; "" if unknown.
+		wantIDs map[string]string
+	}{
+		{
+			desc: "initial scan",
+			do: func() {
+				idx.reset(root.name, []*shotInfo{mustLoadShot(t, root, "save/d-1"), mustLoadShot(t, root, "save/d-2")})
+			},
+			// Incomplete shots are not listed.
+			wantEvents: []string{"shot-added save save/d-1", "latest-changed save save/d-1"},
+			wantListed: map[string][]string{"save": {"save/d-1"}},
+			wantLatest: map[string]string{"save": "save/d-1"},
+			wantIDs:    map[string]string{"1": "save/d-1", "2": "save/d-2"},
+		},
+		{
+			desc: "shot completed",
+			do: func() {
+				writeTestShot(t, dir, "save/d-2", 200, shot.StatusComplete)
+				idx.put(mustLoadShot(t, root, "save/d-2"))
+			},
+			wantEvents: []string{"shot-added save save/d-2", "latest-changed save save/d-2"},
+			wantListed: map[string][]string{"save": {"save/d-2", "save/d-1"}},
+			wantLatest: map[string]string{"save": "save/d-2"},
+		},
+		{
+			desc: "same shot loaded again",
+			do: func() {
+				idx.put(mustLoadShot(t, root, "save/d-2"))
+			},
+			wantListed: map[string][]string{"save": {"save/d-2", "save/d-1"}},
+			wantLatest: map[string]string{"save": "save/d-2"},
+		},
+		{
+			desc: "other save",
+			do: func() {
+				idx.put(mustLoadShot(t, root, "other/d-3"))
+			},
+			wantEvents: []string{"shot-added other other/d-3", "latest-changed other other/d-3"},
+			wantListed: map[string][]string{"save": {"save/d-2", "save/d-1"}, "other": {"other/d-3"}},
+			wantLatest: map[string]string{"save": "save/d-2", "other": "other/d-3"},
+		},
+		{
+			// As the watcher does when a shot directory is replaced by its
+			// archive; both are served at the same URL, with the same ID.
+			desc: "shot replaced by its archive",
+			do: func() {
+				idx.put(mustLoadShot(t, root, "save/d-1.zip"))
+				idx.remove("save/d-1")
+			},
+			wantListed: map[string][]string{"save": {"save/d-2", "save/d-1"}, "other": {"other/d-3"}},
+			wantLatest: map[string]string{"save": "save/d-2", "other": "other/d-3"},
+			wantIDs:    map[string]string{"1": "save/d-1"},
+		},
+		{
+			desc: "latest removed",
+			do: func() {
+				idx.remove("save/d-2")
+			},
+			wantEvents: []string{"shot-removed save save/d-2", "latest-changed save save/d-1"},
+			wantListed: map[string][]string{"save": {"save/d-1"}, "other": {"other/d-3"}},
+			wantLatest: map[string]string{"save": "save/d-1", "other": "other/d-3"},
+			wantIDs:    map[string]string{"2": ""},
+		},
+		{
+			desc: "save directory removed",
+			do: func() {
+				idx.remove("save")
+			},
+			wantEvents: []string{"shot-removed save save/d-1", "latest-changed save"},
+			wantListed: map[string][]string{"other": {"other/d-3"}},
+			wantLatest: map[string]string{"other": "other/d-3"},
+			wantIDs:    map[string]string{"1": "", "3": "other/d-3"},
+		},
+		{
+			desc: "removing an unknown shot",
+			do: func() {
+				idx.remove("save/d-4")
+			},
+			wantListed: map[string][]string{"other": {"other/d-3"}},
+			wantLatest: map[string]string{"other": "other/d-3"},
+		},
+		{
+			desc: "rescan finding nothing",
+			do: func() {
+				idx.reset(root.name, nil)
+			},
+			wantEvents: []string{"shot-removed other other/d-3", "latest-changed other"},
+			wantListed: map[string][]string{},
+			wantLatest: map[string]string{},
+			wantIDs:    map[string]string{"3": ""},
+		},
+	}
+	for _, step := range steps {
+		step.do()
+		if got := drainEvents(events); !reflect.DeepEqual(got, step.wantEvents) {
+			t.Errorf("%s: events = %q, want %q", step.desc, got, step.wantEvents)
+		}
+		listed, latest := indexState(idx)
+		if !reflect.DeepEqual(listed, step.wantListed) {
+			t.Errorf("%s: listed shots = %q, want %q", step.desc, listed, step.wantListed)
+		}
+		if !reflect.DeepEqual(latest, step.wantLatest) {
+			t.Errorf("%s: latest shots = %q, want %q", step.desc, latest, step.wantLatest)
+		}
+		for id, want := range step.wantIDs {
+			got := ""
+			if si := idx.shotByID(id); si != nil {
+				got = si.name
+			}
+			if got != want {
+				t.Errorf("%s: shotByID(%q) = %q, want %q", step.desc, id, got, want)
+			}
+		}
+	}
+}
+
+// TestShotIndexMultipleRoots checks that a scan of a root leaves the shots of
+// other roots alone.
+func TestShotIndexMultipleRoots(t *testing.T) {
+	root1, dir1 := newTestRoot(t)
+	root1.name = "a"
+	root2, dir2 := newTestRoot(t)
+	root2.name = "b"
+	writeTestShot(t, dir1, "save/d-1", 100, shot.StatusComplete)
+	writeTestShot(t, dir2, "save/d-2", 100, shot.StatusComplete)
+
+	idx := newShotIndex(false, nil, nil)
+	idx.reset("a", []*shotInfo{mustLoadShot(t, root1, "save/d-1")})
+	idx.reset("b", []*shotInfo{mustLoadShot(t, root2, "save/d-2")})
+	idx.reset("a", nil)
+
+	var keys []string
+	idx.m.Lock()
+	for key := range idx.shots {
+		keys = append(keys, key)
+	}
+	idx.m.Unlock()
+	sort.Strings(keys)
+	if want := []string{"b/save/d-2"}; !reflect.DeepEqual(keys, want) {
+		t.Errorf("shots = %q, want %q", keys, want)
+	}
+	if _, latest := indexState(idx); !reflect.DeepEqual(latest, map[string]string{"b/save": "b/save/d-2"}) {
+		t.Errorf("latest shots = %q, want only b/save", latest)
+	}
+}
@@ -0,0 +1,130 @@
+package cmd
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/Palats/mapshot/shot"
+	"github.com/spf13/cobra"
+)
+
+// readMapshotFile reads the raw mapshot.json, given either the render
+// directory or the file itself.
+func readMapshotFile(target string) (string, []byte, error) {
+	info, err := os.Stat(target)
+	if err != nil {
+		return "", nil, err
+	}
+	filename := target
+	if info.IsDir() {
+		filename = filepath.Join(target, shot.Filename)
+	}
+	raw, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return "", nil, fmt.Errorf("unable to read %s: %w", filename, err)
+	}
+	return filename, raw, nil
+}
+
+func printMapshot(data *shot.Mapshot) {
+	fmt.Println("Unique ID:   ", data.UniqueID)
+	fmt.Println("Savename:    ", data.Savename)
+	fmt.Println("Map ID:      ", data.MapID)
+	fmt.Println("Seed:        ", data.Seed)
+	fmt.Printf("Ticks played: %d (%.1f hours)\n", data.TicksPlayed, float64(data.TicksPlayed)/(60*3600))
+	fmt.Println("Tick:        ", data.Tick)
+	status := data.Status
+	if status == "" {
+		status = "unknown (older version)"
+	}
+	fmt.Println("Status:      ", status)
+	fmt.Println("Game version:", data.GameVersion)
+
+	var mods []string
+	for name := range data.ActiveMods {
+		mods = append(mods, name)
+	}
+	sort.Strings(mods)
+	fmt.Printf("Mods:         %d\n", len(mods))
+	for _, name := range mods {
+		fmt.Printf("  %s %s\n", name, data.ActiveMods[name])
+	}
+
+	fmt.Printf("Surfaces:     %d\n", len(data.Surfaces))
+	for _, s := range data.Surfaces {
+		fmt.Printf("  [%d] %s", s.SurfaceIdx, s.SurfaceName)
+		if n := s.DisplayName(); n != s.SurfaceName {
+			fmt.Printf(" (%s)", n)
+		}
+		if s.IsPlanet {
+			fmt.Print(" planet")
+		}
+		if s.IsSpacePlatform {
+			fmt.Print(" space-platform")
+		}
+		fmt.Println()
+		fmt.Printf("      area: (%g, %g)-(%g, %g)\n", s.WorldMin.X, s.WorldMin.Y, s.WorldMax.X, s.WorldMax.Y)
+		fmt.Printf("      tiles: prefix=%s size=%g render_size=%dpx zoom=%d..%d\n", s.FilePrefix, s.TileSize, s.RenderSize, s.ZoomMin, s.ZoomMax)
+		fmt.Printf("      stations=%d tags=%d players=%d\n", len(s.Stations), len(s.Tags), len(s.Players))
+	}
+}
+
+var cmdInspect = &cobra.Command{
+	Use:   "inspect <dir>",
+	Short: "Show and validate the content of a mapshot.",
+	Long: `Show and validate the content of a mapshot.
+
+The parameter is the mapshot directory (the one of the form d-<hash>) or its
+mapshot.json file. The file is validated against the mapshot.json JSON Schema;
+the command fails if it does not match.
+`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		filename, raw, err := readMapshotFile(args[0])
+		if err != nil {
+			return err
+		}
+		validationErr := shot.Validate(raw)
+		var verr *shot.ValidationError
+		if validationErr != nil && !errors.As(validationErr, &verr) {
+			// Not even JSON, no point in going further.
+			return fmt.Errorf("%s: %w", filename, validationErr)
+		}
+
+		data, err := shot.Parse(raw)
+		if err != nil {
+			return fmt.Errorf("%s: %w", filename, err)
+		}
+		if flagInspectJSON {
+			enc := json.NewEncoder(os.Stdout)
+			enc.SetIndent("", "  ")
+			enc.SetEscapeHTML(false)
+			if err := enc.Encode(data); err != nil {
+				return err
+			}
+		} else {
+			fmt.Println("File:        ", filename)
+			printMapshot(data)
+		}
+
+		if validationErr != nil {
+			return fmt.Errorf("%s: %w", filename, validationErr)
+		}
+		if !flagInspectJSON {
+			fmt.Println("Schema:       valid")
+		}
+		return nil
+	},
+}
+
+var flagInspectJSON bool
+
+func init() {
+	cmdInspect.PersistentFlags().BoolVar(&flagInspectJSON, "json", false, "Print the normalized mapshot.json instead of a summary.")
+	cmdRoot.AddCommand(cmdInspect)
+}
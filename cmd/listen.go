@@ -0,0 +1,158 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// sdListenFdsStart is the first file descriptor passed by systemd socket
+// activation.
+const sdListenFdsStart = 3
+
+// activationListener returns the listener passed by systemd socket activation,
+// or nil if the process was not started that way. See sd_listen_fds(3).
+func activationListener() (net.Listener, error) {
+	if pid, err := strconv.Atoi(os.Getenv("LISTEN_PID")); err != nil || pid != os.Getpid() {
+		return nil, nil
+	}
+	count, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || count < 1 {
+		return nil, nil
+	}
+	// Not meant for child processes - e.g., Factorio.
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+	if count > 1 {
+		return nil, fmt.Errorf("socket activation passed %d sockets; only one is supported", count)
+	}
+	f := os.NewFile(sdListenFdsStart, "systemd-socket")
+	ln, err := net.FileListener(f)
+	// The listener has its own copy of the file descriptor.
+	f.Close()
+	if err != nil {
+		return nil, fmt.Errorf("unable to use socket from systemd: %w", err)
+	}
+	return ln, nil
+}
+
+// listen creates the listener of the server: from systemd socket activation if
+// available, otherwise from --listen or --port.
+func listen() (net.Listener, error) {
+	ln, err := activationListener()
+	if ln != nil || err != nil {
+		return ln, err
+	}
+	if strings.HasPrefix(flagServeListen, "unix:") {
+		socket := strings.TrimPrefix(flagServeListen, "unix:")
+		// A socket left behind by a previous instance would prevent listening.
+		if info, err := os.Stat(socket); err == nil && info.Mode()&os.ModeSocket != 0 {
+			os.Remove(socket)
+		}
+		return net.Listen("unix", socket)
+	}
+	addr := flagServeListen
+	if addr == "" {
+		addr = fmt.Sprintf(":%d", port)
+	}
+	return net.Listen("tcp", addr)
+}
+
+// newHTTPServer creates a server with the timeouts from the flags.
+func newHTTPServer(h http.Handler) *http.Server {
+	return &http.Server{
+		Handler:           h,
+		ReadHeaderTimeout: flagServeReadHeaderTimeout,
+		ReadTimeout:       flagServeReadTimeout,
+		WriteTimeout:      flagServeWriteTimeout,
+		IdleTimeout:       flagServeIdleTimeout,
+	}
+}
+
+// listenAndServe serves the handler, with TLS if configured through the
+// flags, until the context is cancelled. In-flight requests are then given
+// some time to finish; onShutdown is called when that starts, to terminate
+// long-lived requests.
+func listenAndServe(ctx context.Context, h http.Handler, onShutdown func()) error {
+	ln, err := listen()
+	if err != nil {
+		return err
+	}
+	server := newHTTPServer(h)
+	if onShutdown != nil {
+		server.RegisterOnShutdown(onShutdown)
+	}
+	servers := []*http.Server{server}
+	errc := make(chan error, 2)
+
+	if flagServeTLSCert == "" {
+		fmt.Printf("Listening on %s ...\n", ln.Addr())
+		go func() {
+			errc <- server.Serve(ln)
+		}()
+	} else {
+		cfg, err := tlsConfig()
+		if err != nil {
+			ln.Close()
+			return err
+		}
+		server.TLSConfig = cfg
+		if flagServeRedirectPort != 0 {
+			// Redirect to the port actually listened on, which differs from
+			// --port with --listen or socket activation.
+			tcpAddr, ok := ln.Addr().(*net.TCPAddr)
+			if !ok {
+				ln.Close()
+				return fmt.Errorf("--http_redirect_port requires listening on TCP, not %s", ln.Addr())
+			}
+			redirectAddr := fmt.Sprintf(":%d", flagServeRedirectPort)
+			redirect := newHTTPServer(redirectToHTTPS(tcpAddr.Port))
+			redirect.Addr = redirectAddr
+			servers = append(servers, redirect)
+			fmt.Printf("Redirecting HTTP from %s ...\n", redirectAddr)
+			go func() {
+				errc <- redirect.ListenAndServe()
+			}()
+		}
+		fmt.Printf("Listening with TLS on %s ...\n", ln.Addr())
+		go func() {
+			// Certificates are provided by the TLS config.
+			errc <- server.ServeTLS(ln, "", "")
+		}()
+	}
+
+	select {
+	case err := <-errc:
+		for _, s := range servers {
+			s.Close()
+		}
+		return err
+	case <-ctx.Done():
+	}
+
+	fmt.Println("Shutting down...")
+	slog.Info("shutting down", "timeout", flagServeShutdownTimeout)
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), flagServeShutdownTimeout)
+	defer cancel()
+	var shutdownErr error
+	for _, s := range servers {
+		if err := s.Shutdown(shutdownCtx); err != nil {
+			// Remaining requests are interrupted.
+			s.Close()
+			shutdownErr = fmt.Errorf("requests still in flight after %v: %w", flagServeShutdownTimeout, err)
+		}
+	}
+	for range servers {
+		if err := <-errc; err != nil && !errors.Is(err, http.ErrServerClosed) {
+			slog.Error("server error during shutdown", "err", err)
+		}
+	}
+	return shutdownErr
+}
@@ -0,0 +1,83 @@
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+
+	"github.com/spf13/pflag"
+)
+
+// LogFlags configures the diagnostic logs of all commands.
+type LogFlags struct {
+	level  string
+	format string
+	file   string
+	// Deprecated alias of --log_level=info, from when logs went through glog.
+	alsoLogToStderr bool
+}
+
+// Register creates flags for the logging parameters.
+func (lf *LogFlags) Register(flags *pflag.FlagSet, prefix string) *LogFlags {
+	flags.StringVar(&lf.level, prefix+"level", "warn", "Minimum level of logs to write: debug, info, warn or error.")
+	flags.StringVar(&lf.format, prefix+"format", "text", "Format of logs: text (key=value pairs) or json (one object per line).")
+	flags.StringVar(&lf.file, prefix+"file", "", "File to append logs to. If empty, logs are written to stderr.")
+	flags.BoolVar(&lf.alsoLogToStderr, "alsologtostderr", false, "Same as --"+prefix+"level=info.")
+	flags.MarkDeprecated("alsologtostderr", "use --"+prefix+"level=info instead")
+	return lf
+}
+
+// parseLevel converts the name of a log level.
+func parseLevel(name string) (slog.Level, error) {
+	switch strings.ToLower(name) {
+	case "debug":
+		return slog.LevelDebug, nil
+	case "info":
+		return slog.LevelInfo, nil
+	case "warn", "warning":
+		return slog.LevelWarn, nil
+	case "error":
+		return slog.LevelError, nil
+	}
+	return 0, fmt.Errorf("unknown log level %q; expected debug, info, warn or error", name)
+}
+
+// newLogHandler creates a handler writing to w in the requested format.
+func newLogHandler(w io.Writer, format string, level slog.Leveler) (slog.Handler, error) {
+	opts := &slog.HandlerOptions{Level: level}
+	switch format {
+	case "text":
+		return slog.NewTextHandler(w, opts), nil
+	case "json":
+		return slog.NewJSONHandler(w, opts), nil
+	}
+	return nil, fmt.Errorf("unknown log format %q; expected text or json", format)
+}
+
+// setup installs the default logger according to the flags.
+func (lf *LogFlags) setup() error {
+	level, err := parseLevel(lf.level)
+	if err != nil {
+		return err
+	}
+	if lf.alsoLogToStderr && level > slog.LevelInfo {
+		level = slog.LevelInfo
+	}
+	var w io.Writer = os.Stderr
+	if lf.file != "" {
+		f, err := os.OpenFile(lf.file, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			return fmt.Errorf("unable to open log file: %w", err)
+		}
+		// Kept open for the lifetime of the process.
+		w = f
+	}
+	h, err := newLogHandler(w, lf.format, level)
+	if err != nil {
+		return err
+	}
+	slog.SetDefault(slog.New(h))
+	return nil
+}
@@ -0,0 +1,235 @@
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"image/png"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/Palats/mapshot/shot"
+	"github.com/Palats/mapshot/storage"
+	"github.com/spf13/cobra"
+)
+
+// Values of --missing_tiles.
+const (
+	// Tiles missing from the manifest get an empty response.
+	missingTilesEmpty = "empty"
+	// Tiles missing from the manifest get a transparent image.
+	missingTilesPlaceholder = "placeholder"
+	// Manifests are ignored; tiles are looked up in the storage.
+	missingTilesStorage = "storage"
+)
+
+// missingTileHandler returns what answers requests for tiles which do not
+// exist according to the manifest of their shot, given the value of
+// --missing_tiles. It returns nil if manifests are not to be used.
+func missingTileHandler(mode string) (http.Handler, error) {
+	switch mode {
+	case missingTilesEmpty:
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			w.WriteHeader(http.StatusNoContent)
+		}), nil
+	case missingTilesPlaceholder:
+		var buf bytes.Buffer
+		if err := png.Encode(&buf, image.NewNRGBA(image.Rect(0, 0, 1, 1))); err != nil {
+			return nil, err
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			w.Header().Set("Content-Type", "image/png")
+			http.ServeContent(w, req, "", time.Time{}, bytes.NewReader(buf.Bytes()))
+		}), nil
+	case missingTilesStorage:
+		return nil, nil
+	}
+	return nil, fmt.Errorf("invalid value %q for missing tiles; must be one of %s, %s or %s", mode, missingTilesEmpty, missingTilesPlaceholder, missingTilesStorage)
+}
+
+// tileMissing indicates whether the file, given relative to the shot
+// directory, is a tile which does not exist according to the manifest of the
+// shot. The manifest is read on first use. Only complete shot directories
+// have one - archives list their content in memory anyway.
+func (si *shotInfo) tileMissing(name string) bool {
+	if !strings.HasSuffix(name, ".jpg") || si.status != shotComplete || archivedShotDir(si.location) != "" {
+		return false
+	}
+	si.tilesOnce.Do(func() {
+		r, err := si.open(shot.TilesFilename)
+		if errors.Is(err, fs.ErrNotExist) {
+			return
+		}
+		if err != nil {
+			slog.Error("unable to read tiles manifest", "shot", si.name, "err", err)
+			return
+		}
+		defer r.Close()
+		tiles := &shot.Tiles{}
+		if err := json.NewDecoder(r).Decode(tiles); err != nil {
+			slog.Error("invalid tiles manifest", "shot", si.name, "err", err)
+			return
+		}
+		si.tiles = tiles
+	})
+	if si.tiles == nil {
+		return false
+	}
+	exists, known := si.tiles.Lookup(name)
+	return known && !exists
+}
+
+// isShotManifest indicates whether the file, in a shot directory, is one of
+// the manifests the server reads once per shot: tiles.json, and the list of
+// the tiles pruned by `mapshot optimize` of each surface.
+func isShotManifest(name string) bool {
+	base := path.Base(name)
+	return base == shot.TilesFilename || strings.HasSuffix(base, "uniform.json")
+}
+
+// listTiles builds the manifest of the tiles of a shot directory. Tiles pruned
+// by `mapshot optimize` are listed as existing. It also returns the number of
+// tiles.
+func listTiles(si *shotInfo) (*shot.Tiles, int, error) {
+	tiles := &shot.Tiles{}
+	count := 0
+	for _, surface := range si.json.Surfaces {
+		st := &shot.SurfaceTiles{FilePrefix: surface.FilePrefix}
+		for zoom := surface.ZoomMin; zoom <= surface.ZoomMax; zoom++ {
+			level := shot.NewTileLevel(surface, zoom)
+			// Listing directories is much cheaper than looking up each tile,
+			// in particular on S3.
+			dir := path.Join(si.location, fmt.Sprintf("%s%d", surface.FilePrefix, zoom))
+			entries, err := si.store.ReadDir(dir)
+			if err != nil && !errors.Is(err, fs.ErrNotExist) {
+				return nil, 0, err
+			}
+			for _, entry := range entries {
+				var x, y int
+				if _, err := fmt.Sscanf(entry.Name(), "tile_%d_%d.jpg", &x, &y); err != nil {
+					continue
+				}
+				if path.Base(surface.TilePath(zoom, x, y)) == entry.Name() {
+					level.Set(x, y)
+				}
+			}
+			minX, minY, maxX, maxY := surface.TileRange(zoom)
+			for y := minY; y <= maxY; y++ {
+				for x := minX; x <= maxX; x++ {
+					if _, ok := si.uniformTile(surface.TilePath(zoom, x, y)); ok {
+						level.Set(x, y)
+					}
+					if level.Has(x, y) {
+						count++
+					}
+				}
+			}
+			st.Levels = append(st.Levels, level)
+		}
+		tiles.Surfaces = append(tiles.Surfaces, st)
+	}
+	return tiles, count, nil
+}
+
+// writeTilesManifest writes the manifest of the tiles of a shot directory. It
+// returns the number of tiles.
+func writeTilesManifest(ctx context.Context, si *shotInfo) (int, error) {
+	if archivedShotDir(si.location) != "" {
+		return 0, fmt.Errorf("%s is archived; archives do not need a manifest", si.location)
+	}
+	store, ok := si.store.(storage.Writable)
+	if !ok {
+		return 0, fmt.Errorf("storage %s is read-only", si.store)
+	}
+	tiles, count, err := listTiles(si)
+	if err != nil {
+		return 0, err
+	}
+	raw, err := json.Marshal(tiles)
+	if err != nil {
+		return 0, err
+	}
+	location := path.Join(si.location, shot.TilesFilename)
+	if err := store.Put(ctx, location, bytes.NewReader(raw), int64(len(raw))); err != nil {
+		return 0, fmt.Errorf("unable to write %s: %w", location, err)
+	}
+	return count, nil
+}
+
+// updateTilesManifest writes the manifest of the tiles of a shot directory
+// again if it has one, after tiles were added.
+func updateTilesManifest(ctx context.Context, si *shotInfo) error {
+	if _, err := fs.Stat(si.store, path.Join(si.location, shot.TilesFilename)); err != nil {
+		return nil
+	}
+	_, err := writeTilesManifest(ctx, si)
+	return err
+}
+
+// finishTiles writes the manifest of the tiles of a shot rendered by
+// `mapshot render`.
+func finishTiles(ctx context.Context, scriptOutput string, location string) error {
+	store, err := storage.NewLocal(scriptOutput)
+	if err != nil {
+		return err
+	}
+	si, err := loadShot(&serveRoot{location: scriptOutput, storage: store}, location)
+	if err != nil {
+		return err
+	}
+	count, err := writeTilesManifest(ctx, si)
+	if err != nil {
+		return err
+	}
+	slog.Info("tiles manifest written", "location", location, "tiles", count)
+	return nil
+}
+
+var cmdManifest = &cobra.Command{
+	Use:   "manifest <shot>",
+	Short: "Write the list of the tiles of a mapshot.",
+	Long: `Write the list of the tiles of a mapshot.
+
+The mod does not write tiles which would only contain empty areas. The list of
+the tiles which exist, per surface and zoom level, is written as tiles.json in
+the mapshot directory. 'mapshot serve' then answers requests for other tiles
+right away - see its --missing_tiles flag - instead of looking them up in the
+storage. 'mapshot render' writes it after each render; this command writes it
+for older mapshots, or again after tiles were changed by hand.
+
+Only complete mapshot directories need it: archives are indexed in memory.
+
+The shot is the mapshot directory (the one of the form d-<hash>). With --source,
+it is relative to that location instead, which can be an S3 bucket.
+`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		si, err := openShot(cmd.Context(), flagManifestSource, args[0])
+		if err != nil {
+			return err
+		}
+		if si.status != shotComplete {
+			return fmt.Errorf("%s: render is not complete (%s)", args[0], si.status)
+		}
+		count, err := writeTilesManifest(cmd.Context(), si)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%s: %d tiles listed\n", args[0], count)
+		return nil
+	},
+}
+
+var flagManifestSource string
+
+func init() {
+	cmdManifest.PersistentFlags().StringVar(&flagManifestSource, "source", "", "Where to find the mapshot; a directory or s3://<bucket>/<prefix>. If empty, the mapshot is a local path.")
+	cmdRoot.AddCommand(cmdManifest)
+}
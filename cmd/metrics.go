@@ -0,0 +1,270 @@
+package cmd
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/prometheus/client_golang/prometheus/push"
+)
+
+// Classes of routes of the server, used to label request metrics. Paths are
+// not used directly, as they would give unbounded cardinality.
+const (
+	routeTiles   = "tiles"
+	routeListing = "listing"
+	routeAPI     = "api"
+	routeEvents  = "events"
+	routeMetrics = "metrics"
+	routeHealth  = "health"
+)
+
+// routeClass returns the class of route serving the path.
+func routeClass(urlPath string) string {
+	switch {
+	case strings.HasPrefix(urlPath, "/data/"):
+		return routeTiles
+	case strings.HasPrefix(urlPath, "/api/"):
+		return routeAPI
+	case urlPath == "/events":
+		return routeEvents
+	case urlPath == flagServeMetricsPath:
+		return routeMetrics
+	case urlPath == "/healthz" || urlPath == "/readyz":
+		return routeHealth
+	default:
+		return routeListing
+	}
+}
+
+// serverMetrics holds the metrics of `mapshot serve`. A dedicated registry is
+// used, so several servers can coexist - e.g., in tests or `mapshot dev`.
+type serverMetrics struct {
+	registry *prometheus.Registry
+
+	requests      *prometheus.CounterVec
+	latency       *prometheus.HistogramVec
+	bytes         *prometheus.CounterVec
+	scanDuration  *prometheus.HistogramVec
+	scanErrors    *prometheus.CounterVec
+	lastScanStart *prometheus.GaugeVec
+}
+
+func newServerMetrics(idx *shotIndex) *serverMetrics {
+	m := &serverMetrics{
+		registry: prometheus.NewRegistry(),
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "mapshot_http_requests_total",
+			Help: "Number of HTTP requests, by class of route and status code.",
+		}, []string{"route", "code"}),
+		latency: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "mapshot_http_request_duration_seconds",
+			Help:    "Time to serve HTTP requests, by class of route. Event streams are not included.",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"route"}),
+		bytes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "mapshot_http_response_bytes_total",
+			Help: "Bytes of response bodies sent, after compression, by class of route.",
+		}, []string{"route"}),
+		scanDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "mapshot_scan_duration_seconds",
+			Help:    "Time taken by full scans of the roots to find mapshots.",
+			Buckets: prometheus.ExponentialBuckets(0.01, 4, 8),
+		}, []string{"root"}),
+		scanErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "mapshot_scan_errors_total",
+			Help: "Number of errors during scans: failed scans and mapshots which could not be loaded.",
+		}, []string{"root"}),
+		lastScanStart: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "mapshot_scan_last_timestamp_seconds",
+			Help: "When the last full scan of the root started, as a Unix timestamp.",
+		}, []string{"root"}),
+	}
+	m.registry.MustRegister(
+		m.requests, m.latency, m.bytes,
+		m.scanDuration, m.scanErrors, m.lastScanStart,
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "mapshot_saves",
+			Help: "Number of saves in the index.",
+		}, func() float64 {
+			saves, _ := idx.counts()
+			return float64(saves)
+		}),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "mapshot_shots",
+			Help: "Number of mapshots in the index, including those not complete.",
+		}, func() float64 {
+			_, shots := idx.counts()
+			return float64(shots)
+		}),
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+	return m
+}
+
+// observeScan records the result of a scan of a root.
+func (m *serverMetrics) observeScan(root string, start time.Time, failed int, err error) {
+	m.lastScanStart.WithLabelValues(root).Set(float64(start.Unix()))
+	m.scanDuration.WithLabelValues(root).Observe(time.Since(start).Seconds())
+	errors := m.scanErrors.WithLabelValues(root)
+	errors.Add(float64(failed))
+	if err != nil {
+		errors.Inc()
+	}
+}
+
+// handler serves the metrics.
+func (m *serverMetrics) handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
+
+// wrap records metrics about the requests served by h.
+func (m *serverMetrics) wrap(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		start := time.Now()
+		route := routeClass(req.URL.Path)
+		mw := &statusWriter{ResponseWriter: w, code: http.StatusOK}
+		h.ServeHTTP(mw, req)
+		m.requests.WithLabelValues(route, strconv.Itoa(mw.code)).Inc()
+		m.bytes.WithLabelValues(route).Add(float64(mw.written))
+		if route != routeEvents {
+			m.latency.WithLabelValues(route).Observe(time.Since(start).Seconds())
+		}
+	})
+}
+
+// statusWriter keeps track of the status code and size of a response, for
+// metrics and access logs.
+type statusWriter struct {
+	http.ResponseWriter
+	code    int
+	written int64
+}
+
+func (mw *statusWriter) WriteHeader(code int) {
+	mw.code = code
+	mw.ResponseWriter.WriteHeader(code)
+}
+
+// Unwrap gives access to the underlying writer, for http.ResponseController.
+func (mw *statusWriter) Unwrap() http.ResponseWriter {
+	return mw.ResponseWriter
+}
+
+func (mw *statusWriter) Write(b []byte) (int, error) {
+	n, err := mw.ResponseWriter.Write(b)
+	mw.written += int64(n)
+	return n, err
+}
+
+// Flush is needed to stream events.
+func (mw *statusWriter) Flush() {
+	if f, ok := mw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Hijack is provided for completeness, as the writer wraps all handlers.
+func (mw *statusWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hj, ok := mw.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("hijacking not supported")
+	}
+	return hj.Hijack()
+}
+
+// renderMetrics describes a single run of `mapshot render`. They are pushed to
+// a Prometheus Pushgateway and/or written for the textfile collector of the
+// node exporter once the render is finished.
+type renderMetrics struct {
+	savename string
+	start    time.Time
+	// Which steps were reached; metrics of other steps are not reported.
+	isStarted, isDone bool
+
+	startup     prometheus.Gauge
+	duration    prometheus.Gauge
+	tiles       prometheus.Gauge
+	success     prometheus.Gauge
+	lastRun     prometheus.Gauge
+	lastSuccess prometheus.Gauge
+}
+
+func newRenderMetrics(savename string) *renderMetrics {
+	gauge := func(name string, help string) prometheus.Gauge {
+		return prometheus.NewGauge(prometheus.GaugeOpts{Name: name, Help: help})
+	}
+	return &renderMetrics{
+		savename:    savename,
+		start:       time.Now(),
+		startup:     gauge("mapshot_render_factorio_startup_seconds", "Time for Factorio to start and load the save, until the mod starts rendering."),
+		duration:    gauge("mapshot_render_duration_seconds", "Total time of the render, including Factorio startup."),
+		tiles:       gauge("mapshot_render_tiles", "Number of tiles produced by the render."),
+		success:     gauge("mapshot_render_success", "Whether the render succeeded (1) or failed (0)."),
+		lastRun:     gauge("mapshot_render_last_run_timestamp_seconds", "When the render finished, successfully or not, as a Unix timestamp."),
+		lastSuccess: gauge("mapshot_render_last_success_timestamp_seconds", "When the render last finished successfully, as a Unix timestamp. Not set on failure."),
+	}
+}
+
+// started records that Factorio is up and the mod started rendering.
+func (m *renderMetrics) started() {
+	m.startup.Set(time.Since(m.start).Seconds())
+	m.isStarted = true
+}
+
+// done records that the render has been written.
+func (m *renderMetrics) done(tiles int) {
+	m.duration.Set(time.Since(m.start).Seconds())
+	m.tiles.Set(float64(tiles))
+	m.isDone = true
+}
+
+// export records the final status of the render and sends the metrics where
+// requested by the flags.
+func (m *renderMetrics) export(renderErr error) error {
+	now := float64(time.Now().Unix())
+	m.lastRun.Set(now)
+	collectors := []prometheus.Collector{m.success, m.lastRun}
+	if m.isStarted {
+		collectors = append(collectors, m.startup)
+	}
+	if m.isDone {
+		collectors = append(collectors, m.duration, m.tiles)
+	}
+	if renderErr == nil {
+		m.success.Set(1)
+		m.lastSuccess.Set(now)
+		collectors = append(collectors, m.lastSuccess)
+	} else {
+		m.success.Set(0)
+	}
+
+	if flagRenderPushgateway != "" {
+		// The metrics of other saves are kept, as they are in another group.
+		// Adding, instead of replacing, also keeps the time of the last
+		// success when the render failed.
+		p := push.New(flagRenderPushgateway, "mapshot_render").Grouping("savename", m.savename)
+		for _, c := range collectors {
+			p = p.Collector(c)
+		}
+		if err := p.Add(); err != nil {
+			return fmt.Errorf("unable to push metrics to %s: %w", flagRenderPushgateway, err)
+		}
+	}
+	if flagRenderMetricsFile != "" {
+		reg := prometheus.NewRegistry()
+		prometheus.WrapRegistererWith(prometheus.Labels{"savename": m.savename}, reg).MustRegister(collectors...)
+		if err := prometheus.WriteToTextfile(flagRenderMetricsFile, reg); err != nil {
+			return fmt.Errorf("unable to write metrics: %w", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,73 @@
+package cmd
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRouteClass(t *testing.T) {
+	tests := []struct {
+		path string
+		want string
+	}{
+		{"/data/mapshot/save/d-1/zoom_0/tile_0_0.jpg", routeTiles},
+		{"/api/v1/saves", routeAPI},
+		{"/api/snapshot", routeAPI},
+		{"/events", routeEvents},
+		{flagServeMetricsPath, routeMetrics},
+		{"/healthz", routeHealth},
+		{"/readyz", routeHealth},
+		{"/", routeListing},
+		{"/map/", routeListing},
+		{"/shots.json", routeListing},
+	}
+	for _, tc := range tests {
+		if got := routeClass(tc.path); got != tc.want {
+			t.Errorf("routeClass(%q) = %q, want %q", tc.path, got, tc.want)
+		}
+	}
+}
+
+// TestServerMetricsIndependent checks that servers do not share metrics.
+// Registering the same metrics twice in the default registry would panic.
+func TestServerMetricsIndependent(t *testing.T) {
+	h := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/missing" {
+			http.NotFound(w, req)
+			return
+		}
+		w.Write([]byte("content"))
+	})
+	m1 := newServerMetrics(newShotIndex(false, nil, nil))
+	m2 := newServerMetrics(newShotIndex(false, nil, nil))
+	h1, h2 := m1.wrap(h), m2.wrap(h)
+
+	for _, p := range []string{"/", "/api/v1/saves", "/missing"} {
+		h1.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, p, nil))
+	}
+	h2.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+
+	tests := []struct {
+		desc string
+		m    *serverMetrics
+		line string
+		want bool
+	}{
+		{"first server, listing", m1, `mapshot_http_requests_total{code="200",route="listing"} 1`, true},
+		{"first server, api", m1, `mapshot_http_requests_total{code="200",route="api"} 1`, true},
+		{"first server, not found", m1, `mapshot_http_requests_total{code="404",route="listing"} 1`, true},
+		{"first server, bytes", m1, `mapshot_http_response_bytes_total{route="api"} 7`, true},
+		{"second server, listing", m2, `mapshot_http_requests_total{code="200",route="listing"} 1`, true},
+		{"second server, api", m2, `route="api"`, false},
+		{"second server, not found", m2, `code="404"`, false},
+	}
+	for _, tc := range tests {
+		rec := httptest.NewRecorder()
+		tc.m.handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, flagServeMetricsPath, nil))
+		if got := strings.Contains(rec.Body.String(), tc.line); got != tc.want {
+			t.Errorf("%s: presence of %q is %v, want %v", tc.desc, tc.line, got, tc.want)
+		}
+	}
+}
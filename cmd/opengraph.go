@@ -0,0 +1,299 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"io"
+	"log/slog"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/Palats/mapshot/shot"
+)
+
+// Size of the preview images of shared links; the size recommended for
+// OpenGraph images.
+const (
+	previewWidth  = 1200
+	previewHeight = 630
+)
+
+// Default size of the iframe given through oEmbed.
+const (
+	oembedWidth  = 800
+	oembedHeight = 600
+)
+
+// viewerTarget is what the viewer shows for a given URL.
+type viewerTarget struct {
+	shot    *shotInfo
+	surface *shot.Surface
+	view    viewport
+	// Whether the shot was designated as the latest of a save - `l` query
+	// parameter - instead of directly.
+	latest bool
+}
+
+// resolveViewer finds what the viewer shows for the given query parameters,
+// the same way the viewer does. It returns nil if the shot is not known or
+// not accessible for the request.
+func (s *Server) resolveViewer(req *http.Request, query url.Values) *viewerTarget {
+	t := &viewerTarget{}
+	if savename := query.Get("l"); savename != "" {
+		t.shot = s.idx.latestShot(savename)
+		t.latest = true
+	} else if encodedPath := query.Get("path"); encodedPath != "" {
+		p, err := url.PathUnescape(encodedPath)
+		if err != nil {
+			return nil
+		}
+		p = strings.TrimPrefix(p, requestPrefix(req))
+		if !strings.HasSuffix(p, "/") {
+			p += "/"
+		}
+		if si, rest := s.idx.lookup(p); rest == "/" {
+			t.shot = si
+		}
+	}
+	if t.shot == nil || !requestAccess(req).allowed(t.shot.savename) || len(t.shot.json.Surfaces) == 0 {
+		return nil
+	}
+	surfaceKey := query.Get("s")
+	if surfaceKey == "" {
+		surfaceKey = "1"
+	}
+	if t.surface = t.shot.json.Surface(surfaceKey); t.surface == nil {
+		t.surface = t.shot.json.Surfaces[0]
+	}
+	// Invalid values are ignored, as in the viewer.
+	parse := func(key string) float64 {
+		v, err := strconv.ParseFloat(query.Get(key), 64)
+		if err != nil || math.IsNaN(v) || math.IsInf(v, 0) {
+			return 0
+		}
+		return v
+	}
+	t.view = viewport{x: parse("x"), y: parse("y"), z: parse("z")}
+	return t
+}
+
+// title is the title of the page showing the target.
+func (t *viewerTarget) title() string {
+	title := t.shot.savename
+	if len(t.shot.json.Surfaces) > 1 {
+		title += " (" + t.surface.DisplayName() + ")"
+	}
+	return title + " - Mapshot"
+}
+
+// description summarizes the target for link previews.
+func (t *viewerTarget) description() string {
+	return fmt.Sprintf("Factorio map of %s, after %s of play (tick %d).", t.shot.savename, formatTicks(t.shot.json.TicksPlayed), t.shot.json.Tick)
+}
+
+// formatTicks gives a human readable duration for a number of game ticks.
+func formatTicks(ticks int64) string {
+	minutes := ticks / 60 / 60
+	days, hours := minutes/60/24, minutes/60%24
+	if days > 0 {
+		return fmt.Sprintf("%dd %dh %02dm", days, hours, minutes%60)
+	}
+	return fmt.Sprintf("%dh %02dm", hours, minutes%60)
+}
+
+// viewerQuery returns the query parameters of the viewer relevant to the
+// target, normalized.
+func viewerQuery(query url.Values) url.Values {
+	q := url.Values{}
+	for _, key := range []string{"l", "path", "s", "x", "y", "z", "lt", "lg", "ld"} {
+		if v := query.Get(key); v != "" {
+			q.Set(key, v)
+		}
+	}
+	return q
+}
+
+var viewerMetadataTemplate = template.Must(template.New("metadata").Parse(`
+    <meta name="description" content="{{.Description}}">
+    <meta property="og:type" content="website">
+    <meta property="og:site_name" content="Mapshot">
+    <meta property="og:title" content="{{.Title}}">
+    <meta property="og:description" content="{{.Description}}">
+    <meta property="og:url" content="{{.URL}}">
+    <meta property="og:image" content="{{.Image}}">
+    <meta property="og:image:width" content="{{.ImageWidth}}">
+    <meta property="og:image:height" content="{{.ImageHeight}}">
+    <meta name="twitter:card" content="summary_large_image">
+    <meta name="twitter:title" content="{{.Title}}">
+    <meta name="twitter:description" content="{{.Description}}">
+    <meta name="twitter:image" content="{{.Image}}">
+    <link rel="alternate" type="application/json+oembed" href="{{.OEmbed}}" title="{{.Title}}">
+`))
+
+// withViewerMetadata adds OpenGraph & Twitter card tags to the viewer page,
+// along with oEmbed discovery, so links to a map unfurl nicely in chats and
+// forums. Other files of the viewer are served unchanged.
+func (s *Server) withViewerMetadata(viewer http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/map/" && req.URL.Path != "/map/index.html" {
+			viewer.ServeHTTP(w, req)
+			return
+		}
+		t := s.resolveViewer(req, req.URL.Query())
+		if t == nil {
+			viewer.ServeHTTP(w, req)
+			return
+		}
+
+		page, err := s.viewerPage()
+		if err != nil {
+			slog.Error("unable to read viewer page", "err", err)
+			viewer.ServeHTTP(w, req)
+			return
+		}
+		var buf bytes.Buffer
+		if err := renderViewerPage(&buf, string(page), t, requestBaseURL(req), req.URL.Query()); err != nil {
+			slog.Error("unable to generate viewer metadata", "err", err)
+			viewer.ServeHTTP(w, req)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		// The page points to whatever the latest shot is.
+		w.Header().Set("Cache-Control", cacheShort)
+		w.Write(buf.Bytes())
+	})
+}
+
+// renderViewerPage writes the viewer page with the title and metadata of the
+// target. base is the URL the server is reached at.
+func renderViewerPage(w io.Writer, page string, t *viewerTarget, base string, query url.Values) error {
+	head, tail, ok := strings.Cut(page, "</head>")
+	if !ok {
+		return fmt.Errorf("viewer page has no </head>")
+	}
+	query = viewerQuery(query)
+	pageURL := base + "/map/?" + query.Encode()
+	head = strings.Replace(head, "<title>Mapshot</title>", "<title>"+template.HTMLEscapeString(t.title())+"</title>", 1)
+	if _, err := io.WriteString(w, head); err != nil {
+		return err
+	}
+	err := viewerMetadataTemplate.Execute(w, map[string]interface{}{
+		"Title":       t.title(),
+		"Description": t.description(),
+		"URL":         pageURL,
+		"Image":       base + "/map/preview?" + query.Encode(),
+		"ImageWidth":  previewWidth,
+		"ImageHeight": previewHeight,
+		"OEmbed":      base + "/oembed?" + url.Values{"url": {pageURL}, "format": {"json"}}.Encode(),
+	})
+	if err != nil {
+		return err
+	}
+	_, err = io.WriteString(w, "</head>"+tail)
+	return err
+}
+
+// servePreview sends an image of what the viewer shows for the query
+// parameters, at the size of OpenGraph images.
+func (s *Server) servePreview(w http.ResponseWriter, req *http.Request) {
+	t := s.resolveViewer(req, req.URL.Query())
+	if t == nil {
+		http.NotFound(w, req)
+		return
+	}
+	s.serveViewport(w, req, t, previewWidth, previewHeight, imageJPEG)
+}
+
+// OEmbedJSON is the response of the oEmbed endpoint. See https://oembed.com/.
+type OEmbedJSON struct {
+	Type            string `json:"type"`
+	Version         string `json:"version"`
+	Title           string `json:"title"`
+	ProviderName    string `json:"provider_name"`
+	ProviderURL     string `json:"provider_url"`
+	HTML            string `json:"html"`
+	Width           int    `json:"width"`
+	Height          int    `json:"height"`
+	ThumbnailURL    string `json:"thumbnail_url"`
+	ThumbnailWidth  int    `json:"thumbnail_width"`
+	ThumbnailHeight int    `json:"thumbnail_height"`
+}
+
+var oembedTemplate = template.Must(template.New("oembed").Parse(
+	`<iframe src="{{.URL}}" width="{{.Width}}" height="{{.Height}}" title="{{.Title}}" style="border: 0" allowfullscreen></iframe>`))
+
+// serveOEmbed implements the oEmbed endpoint for viewer URLs, giving an
+// iframe of the interactive viewer.
+func (s *Server) serveOEmbed(w http.ResponseWriter, req *http.Request) {
+	query := req.URL.Query()
+	if f := query.Get("format"); f != "" && f != "json" {
+		http.Error(w, "only json format is supported", http.StatusNotImplemented)
+		return
+	}
+	target, err := url.Parse(query.Get("url"))
+	if err != nil {
+		http.Error(w, "invalid url", http.StatusBadRequest)
+		return
+	}
+	prefix := requestPrefix(req)
+	if target.Path != prefix+"/map/" && target.Path != prefix+"/map/index.html" {
+		http.NotFound(w, req)
+		return
+	}
+	t := s.resolveViewer(req, target.Query())
+	if t == nil {
+		http.NotFound(w, req)
+		return
+	}
+	noteShot(req, t.shot)
+
+	width, height := oembedWidth, oembedHeight
+	if v, err := strconv.Atoi(query.Get("maxwidth")); err == nil && v > 0 && v < width {
+		width = v
+	}
+	if v, err := strconv.Atoi(query.Get("maxheight")); err == nil && v > 0 && v < height {
+		height = v
+	}
+	// Links are rebuilt rather than reusing the given URL, so they always
+	// point to this server.
+	base := requestBaseURL(req)
+	viewerParams := viewerQuery(target.Query()).Encode()
+	var iframe bytes.Buffer
+	err = oembedTemplate.Execute(&iframe, map[string]interface{}{
+		"URL":    base + "/map/?" + viewerParams,
+		"Width":  width,
+		"Height": height,
+		"Title":  t.title(),
+	})
+	if err != nil {
+		slog.Error("unable to generate oEmbed", "err", err)
+		http.Error(w, "unable to generate oEmbed", http.StatusInternalServerError)
+		return
+	}
+	resp := &OEmbedJSON{
+		Type:            "rich",
+		Version:         "1.0",
+		Title:           t.title(),
+		ProviderName:    "Mapshot",
+		ProviderURL:     base + "/",
+		HTML:            iframe.String(),
+		Width:           width,
+		Height:          height,
+		ThumbnailURL:    base + "/map/preview?" + viewerParams,
+		ThumbnailWidth:  previewWidth,
+		ThumbnailHeight: previewHeight,
+	}
+	raw, err := json.Marshal(resp)
+	if err != nil {
+		http.Error(w, "unable to encode response", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", cacheShort)
+	w.Write(raw)
+}
@@ -0,0 +1,530 @@
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/jpeg"
+	"io"
+	"io/fs"
+	"log/slog"
+	"net/http"
+	"path"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Palats/mapshot/shot"
+	"github.com/Palats/mapshot/storage"
+	"github.com/spf13/cobra"
+)
+
+// Lowest JPEG quality used to bring tiles under --target_size.
+const optimizeMinQuality = 20
+
+// uniformTile is a tile pruned by `mapshot optimize`, as it had a single color.
+type uniformTile struct {
+	color color.RGBA
+	// Width and height, in pixels.
+	size int
+}
+
+// image recreates the tile.
+func (t uniformTile) image() *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, t.size, t.size))
+	draw.Draw(img, img.Rect, &image.Uniform{t.color}, image.Point{}, draw.Src)
+	return img
+}
+
+// encode recreates the tile as a JPEG, like the tiles written by the mod.
+func (t uniformTile) encode() ([]byte, error) {
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, t.image(), &jpeg.Options{Quality: defaultJPGQuality}); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// uniformTileCacheEntries is the number of encoded pruned tiles kept in
+// memory. Most pruned tiles share a few colors - water, void.
+const uniformTileCacheEntries = 1024
+
+var uniformTileCache = struct {
+	sync.Mutex
+	encoded map[uniformTile][]byte
+}{encoded: map[uniformTile][]byte{}}
+
+// cachedEncode is the same as encode, but keeps the result: pruned tiles
+// make up large parts of most views.
+func (t uniformTile) cachedEncode() ([]byte, error) {
+	uniformTileCache.Lock()
+	data, ok := uniformTileCache.encoded[t]
+	uniformTileCache.Unlock()
+	if ok {
+		return data, nil
+	}
+	data, err := t.encode()
+	if err != nil {
+		return nil, err
+	}
+	uniformTileCache.Lock()
+	defer uniformTileCache.Unlock()
+	if len(uniformTileCache.encoded) >= uniformTileCacheEntries {
+		// Unusual; no need to be smart about it.
+		uniformTileCache.encoded = map[uniformTile][]byte{}
+	}
+	uniformTileCache.encoded[t] = data
+	return data, nil
+}
+
+// ServeHTTP sends the tile.
+func (t uniformTile) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	data, err := t.cachedEncode()
+	if err != nil {
+		http.Error(w, "unable to encode tile", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "image/jpeg")
+	http.ServeContent(w, req, "", time.Time{}, bytes.NewReader(data))
+}
+
+// parseHexColor decodes a color written as #rrggbb.
+func parseHexColor(s string) (color.RGBA, error) {
+	c := color.RGBA{A: 255}
+	if _, err := fmt.Sscanf(s, "#%02x%02x%02x", &c.R, &c.G, &c.B); err != nil || len(s) != 7 {
+		return c, fmt.Errorf("invalid color %q", s)
+	}
+	return c, nil
+}
+
+func hexColor(c color.RGBA) string {
+	return fmt.Sprintf("#%02x%02x%02x", c.R, c.G, c.B)
+}
+
+// readUniformTiles reads the manifest of pruned tiles of a surface. open reads
+// a file of the shot, given relative to the shot directory. A surface without
+// manifest has no pruned tile.
+func readUniformTiles(open func(string) (io.ReadCloser, error), surface *shot.Surface) (*shot.UniformTiles, error) {
+	ut := &shot.UniformTiles{Tiles: map[string]string{}}
+	name := surface.UniformTilesPath()
+	r, err := open(name)
+	if errors.Is(err, fs.ErrNotExist) {
+		return ut, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	if err := json.NewDecoder(r).Decode(ut); err != nil {
+		return nil, fmt.Errorf("invalid %s: %w", name, err)
+	}
+	if ut.Tiles == nil {
+		ut.Tiles = map[string]string{}
+	}
+	return ut, nil
+}
+
+// loadUniformTiles reads the manifests of pruned tiles of all the surfaces.
+func loadUniformTiles(open func(string) (io.ReadCloser, error), data *shot.Mapshot) (map[string]uniformTile, error) {
+	tiles := map[string]uniformTile{}
+	for _, surface := range data.Surfaces {
+		ut, err := readUniformTiles(open, surface)
+		if err != nil {
+			return nil, err
+		}
+		for name, hex := range ut.Tiles {
+			c, err := parseHexColor(hex)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %s: %w", surface.UniformTilesPath(), name, err)
+			}
+			tiles[name] = uniformTile{color: c, size: surface.RenderSize}
+		}
+	}
+	return tiles, nil
+}
+
+// uniformTile indicates whether the tile, given relative to the shot
+// directory, was pruned by `mapshot optimize`. Manifests are read on first use;
+// invalid ones are ignored.
+func (si *shotInfo) uniformTile(name string) (uniformTile, bool) {
+	if !strings.HasSuffix(name, ".jpg") {
+		return uniformTile{}, false
+	}
+	si.uniformOnce.Do(func() {
+		tiles, err := loadUniformTiles(si.open, si.json)
+		if err != nil {
+			slog.Error("unable to load pruned tiles", "shot", si.name, "err", err)
+			return
+		}
+		si.uniformTiles = tiles
+	})
+	t, ok := si.uniformTiles[name]
+	return t, ok
+}
+
+// averageColor returns the average color of the image, and whether all its
+// pixels are within tolerance of it on each component.
+func averageColor(img image.Image, tolerance int) (color.RGBA, bool) {
+	b := img.Bounds()
+	rgba, ok := img.(*image.RGBA)
+	if !ok {
+		rgba = image.NewRGBA(b)
+		draw.Draw(rgba, b, img, b.Min, draw.Src)
+	}
+	var sum [3]int
+	lo := [3]int{255, 255, 255}
+	var hi [3]int
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		row := rgba.Pix[rgba.PixOffset(b.Min.X, y):]
+		for x := 0; x < b.Dx(); x++ {
+			for c := 0; c < 3; c++ {
+				v := int(row[4*x+c])
+				sum[c] += v
+				lo[c] = min(lo[c], v)
+				hi[c] = max(hi[c], v)
+			}
+		}
+		// Most tiles are far from uniform; no need to look further.
+		for c := 0; c < 3; c++ {
+			if hi[c]-lo[c] > 2*tolerance {
+				return color.RGBA{}, false
+			}
+		}
+	}
+	n := b.Dx() * b.Dy()
+	if n == 0 {
+		return color.RGBA{}, false
+	}
+	var avg [3]uint8
+	for c := 0; c < 3; c++ {
+		a := (sum[c] + n/2) / n
+		if hi[c]-a > tolerance || a-lo[c] > tolerance {
+			return color.RGBA{}, false
+		}
+		avg[c] = uint8(a)
+	}
+	return color.RGBA{R: avg[0], G: avg[1], B: avg[2], A: 255}, true
+}
+
+// optimizer reduces the size of a shot: tiles of a single color are removed
+// and listed in a manifest of their surface instead, and other tiles can be
+// compressed again.
+type optimizer struct {
+	si    *shotInfo
+	store storage.Writable
+	// Maximum difference of each color component of a pixel with the average
+	// color of a tile for it to be pruned.
+	tolerance int
+	// JPEG quality to compress tiles again with; 0 to keep them as is. With
+	// targetSize, the highest quality to use.
+	quality int
+	// Size in bytes above which tiles are compressed again; 0 for none.
+	targetSize int
+	// Number of tiles processed concurrently.
+	parallel int
+	// Only report what would be done.
+	dryRun bool
+
+	tiles, pruned, recompressed atomic.Int64
+	// Size of the tiles before, and bytes saved.
+	before, saved atomic.Int64
+}
+
+func newOptimizer(si *shotInfo, tolerance, quality, targetSize, parallel int, dryRun bool) (*optimizer, error) {
+	if archivedShotDir(si.location) != "" {
+		return nil, fmt.Errorf("%s is archived; extract it first", si.location)
+	}
+	store, ok := si.store.(storage.Writable)
+	if !ok {
+		return nil, fmt.Errorf("storage %s is read-only", si.store)
+	}
+	// Tiles of renders in progress are still being written.
+	if si.status != shotComplete {
+		return nil, fmt.Errorf("%s: render is not complete (%s)", si.location, si.status)
+	}
+	if tolerance < 0 || tolerance > 255 {
+		return nil, fmt.Errorf("invalid tolerance %d", tolerance)
+	}
+	if quality < 0 || quality > 100 {
+		return nil, fmt.Errorf("invalid JPEG quality %d", quality)
+	}
+	if targetSize > 0 && quality > 0 && quality < optimizeMinQuality {
+		return nil, fmt.Errorf("JPEG quality must be at least %d with a target size", optimizeMinQuality)
+	}
+	if targetSize < 0 {
+		return nil, fmt.Errorf("invalid target size %d", targetSize)
+	}
+	if parallel < 1 {
+		return nil, fmt.Errorf("invalid parallelism %d", parallel)
+	}
+	return &optimizer{
+		si:         si,
+		store:      store,
+		tolerance:  tolerance,
+		quality:    quality,
+		targetSize: targetSize,
+		parallel:   parallel,
+		dryRun:     dryRun,
+	}, nil
+}
+
+// optimize processes all the surfaces.
+func (o *optimizer) optimize(ctx context.Context) error {
+	for _, surface := range o.si.json.Surfaces {
+		if err := o.optimizeSurface(ctx, surface); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// optimizeSurface processes the tiles of a surface. The manifest is written
+// before pruned tiles are removed, so they are always available one way or
+// the other.
+func (o *optimizer) optimizeSurface(ctx context.Context, surface *shot.Surface) error {
+	ut, err := readUniformTiles(o.si.open, surface)
+	if err != nil {
+		return err
+	}
+	var names []string
+	for zoom := surface.ZoomMin; zoom <= surface.ZoomMax; zoom++ {
+		minX, minY, maxX, maxY := surface.TileRange(zoom)
+		for y := minY; y <= maxY; y++ {
+			for x := minX; x <= maxX; x++ {
+				names = append(names, surface.TilePath(zoom, x, y))
+			}
+		}
+	}
+
+	var m sync.Mutex
+	var pruned []string
+	err = forEachParallel(ctx, o.parallel, names, func(ctx context.Context, name string) error {
+		uniform, exists, err := o.optimizeTile(ctx, surface, name)
+		if err != nil || !exists {
+			return err
+		}
+		m.Lock()
+		defer m.Unlock()
+		if uniform != nil {
+			ut.Tiles[name] = hexColor(*uniform)
+			pruned = append(pruned, name)
+		} else {
+			// The tile might have been written again since a previous run.
+			delete(ut.Tiles, name)
+		}
+		return nil
+	})
+	if err != nil || o.dryRun {
+		return err
+	}
+
+	location := path.Join(o.si.location, surface.UniformTilesPath())
+	if len(ut.Tiles) == 0 {
+		if err := o.store.Remove(ctx, location); err != nil {
+			return fmt.Errorf("unable to remove %s: %w", location, err)
+		}
+		return nil
+	}
+	raw, err := json.Marshal(ut)
+	if err != nil {
+		return err
+	}
+	if err := o.store.Put(ctx, location, bytes.NewReader(raw), int64(len(raw))); err != nil {
+		return fmt.Errorf("unable to write %s: %w", location, err)
+	}
+	sort.Strings(pruned)
+	return forEachParallel(ctx, o.parallel, pruned, func(ctx context.Context, name string) error {
+		location := path.Join(o.si.location, name)
+		if err := o.store.Remove(ctx, location); err != nil {
+			return fmt.Errorf("unable to remove %s: %w", location, err)
+		}
+		return nil
+	})
+}
+
+// optimizeTile looks at a single tile, indicating whether it exists. If it is
+// uniform, its color is returned; the caller takes care of removing it.
+// Otherwise, it is compressed again if requested.
+func (o *optimizer) optimizeTile(ctx context.Context, surface *shot.Surface, name string) (uniform *color.RGBA, exists bool, err error) {
+	location := path.Join(o.si.location, name)
+	raw, err := fs.ReadFile(o.store, location)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	img, err := jpeg.Decode(bytes.NewReader(raw))
+	if err != nil {
+		return nil, false, fmt.Errorf("unable to decode %s: %w", location, err)
+	}
+	o.tiles.Add(1)
+	o.before.Add(int64(len(raw)))
+
+	b := img.Bounds()
+	if b.Dx() == surface.RenderSize && b.Dy() == surface.RenderSize {
+		if c, ok := averageColor(img, o.tolerance); ok {
+			o.pruned.Add(1)
+			o.saved.Add(int64(len(raw)))
+			return &c, true, nil
+		}
+	}
+
+	data, err := o.recompress(img, len(raw))
+	if err != nil {
+		return nil, false, fmt.Errorf("unable to compress %s: %w", location, err)
+	}
+	if data != nil {
+		if !o.dryRun {
+			if err := o.store.Put(ctx, location, bytes.NewReader(data), int64(len(data))); err != nil {
+				return nil, false, fmt.Errorf("unable to write %s: %w", location, err)
+			}
+		}
+		o.recompressed.Add(1)
+		o.saved.Add(int64(len(raw) - len(data)))
+	}
+	return nil, true, nil
+}
+
+// recompress encodes the tile again, either at the requested quality, or at
+// the highest quality which fits in the target size. It returns nil when that
+// would not make the tile smaller.
+func (o *optimizer) recompress(img image.Image, size int) ([]byte, error) {
+	encode := func(quality int) ([]byte, error) {
+		var buf bytes.Buffer
+		err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: quality})
+		return buf.Bytes(), err
+	}
+
+	var data []byte
+	var err error
+	switch {
+	case o.targetSize > 0:
+		if size <= o.targetSize {
+			return nil, nil
+		}
+		lo, hi := optimizeMinQuality, 95
+		if o.quality > 0 {
+			hi = o.quality
+		}
+		// Size grows with quality, so search for the highest quality which
+		// fits; if none does, the lowest one is used.
+		if data, err = encode(lo); err != nil {
+			return nil, err
+		}
+		for lo < hi {
+			q := (lo + hi + 1) / 2
+			d, err := encode(q)
+			if err != nil {
+				return nil, err
+			}
+			if len(d) <= o.targetSize {
+				lo, data = q, d
+			} else {
+				hi = q - 1
+			}
+		}
+	case o.quality > 0:
+		if data, err = encode(o.quality); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, nil
+	}
+	if len(data) >= size {
+		return nil, nil
+	}
+	return data, nil
+}
+
+// formatBytes returns a human readable size.
+func formatBytes(n int64) string {
+	switch {
+	case n >= 1<<30:
+		return fmt.Sprintf("%.1f GiB", float64(n)/(1<<30))
+	case n >= 1<<20:
+		return fmt.Sprintf("%.1f MiB", float64(n)/(1<<20))
+	case n >= 1<<10:
+		return fmt.Sprintf("%.1f KiB", float64(n)/(1<<10))
+	}
+	return fmt.Sprintf("%d B", n)
+}
+
+var cmdOptimize = &cobra.Command{
+	Use:   "optimize <shot>",
+	Short: "Reduce the size of a mapshot, pruning tiles of a single color.",
+	Long: `Reduce the size of a mapshot, pruning tiles of a single color.
+
+Tiles where all the pixels are within --tolerance of a single color - e.g.,
+water, or the background of space platforms - are removed. Their color is
+recorded instead in a manifest of their surface, <prefix>uniform.json, next
+to the tiles. 'mapshot serve' recreates them from it when requested, as do
+previews and exports; a running server reads the manifest again when it
+changes - right away when watching a local directory, at the next rescan
+otherwise. Running optimize again on a mapshot is fine; tiles
+written since then - e.g., with 'mapshot pyramid --force' - are only used once
+optimize has looked at them.
+
+Other tiles can be compressed again: with --quality, at that JPEG quality;
+with --target_size, tiles larger than that many bytes use the highest quality
+which fits, down to 20 - then --quality is the highest quality to use. Tiles
+are only replaced when that makes them smaller. This loses details each time
+it is done.
+
+Static web hosts cannot recreate pruned tiles: 'mapshot export-site' writes
+them back, while 'mapshot publish' copies the manifests as is, for
+'mapshot serve'.
+
+The shot is the mapshot directory (the one of the form d-<hash>). With --source,
+it is relative to that location instead, which can be an S3 bucket. Only
+complete mapshots can be optimized.
+`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		si, err := openShot(cmd.Context(), flagOptimizeSource, args[0])
+		if err != nil {
+			return err
+		}
+		o, err := newOptimizer(si, flagOptimizeTolerance, flagOptimizeQuality, flagOptimizeTargetSize, flagOptimizeParallel, flagOptimizeDryRun)
+		if err != nil {
+			return err
+		}
+		if err := o.optimize(cmd.Context()); err != nil {
+			return err
+		}
+		prefix := ""
+		if o.dryRun {
+			prefix = "[dry run] "
+		}
+		fmt.Printf("%s%s: %d tiles, %d pruned, %d compressed again; %s saved out of %s\n", prefix, args[0],
+			o.tiles.Load(), o.pruned.Load(), o.recompressed.Load(), formatBytes(o.saved.Load()), formatBytes(o.before.Load()))
+		return nil
+	},
+}
+
+var (
+	flagOptimizeSource     string
+	flagOptimizeTolerance  int
+	flagOptimizeQuality    int
+	flagOptimizeTargetSize int
+	flagOptimizeParallel   int
+	flagOptimizeDryRun     bool
+)
+
+func init() {
+	cmdOptimize.PersistentFlags().StringVar(&flagOptimizeSource, "source", "", "Where to find the mapshot; a directory or s3://<bucket>/<prefix>. If empty, the mapshot is a local path.")
+	cmdOptimize.PersistentFlags().IntVar(&flagOptimizeTolerance, "tolerance", 4, "Maximum difference, on each of red, green and blue from 0 to 255, between the pixels of a tile and its average color for the tile to be pruned. 0 only prunes tiles of exactly one color.")
+	cmdOptimize.PersistentFlags().IntVar(&flagOptimizeQuality, "quality", 0, "JPEG quality, from 1 to 100, to compress tiles again with. 0 to keep them as is.")
+	cmdOptimize.PersistentFlags().IntVar(&flagOptimizeTargetSize, "target_size", 0, "Compress again tiles larger than this many bytes. 0 to keep them as is.")
+	cmdOptimize.PersistentFlags().IntVar(&flagOptimizeParallel, "parallel", runtime.NumCPU(), "Number of tiles to process concurrently.")
+	cmdOptimize.PersistentFlags().BoolVar(&flagOptimizeDryRun, "dry_run", false, "Only report what would be saved, without modifying the mapshot.")
+	cmdRoot.AddCommand(cmdOptimize)
+}
@@ -0,0 +1,389 @@
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/jpeg"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/Palats/mapshot/shot"
+)
+
+func TestAverageColor(t *testing.T) {
+	// fill returns an image of the given size, with the first pixel of
+	// another color.
+	fill := func(size int, c, first color.RGBA) image.Image {
+		img := uniformImage(size, c).(*image.RGBA)
+		img.SetRGBA(0, 0, first)
+		return img
+	}
+	// halves returns a 2x2 image, the top half of one color and the bottom
+	// one of another.
+	halves := func(top, bottom color.RGBA) image.Image {
+		img := image.NewRGBA(image.Rect(0, 0, 2, 2))
+		draw.Draw(img, image.Rect(0, 0, 2, 1), image.NewUniform(top), image.Point{}, draw.Src)
+		draw.Draw(img, image.Rect(0, 1, 2, 2), image.NewUniform(bottom), image.Point{}, draw.Src)
+		return img
+	}
+	gray := image.NewGray(image.Rect(0, 0, 4, 4))
+	for i := range gray.Pix {
+		gray.Pix[i] = 50
+	}
+	c := color.RGBA{10, 20, 30, 255}
+
+	tests := []struct {
+		desc      string
+		img       image.Image
+		tolerance int
+		want      color.RGBA
+		wantOK    bool
+	}{
+		{
+			desc:   "single color",
+			img:    fill(4, c, c),
+			want:   c,
+			wantOK: true,
+		},
+		{
+			desc:      "within tolerance",
+			img:       halves(color.RGBA{100, 100, 100, 255}, color.RGBA{108, 100, 100, 255}),
+			tolerance: 4,
+			want:      color.RGBA{104, 100, 100, 255},
+			wantOK:    true,
+		},
+		{
+			desc:      "beyond tolerance",
+			img:       halves(color.RGBA{100, 100, 100, 255}, color.RGBA{108, 100, 100, 255}),
+			tolerance: 3,
+		},
+		{
+			desc:      "single component beyond tolerance",
+			img:       halves(color.RGBA{100, 100, 100, 255}, color.RGBA{100, 100, 109, 255}),
+			tolerance: 4,
+		},
+		{
+			// Within twice the tolerance of each other, but too far from the
+			// average.
+			desc:      "outlier",
+			img:       fill(4, color.RGBA{100, 100, 100, 255}, color.RGBA{108, 100, 100, 255}),
+			tolerance: 4,
+		},
+		{
+			desc:      "outlier within tolerance",
+			img:       fill(4, color.RGBA{100, 100, 100, 255}, color.RGBA{104, 100, 100, 255}),
+			tolerance: 4,
+			want:      color.RGBA{100, 100, 100, 255},
+			wantOK:    true,
+		},
+		{
+			desc:   "not RGBA",
+			img:    gray,
+			want:   color.RGBA{50, 50, 50, 255},
+			wantOK: true,
+		},
+		{
+			desc:      "empty",
+			img:       image.NewRGBA(image.Rect(0, 0, 0, 0)),
+			tolerance: 4,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.desc, func(t *testing.T) {
+			got, ok := averageColor(tc.img, tc.tolerance)
+			if got != tc.want || ok != tc.wantOK {
+				t.Errorf("averageColor(%d) = %v, %v; want %v, %v", tc.tolerance, got, ok, tc.want, tc.wantOK)
+			}
+		})
+	}
+}
+
+// encodeTestJPEG encodes an image as a tile would be.
+func encodeTestJPEG(t *testing.T, img image.Image, quality int) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: quality}); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// noiseImage returns an image which does not compress well.
+func noiseImage(size int) image.Image {
+	r := rand.New(rand.NewPCG(1, 2))
+	img := image.NewRGBA(image.Rect(0, 0, size, size))
+	for i := range img.Pix {
+		img.Pix[i] = uint8(r.IntN(256))
+	}
+	return img
+}
+
+// Tiles of the shot written by writeOptimizeTestShot.
+const (
+	testTileGray  = "s1zoom_0/tile_-1_-1.jpg"
+	testTileBlue  = "s1zoom_0/tile_0_-1.jpg"
+	testTileNoise = "s1zoom_0/tile_0_0.jpg"
+	// Of a single color, but not of the render size.
+	testTileSmall = "s1zoom_0/tile_-1_0.jpg"
+)
+
+// uniformImage returns an image of a single color.
+func uniformImage(size int, c color.RGBA) image.Image {
+	img := image.NewRGBA(image.Rect(0, 0, size, size))
+	draw.Draw(img, img.Bounds(), image.NewUniform(c), image.Point{}, draw.Src)
+	return img
+}
+
+func decodeTestJPEG(t *testing.T, data []byte) image.Image {
+	t.Helper()
+	img, err := jpeg.Decode(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return img
+}
+
+// writeOptimizeTestShot writes a complete shot with a single surface of 4
+// tiles at zoom 0, of 16x16 pixels, and returns its directory and the content
+// of the tiles.
+func writeOptimizeTestShot(t *testing.T) (*serveRoot, *shotInfo, string, map[string][]byte) {
+	t.Helper()
+	root, dir := newTestRoot(t)
+	writeTestShot(t, dir, "save/d-1", 100, shot.StatusComplete)
+	tiles := map[string][]byte{
+		testTileGray:  encodeTestJPEG(t, uniformImage(16, color.RGBA{128, 128, 128, 255}), 90),
+		testTileBlue:  encodeTestJPEG(t, uniformImage(16, color.RGBA{20, 60, 200, 255}), 90),
+		testTileNoise: encodeTestJPEG(t, noiseImage(16), 100),
+		testTileSmall: encodeTestJPEG(t, uniformImage(8, color.RGBA{128, 128, 128, 255}), 90),
+	}
+	for name, data := range tiles {
+		p := filepath.Join(dir, "save", "d-1", filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, data, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return root, mustLoadShot(t, root, "save/d-1"), filepath.Join(dir, "save", "d-1"), tiles
+}
+
+// readTestTiles returns the content of the tiles which exist in the shot
+// directory.
+func readTestTiles(t *testing.T, dir string) map[string][]byte {
+	t.Helper()
+	got := map[string][]byte{}
+	for _, name := range []string{testTileGray, testTileBlue, testTileNoise, testTileSmall} {
+		data, err := os.ReadFile(filepath.Join(dir, filepath.FromSlash(name)))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		got[name] = data
+	}
+	return got
+}
+
+func TestOptimize(t *testing.T) {
+	ctx := context.Background()
+	root, si, dir, tiles := writeOptimizeTestShot(t)
+	total := int64(0)
+	for _, data := range tiles {
+		total += int64(len(data))
+	}
+	// Flat tiles decode to a single color, which is what gets recorded.
+	colorOf := func(name string) string {
+		r, g, b, _ := decodeTestJPEG(t, tiles[name]).At(0, 0).RGBA()
+		return hexColor(color.RGBA{uint8(r >> 8), uint8(g >> 8), uint8(b >> 8), 255})
+	}
+	wantUniform := map[string]string{testTileGray: colorOf(testTileGray), testTileBlue: colorOf(testTileBlue)}
+	if got := colorOf(testTileGray); got != "#808080" {
+		t.Fatalf("gray tile decodes to %s", got)
+	}
+	kept := map[string][]byte{testTileNoise: tiles[testTileNoise], testTileSmall: tiles[testTileSmall]}
+	saved := int64(len(tiles[testTileGray]) + len(tiles[testTileBlue]))
+
+	steps := []struct {
+		desc   string
+		dryRun bool
+
+		wantTiles   map[string][]byte
+		wantUniform map[string]string
+		// Expected counters: tiles, pruned, before, saved.
+		wantCounts [4]int64
+	}{
+		{
+			desc:       "dry run",
+			dryRun:     true,
+			wantTiles:  tiles,
+			wantCounts: [4]int64{4, 2, total, saved},
+		},
+		{
+			desc:        "pruning",
+			wantTiles:   kept,
+			wantUniform: wantUniform,
+			wantCounts:  [4]int64{4, 2, total, saved},
+		},
+		{
+			// Pruned tiles stay in the manifest.
+			desc:        "again",
+			wantTiles:   kept,
+			wantUniform: wantUniform,
+			wantCounts:  [4]int64{2, 0, total - saved, 0},
+		},
+	}
+	for _, step := range steps {
+		o, err := newOptimizer(si, 4, 0, 0, 2, step.dryRun)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := o.optimize(ctx); err != nil {
+			t.Fatalf("%s: optimize() failed: %v", step.desc, err)
+		}
+		if got := readTestTiles(t, dir); !reflect.DeepEqual(got, step.wantTiles) {
+			t.Errorf("%s: tiles changed; got %d tiles, want %d", step.desc, len(got), len(step.wantTiles))
+		}
+		var gotUniform map[string]string
+		raw, err := os.ReadFile(filepath.Join(dir, "s1zoom_uniform.json"))
+		if err == nil {
+			ut := &shot.UniformTiles{}
+			if err := json.Unmarshal(raw, ut); err != nil {
+				t.Fatalf("%s: invalid manifest: %v", step.desc, err)
+			}
+			gotUniform = ut.Tiles
+		} else if !os.IsNotExist(err) {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(gotUniform, step.wantUniform) {
+			t.Errorf("%s: manifest = %v, want %v", step.desc, gotUniform, step.wantUniform)
+		}
+		got := [4]int64{o.tiles.Load(), o.pruned.Load(), o.before.Load(), o.saved.Load()}
+		if got != step.wantCounts || o.recompressed.Load() != 0 {
+			t.Errorf("%s: tiles, pruned, before, saved = %v, %d compressed again; want %v, none", step.desc, got, o.recompressed.Load(), step.wantCounts)
+		}
+	}
+
+	// The server recreates pruned tiles from the manifest.
+	si = mustLoadShot(t, root, "save/d-1")
+	for name, hex := range wantUniform {
+		ut, ok := si.uniformTile(name)
+		if !ok || hexColor(ut.color) != hex || ut.size != 16 {
+			t.Errorf("uniformTile(%q) = %+v, %v; want %s of 16 pixels", name, ut, ok, hex)
+		}
+	}
+}
+
+func TestOptimizeTargetSize(t *testing.T) {
+	ctx := context.Background()
+	_, _, _, tiles := writeOptimizeTestShot(t)
+	original := tiles[testTileNoise]
+	img := decodeTestJPEG(t, original)
+	// Sizes at each quality considered by the search.
+	sizes := map[int]int{}
+	for q := optimizeMinQuality; q <= 95; q++ {
+		sizes[q] = len(encodeTestJPEG(t, img, q))
+	}
+	if sizes[95] >= len(original) || sizes[optimizeMinQuality] >= sizes[95] {
+		t.Fatalf("unexpected sizes of the noisy tile: %d originally, %v", len(original), sizes)
+	}
+
+	tests := []struct {
+		desc       string
+		quality    int
+		targetSize int
+		// Expected quality of the tile; 0 if left as is.
+		want int
+	}{
+		{
+			desc:       "larger than the tile",
+			targetSize: len(original),
+		},
+		{
+			desc:       "highest quality",
+			targetSize: sizes[95],
+			want:       95,
+		},
+		{
+			desc:       "in between",
+			targetSize: sizes[60],
+			want:       60,
+		},
+		{
+			desc:       "capped by quality",
+			quality:    50,
+			targetSize: sizes[95],
+			want:       50,
+		},
+		{
+			desc:       "too small",
+			targetSize: 1,
+			want:       optimizeMinQuality,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.desc, func(t *testing.T) {
+			_, si, dir, tiles := writeOptimizeTestShot(t)
+			o, err := newOptimizer(si, 0, tc.quality, tc.targetSize, 1, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := o.optimize(ctx); err != nil {
+				t.Fatalf("optimize() failed: %v", err)
+			}
+			got := readTestTiles(t, dir)[testTileNoise]
+			want := original
+			if tc.want != 0 {
+				want = encodeTestJPEG(t, img, tc.want)
+			}
+			if !bytes.Equal(got, want) {
+				t.Errorf("noisy tile has %d bytes, want %d bytes (quality %d)", len(got), len(want), tc.want)
+			}
+			// Flat tiles are pruned too.
+			wantSaved := int64(len(tiles[testTileGray]) + len(tiles[testTileBlue]) + len(original) - len(want))
+			if gotSaved := o.saved.Load(); gotSaved != wantSaved {
+				t.Errorf("saved = %d, want %d", gotSaved, wantSaved)
+			}
+		})
+	}
+}
+
+func TestNewOptimizerErrors(t *testing.T) {
+	root, dir := newTestRoot(t)
+	writeTestShot(t, dir, "save/d-1", 100, shot.StatusComplete)
+	writeTestShot(t, dir, "save/d-2", 100, shot.StatusInProgress)
+	writeTestShotArchive(t, dir, "save/d-3.zip", 100)
+	complete := mustLoadShot(t, root, "save/d-1")
+
+	tests := []struct {
+		desc                                     string
+		si                                       *shotInfo
+		tolerance, quality, targetSize, parallel int
+	}{
+		{desc: "archive", si: mustLoadShot(t, root, "save/d-3.zip"), parallel: 1},
+		{desc: "in progress", si: mustLoadShot(t, root, "save/d-2"), parallel: 1},
+		{desc: "tolerance", si: complete, tolerance: 256, parallel: 1},
+		{desc: "quality", si: complete, quality: 101, parallel: 1},
+		{desc: "low quality with target size", si: complete, quality: optimizeMinQuality - 1, targetSize: 1000, parallel: 1},
+		{desc: "target size", si: complete, targetSize: -1, parallel: 1},
+		{desc: "parallel", si: complete},
+	}
+	for _, tc := range tests {
+		t.Run(tc.desc, func(t *testing.T) {
+			if _, err := newOptimizer(tc.si, tc.tolerance, tc.quality, tc.targetSize, tc.parallel, false); err == nil {
+				t.Errorf("newOptimizer() succeeded, want error")
+			}
+		})
+	}
+	if _, err := newOptimizer(complete, 4, optimizeMinQuality, 1000, 1, false); err != nil {
+		t.Errorf("newOptimizer() failed: %v", err)
+	}
+}
@@ -0,0 +1,434 @@
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/Palats/mapshot/embed"
+	"github.com/Palats/mapshot/shot"
+	"github.com/Palats/mapshot/storage"
+	"github.com/spf13/cobra"
+)
+
+// publisher copies shots from a source storage - typically, the Factorio
+// script-output directory - to a target storage, keeping the same layout.
+type publisher struct {
+	source storage.Storage
+	target storage.Writable
+	// Re-upload shots already present on the target.
+	force bool
+	// Number of files uploaded concurrently.
+	parallel int
+	// Upload archived shots as directories, for targets which cannot serve
+	// archives - e.g., static web hosts.
+	extract bool
+	// Write the tiles pruned by `mapshot optimize`, for targets which cannot
+	// recreate them.
+	restoreTiles bool
+}
+
+// put uploads a single file from the source to the target.
+func (p *publisher) put(ctx context.Context, location string) error {
+	f, err := p.source.Open(location)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if err := p.target.Put(ctx, location, f, info.Size()); err != nil {
+		return fmt.Errorf("unable to upload %s: %w", location, err)
+	}
+	return nil
+}
+
+// publishShot uploads a single shot, either a directory or an archive.
+// mapshot.json is uploaded last: the shot is not visible on the target until
+// all its tiles are there. Shots already on the target are skipped - their
+// content never changes once complete.
+func (p *publisher) publishShot(ctx context.Context, location string) error {
+	var archive *shotArchive
+	var data *shot.Mapshot
+	var err error
+	if archivedShotDir(location) != "" {
+		if archive, err = openShotArchive(p.source, location); err == nil {
+			data, err = archive.loadMapshot()
+		}
+	} else {
+		data, err = shot.LoadFS(p.source, location)
+	}
+	if err != nil {
+		return err
+	}
+	if data.Status != "" && data.Status != shot.StatusComplete {
+		fmt.Printf("%s: skipped, render is not complete (%s)\n", location, data.Status)
+		return nil
+	}
+
+	if !p.force {
+		present := false
+		if archive != nil {
+			_, err := p.target.Stat(location)
+			present = (err == nil && !p.extract) || isShotDir(p.target, archivedShotDir(location))
+		} else {
+			present = isShotDir(p.target, location)
+		}
+		if present {
+			fmt.Printf("%s: already published\n", location)
+			return nil
+		}
+	}
+
+	switch {
+	case archive != nil && p.extract:
+		return p.extractShot(ctx, archive)
+	case archive != nil:
+		if err := p.put(ctx, location); err != nil {
+			return err
+		}
+		fmt.Printf("%s: published\n", location)
+		return nil
+	}
+
+	var files []string
+	err = fs.WalkDir(p.source, location, func(fname string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.IsDir() && fname != path.Join(location, shot.Filename) {
+			files = append(files, fname)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if err := forEachParallel(ctx, p.parallel, files, p.put); err != nil {
+		return err
+	}
+	open := func(name string) (io.ReadCloser, error) {
+		return p.source.Open(path.Join(location, name))
+	}
+	restored, err := p.putUniformTiles(ctx, location, data, open)
+	if err != nil {
+		return err
+	}
+	if err := p.put(ctx, path.Join(location, shot.Filename)); err != nil {
+		return err
+	}
+	fmt.Printf("%s: published, %d files\n", location, len(files)+restored+1)
+	return nil
+}
+
+// extractShot uploads the content of an archived shot as a directory.
+func (p *publisher) extractShot(ctx context.Context, archive *shotArchive) error {
+	dir := archivedShotDir(archive.location)
+	put := func(name string) error {
+		r, closer, err := archive.open(name)
+		if err != nil {
+			return fmt.Errorf("unable to read %s from %s: %w", name, archive.location, err)
+		}
+		defer closer.Close()
+		size, err := r.Seek(0, io.SeekEnd)
+		if err != nil {
+			return err
+		}
+		if _, err := r.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		if err := p.target.Put(ctx, path.Join(dir, name), r, size); err != nil {
+			return fmt.Errorf("unable to upload %s: %w", path.Join(dir, name), err)
+		}
+		return nil
+	}
+	count := 0
+	for name := range archive.entries {
+		if name == shot.Filename {
+			continue
+		}
+		if err := put(name); err != nil {
+			return err
+		}
+		count++
+	}
+	data, err := archive.loadMapshot()
+	if err != nil {
+		return err
+	}
+	open := func(name string) (io.ReadCloser, error) {
+		r, closer, err := archive.open(name)
+		if err != nil {
+			return nil, err
+		}
+		return struct {
+			io.Reader
+			io.Closer
+		}{r, closer}, nil
+	}
+	restored, err := p.putUniformTiles(ctx, dir, data, open)
+	if err != nil {
+		return err
+	}
+	count += restored
+	if err := put(shot.Filename); err != nil {
+		return err
+	}
+	fmt.Printf("%s: published as %s, %d files\n", archive.location, dir, count+1)
+	return nil
+}
+
+// putUniformTiles writes the tiles of the shot pruned by `mapshot optimize`
+// to dir on the target, when requested. open reads a file of the shot, given
+// relative to the shot directory. It returns the number of tiles written.
+func (p *publisher) putUniformTiles(ctx context.Context, dir string, data *shot.Mapshot, open func(string) (io.ReadCloser, error)) (int, error) {
+	if !p.restoreTiles {
+		return 0, nil
+	}
+	tiles, err := loadUniformTiles(open, data)
+	if err != nil {
+		return 0, err
+	}
+	var names []string
+	for name := range tiles {
+		names = append(names, name)
+	}
+	err = forEachParallel(ctx, p.parallel, names, func(ctx context.Context, name string) error {
+		// Pruned tiles often share the same color.
+		content, err := tiles[name].cachedEncode()
+		if err != nil {
+			return err
+		}
+		location := path.Join(dir, name)
+		if err := p.target.Put(ctx, location, bytes.NewReader(content), int64(len(content))); err != nil {
+			return fmt.Errorf("unable to upload %s: %w", location, err)
+		}
+		return nil
+	})
+	return len(names), err
+}
+
+// saveShots lists the shots of a save directory, as directories or archives.
+func saveShots(store storage.Storage, save string) ([]string, error) {
+	entries, err := store.ReadDir(save)
+	if err != nil {
+		return nil, err
+	}
+	var locations []string
+	for _, entry := range entries {
+		location := path.Join(save, entry.Name())
+		if entry.IsDir() {
+			if isShotDir(store, location) {
+				locations = append(locations, location)
+			}
+			continue
+		}
+		// Archives are ignored when their directory exists.
+		if dir := archivedShotDir(location); dir != "" && !isShotDir(store, dir) {
+			locations = append(locations, location)
+		}
+	}
+	return locations, nil
+}
+
+// publishSave uploads the files giving access to the shots of the save on the
+// target, once the shots themselves are there: a shots.json listing all of
+// them, and the viewer - its index.html pointing to the latest complete shot.
+// index.html is uploaded last.
+func (p *publisher) publishSave(ctx context.Context, save string) error {
+	locations, err := saveShots(p.target, save)
+	if err != nil {
+		return err
+	}
+	root := &serveRoot{storage: p.target}
+	var shots []*shotInfo
+	for _, location := range locations {
+		si, err := loadShot(root, location)
+		if err != nil {
+			return err
+		}
+		if si.status == shotComplete {
+			shots = append(shots, si)
+		}
+	}
+	if len(shots) == 0 {
+		fmt.Printf("%s: no complete shot published, no index generated\n", save)
+		return nil
+	}
+	sort.Slice(shots, func(i, j int) bool {
+		if shots[i].json.TicksPlayed != shots[j].json.TicksPlayed {
+			return shots[i].json.TicksPlayed > shots[j].json.TicksPlayed
+		}
+		return shots[i].name < shots[j].name
+	})
+
+	// Paths are relative to the save directory, so the published files can
+	// be served from anywhere.
+	listing := &ShotsJSONSave{Savename: save}
+	for _, si := range shots {
+		listing.Versions = append(listing.Versions, &ShotsJSONInfo{
+			Name:        si.name,
+			EncodedPath: url.PathEscape(path.Base(si.name)) + "/",
+			TicksPlayed: si.json.TicksPlayed,
+		})
+	}
+	shotsJSON, err := json.Marshal(&ShotsJSON{All: []*ShotsJSONSave{listing}})
+	if err != nil {
+		return err
+	}
+	config, err := json.Marshal(&MapshotConfigJSON{EncodedPath: listing.Versions[0].EncodedPath})
+	if err != nil {
+		return err
+	}
+
+	var fnames []string
+	for fname := range embed.ViewerFiles {
+		if fname != "index.html" {
+			fnames = append(fnames, fname)
+		}
+	}
+	sort.Strings(fnames)
+	files := map[string]string{
+		"shots.json": string(shotsJSON),
+		"index.html": strings.ReplaceAll(embed.ViewerFiles["index.html"], "__MAPSHOT_CONFIG_TOKEN__", string(config)),
+	}
+	for _, fname := range append(fnames, "shots.json", "index.html") {
+		content, ok := files[fname]
+		if !ok {
+			content = embed.ViewerFiles[fname]
+		}
+		if err := p.target.Put(ctx, path.Join(save, fname), bytes.NewReader([]byte(content)), int64(len(content))); err != nil {
+			return fmt.Errorf("unable to upload %s: %w", fname, err)
+		}
+	}
+	fmt.Printf("%s: index updated, latest is %s\n", save, shots[0].name)
+	return nil
+}
+
+// publishLocation finds the location in the source storage of what is to be
+// published. It is either relative to the source, or, for a local source, a
+// path on the filesystem.
+func publishLocation(source storage.Storage, arg string) (string, error) {
+	if local, ok := source.(*storage.Local); ok {
+		if abs, err := filepath.Abs(arg); err == nil {
+			if _, err := os.Stat(abs); err == nil {
+				if real, err := filepath.EvalSymlinks(abs); err == nil {
+					abs = real
+				}
+				rel, err := filepath.Rel(local.Dir(), abs)
+				if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+					return "", fmt.Errorf("%s is not within %s", arg, local.Dir())
+				}
+				return filepath.ToSlash(rel), nil
+			}
+		}
+	}
+	location := path.Clean(filepath.ToSlash(arg))
+	if !fs.ValidPath(location) {
+		return "", fmt.Errorf("invalid location %q", arg)
+	}
+	if _, err := source.Stat(location); err != nil {
+		return "", err
+	}
+	return location, nil
+}
+
+var cmdPublish = &cobra.Command{
+	Use:   "publish <shot or save> <target>",
+	Short: "Upload mapshots to a directory or an S3 bucket.",
+	Long: `Upload mapshots to a directory or an S3 bucket.
+
+The first argument is either a single shot (a d-<hash> directory or archive) or
+a save directory, in which case all its shots are published. It is given
+relative to the source - by default, Factorio script-output directory - or as
+a path to it on the filesystem.
+
+The target is either a local or mounted directory, or a location of the form
+s3://<bucket>/<prefix>. It keeps the layout of the source, so it can itself be
+served with 'mapshot serve --root'.
+
+Shots already on the target are skipped. A shot becomes visible once all its
+tiles are uploaded. Once the shots are there, the viewer and a shots.json
+listing the shots are uploaded in the save directory.
+`,
+	Args: cobra.ExactArgs(2),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		ctx := cmd.Context()
+		sourceLocation := flagPublishSource
+		if sourceLocation == "" {
+			var err error
+			if sourceLocation, err = factorioSettings.ScriptOutput(); err != nil {
+				return err
+			}
+		}
+		source, err := storage.New(ctx, sourceLocation, s3Settings)
+		if err != nil {
+			return err
+		}
+		if !strings.HasPrefix(args[1], "s3://") {
+			if err := os.MkdirAll(args[1], 0755); err != nil {
+				return err
+			}
+		}
+		target, err := storage.New(ctx, args[1], s3Settings)
+		if err != nil {
+			return err
+		}
+		if flagPublishParallel < 1 {
+			return fmt.Errorf("--parallel must be at least 1")
+		}
+		p := &publisher{
+			source:   source,
+			target:   target,
+			force:    flagPublishForce,
+			parallel: flagPublishParallel,
+		}
+
+		location, err := publishLocation(source, args[0])
+		if err != nil {
+			return err
+		}
+		var locations []string
+		save := location
+		if isShotDir(source, location) || archivedShotDir(location) != "" {
+			locations = []string{location}
+			save = path.Dir(location)
+		} else if locations, err = saveShots(source, location); err != nil {
+			return err
+		}
+		if len(locations) == 0 {
+			return fmt.Errorf("no mapshot found in %s", location)
+		}
+		fmt.Printf("Publishing from %s to %s\n", source, target)
+		for _, l := range locations {
+			if err := p.publishShot(ctx, l); err != nil {
+				return err
+			}
+		}
+		return p.publishSave(ctx, save)
+	},
+}
+
+var (
+	flagPublishSource   string
+	flagPublishForce    bool
+	flagPublishParallel int
+)
+
+func init() {
+	cmdPublish.PersistentFlags().StringVar(&flagPublishSource, "source", "", "Where to read mapshots from; a directory or s3://<bucket>/<prefix>. Defaults to Factorio script-output directory.")
+	cmdPublish.PersistentFlags().BoolVar(&flagPublishForce, "force", false, "Upload shots even if already present on the target.")
+	cmdPublish.PersistentFlags().IntVar(&flagPublishParallel, "parallel", 8, "Number of files to upload concurrently.")
+	cmdRoot.AddCommand(cmdPublish)
+}
@@ -0,0 +1,320 @@
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"image/draw"
+	"image/jpeg"
+	"io/fs"
+	"log/slog"
+	"path"
+	"runtime"
+	"strconv"
+	"sync"
+	"sync/atomic"
+
+	"github.com/Palats/mapshot/shot"
+	"github.com/Palats/mapshot/storage"
+	"github.com/spf13/cobra"
+)
+
+// defaultJPGQuality is the default of the `jpgquality` setting of the mod.
+const defaultJPGQuality = 75
+
+// pyramidBuilder generates the less detailed zoom levels of a shot from its
+// most detailed one: each tile is the downscaled version of the 4 tiles it
+// covers at the next level. This is much faster than having Factorio render
+// every level.
+type pyramidBuilder struct {
+	si    *shotInfo
+	store storage.Writable
+	// JPEG quality of generated tiles.
+	quality int
+	// Number of tiles generated concurrently.
+	parallel int
+	// Replace tiles which already exist.
+	force bool
+
+	written, kept atomic.Int64
+}
+
+func newPyramidBuilder(si *shotInfo, quality int, parallel int, force bool) (*pyramidBuilder, error) {
+	if archivedShotDir(si.location) != "" {
+		return nil, fmt.Errorf("%s is archived; extract it first", si.location)
+	}
+	store, ok := si.store.(storage.Writable)
+	if !ok {
+		return nil, fmt.Errorf("storage %s is read-only", si.store)
+	}
+	if quality < 1 || quality > 100 {
+		return nil, fmt.Errorf("invalid JPEG quality %d", quality)
+	}
+	if parallel < 1 {
+		return nil, fmt.Errorf("invalid parallelism %d", parallel)
+	}
+	return &pyramidBuilder{
+		si:       si,
+		store:    store,
+		quality:  quality,
+		parallel: parallel,
+		force:    force,
+	}, nil
+}
+
+// build generates the levels of all the surfaces.
+func (b *pyramidBuilder) build(ctx context.Context) error {
+	for _, surface := range b.si.json.Surfaces {
+		// Each level is built from the previous one, so they are done in
+		// order.
+		for zoom := surface.ZoomMax - 1; zoom >= surface.ZoomMin; zoom-- {
+			if err := b.buildLevel(ctx, surface, zoom); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// buildLevel generates the tiles of a zoom level from the next one, a few
+// tiles concurrently. It stops at the first error.
+func (b *pyramidBuilder) buildLevel(ctx context.Context, surface *shot.Surface, zoom int) error {
+	var tiles []image.Point
+	minX, minY, maxX, maxY := surface.TileRange(zoom)
+	for y := minY; y <= maxY; y++ {
+		for x := minX; x <= maxX; x++ {
+			tiles = append(tiles, image.Pt(x, y))
+		}
+	}
+	return forEachParallel(ctx, b.parallel, tiles, func(ctx context.Context, tile image.Point) error {
+		return b.buildTile(ctx, surface, zoom, tile.X, tile.Y)
+	})
+}
+
+// forEachParallel calls fn on the items, with the given number of calls
+// running concurrently. It stops at the first error.
+func forEachParallel[T any](ctx context.Context, parallel int, items []T, fn func(context.Context, T) error) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	todo := make(chan T)
+	var wg sync.WaitGroup
+	var m sync.Mutex
+	var firstErr error
+	for i := 0; i < parallel; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for item := range todo {
+				if err := fn(ctx, item); err != nil {
+					m.Lock()
+					if firstErr == nil {
+						firstErr = err
+						cancel()
+					}
+					m.Unlock()
+				}
+			}
+		}()
+	}
+loop:
+	for _, item := range items {
+		select {
+		case todo <- item:
+		case <-ctx.Done():
+			break loop
+		}
+	}
+	close(todo)
+	wg.Wait()
+	if firstErr != nil {
+		return firstErr
+	}
+	return ctx.Err()
+}
+
+// buildTile generates a single tile. As with the mod, no tile is written for
+// areas without anything to show - i.e., when none of the 4 tiles it covers
+// exist. The parts of missing tiles are black.
+func (b *pyramidBuilder) buildTile(ctx context.Context, surface *shot.Surface, zoom, x, y int) error {
+	name := surface.TilePath(zoom, x, y)
+	location := path.Join(b.si.location, name)
+	if !b.force {
+		_, err := b.store.Stat(location)
+		// Tiles pruned by `mapshot optimize` are still there.
+		if _, pruned := b.si.uniformTile(name); err == nil || pruned {
+			b.kept.Add(1)
+			return nil
+		}
+	}
+
+	size := surface.RenderSize
+	full := image.NewRGBA(image.Rect(0, 0, 2*size, 2*size))
+	found := false
+	for i := 0; i < 4; i++ {
+		dx, dy := i%2, i/2
+		child, err := readTile(b.si, surface, zoom+1, 2*x+dx, 2*y+dy)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		cb := child.Bounds()
+		if cb.Dx() != size || cb.Dy() != size {
+			return fmt.Errorf("%s: tile is %dx%d pixels, expected %dx%d", surface.TilePath(zoom+1, 2*x+dx, 2*y+dy), cb.Dx(), cb.Dy(), size, size)
+		}
+		draw.Draw(full, image.Rect(dx*size, dy*size, (dx+1)*size, (dy+1)*size), child, cb.Min, draw.Src)
+		found = true
+	}
+	if !found {
+		return nil
+	}
+
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, halve(full), &jpeg.Options{Quality: b.quality}); err != nil {
+		return err
+	}
+	if err := b.store.Put(ctx, location, bytes.NewReader(buf.Bytes()), int64(buf.Len())); err != nil {
+		return fmt.Errorf("unable to write %s: %w", location, err)
+	}
+	b.written.Add(1)
+	return nil
+}
+
+// halve downscales the image by 2 in each dimension, averaging each block of
+// 2x2 pixels. The image must have even dimensions.
+func halve(src *image.RGBA) *image.RGBA {
+	sb := src.Bounds()
+	dst := image.NewRGBA(image.Rect(0, 0, sb.Dx()/2, sb.Dy()/2))
+	for y := 0; y < dst.Rect.Dy(); y++ {
+		row0 := src.Pix[src.PixOffset(sb.Min.X, sb.Min.Y+2*y):]
+		row1 := src.Pix[src.PixOffset(sb.Min.X, sb.Min.Y+2*y+1):]
+		out := dst.Pix[dst.PixOffset(0, y):]
+		for x := 0; x < dst.Rect.Dx(); x++ {
+			for c := 0; c < 4; c++ {
+				sum := int(row0[8*x+c]) + int(row0[8*x+4+c]) + int(row1[8*x+c]) + int(row1[8*x+4+c])
+				out[4*x+c] = uint8((sum + 2) / 4)
+			}
+		}
+	}
+	return dst
+}
+
+// finishRender builds the zoom levels which Factorio did not render, for a
+// shot created with the `singlelayer` setting of the mod, writes its tiles
+// manifest and marks it as complete - the mod leaves that to the CLI in that
+// mode. That way, the manifest is there as soon as the shot is served as
+// complete.
+func finishRender(ctx context.Context, scriptOutput string, location string) error {
+	store, err := storage.NewLocal(scriptOutput)
+	if err != nil {
+		return err
+	}
+	si, err := loadShot(&serveRoot{location: scriptOutput, storage: store}, location)
+	if err != nil {
+		return err
+	}
+	b, err := newPyramidBuilder(si, shotJPGQuality(si), runtime.NumCPU(), false)
+	if err != nil {
+		return err
+	}
+	fmt.Println("Building less detailed zoom levels...")
+	if err := b.build(ctx); err != nil {
+		return err
+	}
+	slog.Info("pyramid built", "location", location, "tiles", b.written.Load())
+	count, err := writeTilesManifest(ctx, si)
+	if err != nil {
+		return fmt.Errorf("unable to write tiles manifest: %w", err)
+	}
+	slog.Info("tiles manifest written", "location", location, "tiles", count)
+	return markComplete(ctx, store, location)
+}
+
+// shotJPGQuality returns the JPEG quality the tiles of the shot were rendered
+// with, as recorded by the mod, or defaultJPGQuality for older mapshots.
+func shotJPGQuality(si *shotInfo) int {
+	if si.json.JPGQuality > 0 {
+		return si.json.JPGQuality
+	}
+	return defaultJPGQuality
+}
+
+// markComplete sets the status of the shot to complete, keeping the rest of
+// mapshot.json as is.
+func markComplete(ctx context.Context, store storage.Writable, location string) error {
+	filename := path.Join(location, shot.Filename)
+	raw, err := fs.ReadFile(store, filename)
+	if err != nil {
+		return err
+	}
+	var data map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &data); err != nil {
+		return fmt.Errorf("invalid %s: %w", filename, err)
+	}
+	data["status"] = json.RawMessage(strconv.Quote(shot.StatusComplete))
+	if raw, err = json.Marshal(data); err != nil {
+		return err
+	}
+	return store.Put(ctx, filename, bytes.NewReader(raw), int64(len(raw)))
+}
+
+var cmdPyramid = &cobra.Command{
+	Use:   "pyramid <shot>",
+	Short: "Build the less detailed zoom levels of a mapshot from its most detailed one.",
+	Long: `Build the less detailed zoom levels of a mapshot from its most detailed one.
+
+Each tile is built by downscaling the 4 tiles it covers at the next zoom level,
+starting from the most detailed level. This is what 'mapshot render --pyramid'
+does after Factorio has rendered the most detailed level only.
+
+Tiles which already exist are kept, unless --force is given. Areas where the
+mod skipped tiles - see 'minjpgquality' - are black on the generated levels,
+instead of showing the terrain.
+
+The shot is the mapshot directory (the one of the form d-<hash>). With --source,
+it is relative to that location instead, which can be an S3 bucket.
+`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		si, err := openShot(cmd.Context(), flagPyramidSource, args[0])
+		if err != nil {
+			return err
+		}
+		quality := flagPyramidQuality
+		if quality == 0 {
+			quality = shotJPGQuality(si)
+		}
+		b, err := newPyramidBuilder(si, quality, flagPyramidParallel, flagPyramidForce)
+		if err != nil {
+			return err
+		}
+		if err := b.build(cmd.Context()); err != nil {
+			return err
+		}
+		if err := updateTilesManifest(cmd.Context(), si); err != nil {
+			return err
+		}
+		fmt.Printf("%s: %d tiles written, %d already present\n", args[0], b.written.Load(), b.kept.Load())
+		return nil
+	},
+}
+
+var (
+	flagPyramidSource   string
+	flagPyramidQuality  int
+	flagPyramidParallel int
+	flagPyramidForce    bool
+)
+
+func init() {
+	cmdPyramid.PersistentFlags().StringVar(&flagPyramidSource, "source", "", "Where to find the mapshot; a directory or s3://<bucket>/<prefix>. If empty, the mapshot is a local path.")
+	cmdPyramid.PersistentFlags().IntVar(&flagPyramidQuality, "quality", 0, "JPEG quality of the generated tiles, from 1 to 100. If 0, use the quality the mapshot was rendered with.")
+	cmdPyramid.PersistentFlags().IntVar(&flagPyramidParallel, "parallel", runtime.NumCPU(), "Number of tiles to build concurrently.")
+	cmdPyramid.PersistentFlags().BoolVar(&flagPyramidForce, "force", false, "Rebuild tiles which already exist.")
+	cmdRoot.AddCommand(cmdPyramid)
+}
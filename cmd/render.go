@@ -5,14 +5,16 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io/fs"
 	"io/ioutil"
+	"log/slog"
 	"os"
 	"path/filepath"
+	"strings"
 	"time"
 
 	"github.com/Palats/mapshot/embed"
 	"github.com/Palats/mapshot/factorio"
-	"github.com/golang/glog"
 	"github.com/google/uuid"
 	"github.com/otiai10/copy"
 	"github.com/spf13/cobra"
@@ -29,6 +31,7 @@ type RenderFlags struct {
 	jpgquality    int64
 	minjpgquality int64
 	surface       string
+	pyramid       bool
 }
 
 // Register creates flags for the rendering parameters.
@@ -41,6 +44,7 @@ func (rf *RenderFlags) Register(flags *pflag.FlagSet, prefix string) *RenderFlag
 	flags.Int64Var(&rf.jpgquality, prefix+"jpgquality", 0, "Compression quality for jpg files. If 0, use value from the game.")
 	flags.Int64Var(&rf.minjpgquality, prefix+"minjpgquality", -1, "Compression quality for jpg files when no player entities are present. Set to 0 to skip the tile entirely.")
 	flags.StringVar(&rf.surface, prefix+"surface", "", "Game surface to render. If empty, use value from the game. Use _all_ for render all surfaces (default behavior).")
+	flags.BoolVar(&rf.pyramid, prefix+"pyramid", false, "Have Factorio render only the most detailed zoom level, and build the less detailed ones from it, which is much faster. Areas skipped with minjpgquality=0 are then black on less detailed levels.")
 	return rf
 }
 
@@ -70,6 +74,9 @@ func (rf *RenderFlags) genOverrides() map[string]interface{} {
 	if rf.surface != "" {
 		ov["surface"] = rf.surface
 	}
+	if rf.pyramid {
+		ov["singlelayer"] = true
+	}
 	return ov
 }
 
@@ -96,23 +103,30 @@ func writeOverrides(data map[string]interface{}, dstPath string) error {
 	if err := ioutil.WriteFile(overridesFilename, []byte(overrides), 0644); err != nil {
 		return fmt.Errorf("unable to write overrides file %q: %w", overridesFilename, err)
 	}
-	glog.Infof("overrides file created at %q", overridesFilename)
+	slog.Info("overrides file created", "path", overridesFilename)
 	return nil
 }
 
-func render(ctx context.Context, factorioSettings *factorio.Settings, rf *RenderFlags, rawname string) error {
+// renderSavename extracts the name of the save from the render parameter,
+// which can be a filename.
+func renderSavename(rawname string) string {
+	name := filepath.Base(rawname)
+	return name[:len(name)-len(filepath.Ext(name))]
+}
+
+func render(ctx context.Context, factorioSettings *factorio.Settings, rf *RenderFlags, rawname string, metrics *renderMetrics) error {
+	// A process renders a single save, so all logs - including those of the
+	// factorio package - can carry the run ID.
+	runID := uuid.New().String()
+	name := renderSavename(rawname)
+	slog.SetDefault(slog.Default().With("run_id", runID, "savename", name))
+	slog.Info("render starting")
+
 	fact, err := factorio.New(factorioSettings)
 	if err != nil {
 		return err
 	}
 
-	runID := uuid.New().String()
-	glog.Infof("runid: %s", runID)
-
-	// The parameter can be a filename, so extract a name.
-	name := filepath.Base(rawname)
-	name = name[:len(name)-len(filepath.Ext(name))]
-
 	tmpdir, cleanup := getWorkDir()
 	defer cleanup()
 
@@ -127,7 +141,7 @@ func render(ctx context.Context, factorioSettings *factorio.Settings, rf *Render
 	if err := copy.Copy(srcSavegame, dstSavegame); err != nil {
 		return fmt.Errorf("unable to copy file %q: %w", srcSavegame, err)
 	}
-	glog.Infof("copied save from %q to %q", srcSavegame, dstSavegame)
+	slog.Info("copied save", "src", srcSavegame, "dst", dstSavegame)
 
 	// Copy mods
 	dstMods := filepath.Join(tmpdir, "mods")
@@ -143,7 +157,7 @@ func render(ctx context.Context, factorioSettings *factorio.Settings, rf *Render
 	if err := factorio.EnableMod(dstMods, "mapshot"); err != nil {
 		return err
 	}
-	glog.Infof("mod created at %q", dstMapshot)
+	slog.Info("mod created", "path", dstMapshot)
 
 	// Generates overrides to the parameters. This is done by creating a Lua
 	// file, as mods don't have any way of loading data.
@@ -157,7 +171,13 @@ func render(ctx context.Context, factorioSettings *factorio.Settings, rf *Render
 	// Remove done marker if still present
 	doneFile := filepath.Join(fact.ScriptOutput(), "mapshot-done-"+runID)
 	err = os.Remove(doneFile)
-	glog.Infof("removed done-file %q: %v", doneFile, err)
+	slog.Info("removed done-file", "path", doneFile, "err", err)
+	// The mod also indicates when it starts rendering, to measure Factorio
+	// startup time.
+	startedFile := filepath.Join(fact.ScriptOutput(), "mapshot-started-"+runID)
+	os.Remove(startedFile)
+	defer os.Remove(startedFile)
+	started := false
 
 	factorioArgs := []string{
 		"--disable-audio",
@@ -184,6 +204,13 @@ func render(ctx context.Context, factorioSettings *factorio.Settings, rf *Render
 			cancel()
 			break
 		}
+		if !started {
+			if _, err := os.Stat(startedFile); err == nil {
+				slog.Info("rendering started")
+				metrics.started()
+				started = true
+			}
+		}
 
 		// Context cancellation should terminate Factorio, which is detected
 		// through errCh, so no need to wait on context.
@@ -196,40 +223,82 @@ func render(ctx context.Context, factorioSettings *factorio.Settings, rf *Render
 			return fmt.Errorf("factorio exited early: %w", err)
 		}
 	}
-	glog.Infof("done file %q now exists", doneFile)
+	slog.Info("done-file now exists", "path", doneFile)
 	rawDone, err := ioutil.ReadFile(doneFile)
 	if err != nil {
 		return fmt.Errorf("unable to read file %q: %w", doneFile, err)
 	}
 	resultPrefix := string(rawDone)
-	glog.Infof("output at %s", resultPrefix)
+	slog.Info("render written", "output", resultPrefix)
 	fmt.Println("Output:", filepath.Join(fact.ScriptOutput(), resultPrefix))
+	if !started {
+		// Rendering was faster than polling.
+		metrics.started()
+	}
+	location := strings.TrimSuffix(resultPrefix, "/")
+	if rf.pyramid {
+		// Also writes the tiles manifest, before marking the shot complete.
+		if err := finishRender(ctx, fact.ScriptOutput(), location); err != nil {
+			return fmt.Errorf("unable to build zoom levels: %w", err)
+		}
+	} else if err := finishTiles(ctx, fact.ScriptOutput(), location); err != nil {
+		return fmt.Errorf("unable to write tiles manifest: %w", err)
+	}
+	metrics.done(countTiles(filepath.Join(fact.ScriptOutput(), resultPrefix)))
 
 	// Cleaning up done file now that we've read it.
 	err = os.Remove(doneFile)
-	glog.Infof("removed done-file %q: %v", doneFile, err)
+	slog.Info("removed done-file", "path", doneFile, "err", err)
 
 	// Wait for Factorio to terminate.
 	err = <-errCh
 	if err != nil {
-		glog.Warningf("Factorio finished with an error; ignoring as rendering was done. Error: %v", err)
+		slog.Warn("factorio finished with an error; ignoring as rendering was done", "err", err)
 	}
 
 	return nil
 }
 
+// countTiles returns the number of tiles of a render.
+func countTiles(dir string) int {
+	count := 0
+	filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err == nil && !d.IsDir() && filepath.Ext(p) == ".jpg" {
+			count++
+		}
+		return nil
+	})
+	return count
+}
+
 var cmdRender = &cobra.Command{
 	Use:   "render",
 	Short: "Create a screenshot from a save.",
 	Args:  cobra.ExactArgs(1),
 	RunE: func(cmd *cobra.Command, args []string) error {
-		return render(cmd.Context(), factorioSettings, renderFlags, args[0])
+		metrics := newRenderMetrics(renderSavename(args[0]))
+		err := render(cmd.Context(), factorioSettings, renderFlags, args[0], metrics)
+		if err != nil {
+			slog.Error("render failed", "err", err)
+		} else {
+			slog.Info("render finished")
+		}
+		if merr := metrics.export(err); merr != nil {
+			slog.Error("unable to export metrics", "err", merr)
+		}
+		return err
 	},
 }
 
-var renderFlags = &RenderFlags{}
+var (
+	renderFlags           = &RenderFlags{}
+	flagRenderPushgateway string
+	flagRenderMetricsFile string
+)
 
 func init() {
 	renderFlags.Register(cmdRender.PersistentFlags(), "")
+	cmdRender.PersistentFlags().StringVar(&flagRenderPushgateway, "metrics_pushgateway", "", "URL of a Prometheus Pushgateway to push metrics about the render to, e.g., http://localhost:9091.")
+	cmdRender.PersistentFlags().StringVar(&flagRenderMetricsFile, "metrics_file", "", "File to write metrics about the render to, in Prometheus text format - e.g., for the textfile collector of the node exporter. It is replaced on each render.")
 	cmdRoot.AddCommand(cmdRender)
 }
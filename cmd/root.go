@@ -3,10 +3,12 @@ package cmd
 import (
 	"context"
 	"io/ioutil"
+	"log/slog"
 	"os"
+	"path/filepath"
 
 	"github.com/Palats/mapshot/factorio"
-	"github.com/golang/glog"
+	"github.com/Palats/mapshot/storage"
 	"github.com/spf13/cobra"
 )
 
@@ -15,26 +17,30 @@ var cmdRoot = &cobra.Command{
 	Short: "mapshot generates zoomable screenshot for Factorio",
 	// Do not show help if not requested - e.g., when an error is generated.
 	SilenceUsage: true,
+	PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+		return logFlags.setup()
+	},
 }
 
 func getWorkDir() (string, func()) {
 	if workDir != "" {
-		glog.Infof("using work dir %s", workDir)
+		slog.Info("using work dir", "dir", workDir)
 		return workDir, func() {}
 	}
 
 	tmpdir, err := ioutil.TempDir("", "mapshot")
 	if err != nil {
-		glog.Fatalf("unable to create temp dir: %v", err)
+		slog.Error("unable to create temp dir", "err", err)
+		os.Exit(1)
 	}
-	glog.Info("temp dir: ", tmpdir)
+	slog.Info("temp dir created", "dir", tmpdir)
 
 	cleanup := func() {
 		// Remove temporary directory.
 		if err := os.RemoveAll(tmpdir); err != nil {
-			glog.Errorf("unable to remove temp dir %q: %v", tmpdir, err)
+			slog.Error("unable to remove temp dir", "dir", tmpdir, "err", err)
 		} else {
-			glog.Infof("temp dir %q removed", tmpdir)
+			slog.Info("temp dir removed", "dir", tmpdir)
 		}
 	}
 	return tmpdir, cleanup
@@ -42,12 +48,22 @@ func getWorkDir() (string, func()) {
 
 var (
 	factorioSettings = &factorio.Settings{}
+	s3Settings       = &storage.S3Settings{}
+	logFlags         = &LogFlags{}
 	workDir          string
+	flagArchiveCache string
 )
 
 func init() {
 	factorioSettings.Register(cmdRoot.PersistentFlags(), "factorio_")
+	s3Settings.Register(cmdRoot.PersistentFlags(), "s3_")
+	logFlags.Register(cmdRoot.PersistentFlags(), "log_")
 	cmdRoot.PersistentFlags().StringVar(&workDir, "work_dir", "", "If specified, uses this as working directory. Otherwise, creates a temporary one and delete it on exit.")
+	archiveCache := ""
+	if dir, err := os.UserCacheDir(); err == nil {
+		archiveCache = filepath.Join(dir, "mapshot", "archives")
+	}
+	cmdRoot.PersistentFlags().StringVar(&flagArchiveCache, "archive_cache", archiveCache, "Directory where archived mapshots stored as gzipped tar are decompressed once, to be read without decompressing them on each access. It can be cleared at any time.")
 }
 
 // Execute run the full command tree.
@@ -1,39 +1,113 @@
 package cmd
 
 import (
-	"bytes"
 	"context"
-	"encoding/json"
 	"fmt"
-	"io/ioutil"
+	"io"
+	"io/fs"
+	"log/slog"
 	"math/rand"
+	"mime"
 	"net/http"
 	"net/url"
 	"os"
+	"os/signal"
+	"path"
 	"path/filepath"
-	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/Palats/mapshot/embed"
-	"github.com/golang/glog"
+	"github.com/Palats/mapshot/shot"
+	"github.com/Palats/mapshot/storage"
 	"github.com/spf13/cobra"
 )
 
 // shotInfo gives internal information about a single mapshot.
 type shotInfo struct {
+	// Name of the root the shot comes from; empty when serving a single
+	// unnamed root.
+	root string
+	// Path of the shot, prefixed by the root name. Always uses slashes.
 	name string
+	// Unique ID of the render, as generated by the mod.
+	id string
 	// HTTP encodedPath were the tiles & data is served.
 	encodedPath string
 	// Path the mux should use to server the HTTP path
 	muxPath string
-	// Name of the save. Always uses slashes.
+	// Name of the save, prefixed by the root name. Always uses slashes.
 	savename string
-	json     *MapshotJSON
-	// Filesystem path of this mapshot.
-	fsPath string
+	// Summary of mapshot.json.
+	json *shot.Mapshot
+	// Storage of the root the shot comes from.
+	store storage.Storage
+	// Location of the shot in the storage: a directory, or an archive. Always
+	// uses slashes.
+	location string
+	// Whether the render is finished.
+	status shotStatus
+	// Serves the content of the shot directory.
+	handler http.Handler
+
+	// Tiles pruned by `mapshot optimize`, keyed by location relative to the
+	// shot directory. Loaded on first use.
+	uniformOnce  sync.Once
+	uniformTiles map[string]uniformTile
+	// Manifest of the tiles which exist; nil if the shot has none. Loaded on
+	// first use.
+	tilesOnce sync.Once
+	tiles     *shot.Tiles
 }
 
+// key identifies the shot in the index: its location, prefixed by the name of
+// its root.
+func (si *shotInfo) key() string {
+	return path.Join(si.root, si.location)
+}
+
+// loadMapshot reads the full mapshot.json of the shot; only a summary is kept
+// in memory.
+func (si *shotInfo) loadMapshot() (*shot.Mapshot, error) {
+	if archive, ok := si.handler.(*shotArchive); ok {
+		return archive.loadMapshot()
+	}
+	return shot.LoadFS(si.store, si.location)
+}
+
+// open reads a file of the shot, given relative to the shot directory.
+func (si *shotInfo) open(name string) (io.ReadCloser, error) {
+	if archive, ok := si.handler.(*shotArchive); ok {
+		r, closer, err := archive.open(name)
+		if err != nil {
+			return nil, err
+		}
+		return struct {
+			io.Reader
+			io.Closer
+		}{r, closer}, nil
+	}
+	return si.store.Open(path.Join(si.location, name))
+}
+
+// shotStatus indicates whether a mapshot render is finished.
+type shotStatus string
+
+const (
+	// shotComplete is a mapshot with all its tiles written. Mapshots created by
+	// older versions of the mod are always considered complete, as they do not
+	// carry any status.
+	shotComplete shotStatus = "complete"
+	// shotInProgress is a mapshot still being rendered.
+	shotInProgress shotStatus = "in-progress"
+	// shotAbandoned is a mapshot which has not been completed and has not seen
+	// any activity for a while - e.g., Factorio crashed during rendering.
+	shotAbandoned shotStatus = "abandoned"
+)
+
 // ShotsJSON is the data sent to the UI to build the listing.
 type ShotsJSON struct {
 	All []*ShotsJSONSave `json:"all"`
@@ -41,6 +115,8 @@ type ShotsJSON struct {
 
 // ShotsJSONSave is part of ShotsJSON.
 type ShotsJSONSave struct {
+	// Root the save comes from; empty when serving a single unnamed root.
+	Root     string           `json:"root,omitempty"`
 	Savename string           `json:"savename"`
 	Versions []*ShotsJSONInfo `json:"versions"`
 }
@@ -50,12 +126,21 @@ type ShotsJSONInfo struct {
 	Name        string `json:"name,omitempty"`
 	EncodedPath string `json:"encoded_path,omitempty"`
 	TicksPlayed int64  `json:"ticks_played,omitempty"`
+	// Only set for mapshots which are not complete.
+	Status string `json:"status,omitempty"`
+	// URL of a preview of the first surface, when thumbnails are enabled.
+	ThumbnailURL string `json:"thumbnail_url,omitempty"`
 }
 
-// MapshotJSON is a partial representation of the content of mapshot.json.
-type MapshotJSON struct {
-	// Many field omitted that are not used from go.
-	TicksPlayed int64 `json:"ticks_played,omitempty"`
+// withPrefix returns a copy of the info, with the encoded path under the given
+// URL prefix.
+func (info *ShotsJSONInfo) withPrefix(prefix string) *ShotsJSONInfo {
+	prefixed := *info
+	prefixed.EncodedPath = prefix + info.EncodedPath
+	if info.ThumbnailURL != "" {
+		prefixed.ThumbnailURL = prefix + info.ThumbnailURL
+	}
+	return &prefixed
 }
 
 // MapshotConfigJSON is a representation of the viewer configuration.
@@ -63,205 +148,417 @@ type MapshotConfigJSON struct {
 	EncodedPath string `json:"encoded_path"`
 }
 
-// splitPath split a path string into its individual components.
-func splitPath(s string) []string {
-	dir, file := filepath.Split(filepath.Clean(s))
-	if dir == "" {
-		return []string{file}
-	}
-	return append(splitPath(filepath.Clean(dir)), file)
+// isShotDir indicates whether the directory contains a mapshot.
+func isShotDir(store storage.Storage, dir string) bool {
+	_, err := store.Stat(path.Join(dir, shot.Filename))
+	return err == nil
 }
 
-func findShots(baseDir string) ([]shotInfo, error) {
-	realDir, err := filepath.EvalSymlinks(baseDir)
+// lastActivity returns the most recent modification time of the mapshot
+// directory, its mapshot.json and its immediate subdirectories. New tiles
+// update the modification time of their layer directory, so that gives a cheap
+// approximation of when the render was last making progress.
+func lastActivity(store storage.Storage, location string) time.Time {
+	var last time.Time
+	update := func(info fs.FileInfo) {
+		if info.ModTime().After(last) {
+			last = info.ModTime()
+		}
+	}
+	if info, err := store.Stat(location); err == nil {
+		update(info)
+	}
+	if info, err := store.Stat(path.Join(location, shot.Filename)); err == nil {
+		update(info)
+	}
+	entries, err := store.ReadDir(location)
 	if err != nil {
-		return nil, fmt.Errorf("unable to eval symlinks for %s: %w", baseDir, err)
+		return last
+	}
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		if info, err := entry.Info(); err == nil {
+			update(info)
+		}
+	}
+	return last
+}
+
+// classifyShot determines the status of the mapshot stored at location.
+func classifyShot(store storage.Storage, location string, data *shot.Mapshot) shotStatus {
+	switch data.Status {
+	case "", shot.StatusComplete:
+		return shotComplete
+	}
+	if time.Since(lastActivity(store, location)) > flagServeAbandonAfter {
+		return shotAbandoned
 	}
-	glog.Infof("Looking for shots in %s", realDir)
-	var shots []shotInfo
-	err = filepath.Walk(realDir, func(path string, info os.FileInfo, err error) error {
+	return shotInProgress
+}
+
+// loadShot reads the information about the mapshot stored at location - a
+// directory or an archive - in the storage of the root.
+func loadShot(root *serveRoot, location string) (*shotInfo, error) {
+	// Location of the shot as if it was a directory; archived shots are
+	// served as if they had been extracted.
+	dirLocation := location
+	var mapshotData *shot.Mapshot
+	var handler http.Handler
+	if d := archivedShotDir(location); d != "" {
+		archive, err := openShotArchive(root.storage, location)
 		if err != nil {
-			return err
+			return nil, err
 		}
-		if filepath.Base(path) != "mapshot.json" {
-			return nil
+		if mapshotData, err = archive.loadMapshot(); err != nil {
+			return nil, err
 		}
-		glog.Infof("found mapshot.json: %s", path)
-		raw, err := ioutil.ReadFile(path)
+		dirLocation = d
+		handler = archive
+	} else {
+		var err error
+		if mapshotData, err = shot.LoadFS(root.storage, location); err != nil {
+			return nil, err
+		}
+		sub, err := fs.Sub(root.storage, location)
 		if err != nil {
-			glog.Errorf("file %s is not readable", path)
-			return nil
+			return nil, err
 		}
+		handler = http.FileServer(http.FS(sub))
+	}
+	name := path.Join(root.name, dirLocation)
+
+	// Generate access path as seen from the client and suitable for the Go mux.
+	// This is manipulating proper paths - so slashes must be kept as such.
+	// However, path components (in between slashes) must be encoded when the client does a request.
+	// But it Golang mux expect the fully encoded path - and takes care of the decoding of the
+	// request itself.
+	muxPath := "/data/"
+	encodedPath := "/data/"
+	for _, sp := range strings.Split(name, "/") {
+		encodedPath += url.PathEscape(sp) + "/"
+		muxPath += sp + "/"
+	}
 
-		mapshotData := &MapshotJSON{}
-		if err := json.Unmarshal(raw, mapshotData); err != nil {
-			glog.Errorf("file %s does not have valid JSON", path)
-			return nil
-		}
+	// Very old mapshots might not have a unique ID, but their directory name
+	// is derived from it.
+	id := mapshotData.UniqueID
+	if id == "" {
+		id = strings.TrimPrefix(path.Base(dirLocation), "d-")
+	}
+
+	return &shotInfo{
+		root:        root.name,
+		store:       root.storage,
+		location:    location,
+		name:        name,
+		id:          id,
+		savename:    path.Dir(name),
+		json:        mapshotData.Summary(),
+		status:      classifyShot(root.storage, location, mapshotData),
+		encodedPath: encodedPath,
+		muxPath:     muxPath,
+		handler:     handler,
+	}, nil
+}
 
-		shotPath := filepath.Dir(path)
-		relpath, err := filepath.Rel(realDir, shotPath)
+// findShots does a full scan of the root to find all mapshots. It does not
+// look into the content of mapshots themselves, as tiles are not relevant.
+// Mapshots which cannot be loaded are skipped; their number is returned.
+func findShots(root *serveRoot) ([]*shotInfo, int, error) {
+	slog.Info("looking for shots", "storage", root.storage.String())
+	var shots []*shotInfo
+	failed := 0
+	err := fs.WalkDir(root.storage, ".", func(p string, d fs.DirEntry, err error) error {
 		if err != nil {
-			glog.Infof("unable to get relative path of %q: %v", shotPath, err)
+			return err
+		}
+		if !d.IsDir() {
+			// Archived shots are ignored while their directory still exists,
+			// e.g., while being archived.
+			if dir := archivedShotDir(p); dir == "" || isShotDir(root.storage, dir) {
+				return nil
+			}
+			slog.Info("found archived mapshot", "root", root.name, "location", p)
+			shot, err := loadShot(root, p)
+			if err != nil {
+				slog.Error("unable to load mapshot", "root", root.name, "location", p, "err", err)
+				failed++
+				return nil
+			}
+			shots = append(shots, shot)
 			return nil
 		}
-		savename := filepath.ToSlash(filepath.Dir(relpath))
-
-		// Generate access path as seen from the client and suitable for the Go mux.
-		// This is manipulating proper paths - so slashes must be kept as such.
-		// However, path components (in between slashes) must be encoded when the client does a request.
-		// But it Golang mux expect the fully encoded path - and takes care of the decoding of the
-		// request itself.
-		muxPath := "/data/"
-		encodedPath := "/data/"
-		for _, sp := range splitPath(relpath) {
-			encodedPath += url.PathEscape(sp) + "/"
-			muxPath += sp + "/"
-		}
-
-		shots = append(shots, shotInfo{
-			fsPath:      shotPath,
-			name:        filepath.ToSlash(relpath),
-			savename:    savename,
-			json:        mapshotData,
-			encodedPath: encodedPath,
-			muxPath:     muxPath,
-		})
-		return nil
+		if !isShotDir(root.storage, p) {
+			return nil
+		}
+		slog.Info("found mapshot", "root", root.name, "location", p)
+		shot, err := loadShot(root, p)
+		if err != nil {
+			slog.Error("unable to load mapshot", "root", root.name, "location", p, "err", err)
+			failed++
+			return fs.SkipDir
+		}
+		shots = append(shots, shot)
+		return fs.SkipDir
 	})
 	if err != nil {
-		return nil, err
+		return nil, failed, err
+	}
+	return shots, failed, nil
+}
+
+// serveRoot is a storage containing mapshots - typically a Factorio
+// script-output directory.
+type serveRoot struct {
+	// Namespace of the root in URLs and savenames; empty when serving a single
+	// root.
+	name string
+	// Location as specified by the user.
+	location string
+	storage  storage.Storage
+}
+
+// parseRoots reads the --root flags, of the form `name=location`. A single
+// root can be given without name. Without any, the Factorio script-output
+// directory is served without namespace.
+func parseRoots(ctx context.Context, values []string) ([]*serveRoot, error) {
+	if len(values) == 0 {
+		baseDir, err := factorioSettings.ScriptOutput()
+		if err != nil {
+			return nil, err
+		}
+		values = []string{baseDir}
 	}
-	return shots, nil
+	var roots []*serveRoot
+	seen := map[string]bool{}
+	for _, v := range values {
+		root := &serveRoot{location: v}
+		if len(values) > 1 || strings.Contains(v, "=") {
+			parts := strings.SplitN(v, "=", 2)
+			if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+				return nil, fmt.Errorf("invalid --root %q, expected name=location", v)
+			}
+			root.name, root.location = parts[0], parts[1]
+		}
+		if strings.ContainsAny(root.name, "/\\") || root.name == "." || root.name == ".." {
+			return nil, fmt.Errorf("invalid root name %q", root.name)
+		}
+		if seen[root.name] {
+			return nil, fmt.Errorf("root %q specified multiple times", root.name)
+		}
+		seen[root.name] = true
+		store, err := storage.New(ctx, root.location, s3Settings)
+		if err != nil {
+			return nil, err
+		}
+		root.storage = store
+		roots = append(roots, root)
+	}
+	return roots, nil
 }
 
 // Server implements a server presenting available mapshots and serving their
 // content.
 type Server struct {
-	baseDir               string
+	roots                 []*serveRoot
 	listingMux, viewerMux http.Handler
-
-	m   sync.Mutex
-	mux *http.ServeMux
+	// Returns the main page of the viewer, as served by viewerMux.
+	viewerPage func() ([]byte, error)
+	idx        *shotIndex
+	metrics    *serverMetrics
+	snapshots  *snapshotCache
+	handler    http.Handler
+	// Set once all roots have been successfully scanned.
+	ready atomic.Bool
+	// Roots successfully scanned at least once, keyed by name. Only used by
+	// the rescan goroutine.
+	scanned map[string]bool
 }
 
-func newServer(baseDir string, listingMux, viewerMux http.Handler) *Server {
+func newServer(roots []*serveRoot, listingMux, viewerMux http.Handler, viewerPage func() ([]byte, error)) (*Server, error) {
+	missingTile, err := missingTileHandler(flagServeMissingTiles)
+	if err != nil {
+		return nil, err
+	}
+	var thumbnails *thumbnailer
+	if flagServeThumbnails {
+		if thumbnails, err = newThumbnailer(flagServeThumbnailSize, flagServeThumbnailFormat, flagServeThumbnailCache); err != nil {
+			return nil, err
+		}
+	}
 	s := &Server{
-		baseDir:    baseDir,
+		roots:      roots,
 		listingMux: listingMux,
 		viewerMux:  viewerMux,
+		viewerPage: viewerPage,
+		idx:        newShotIndex(flagServeIncomplete, thumbnails, missingTile),
+		snapshots:  newSnapshotCache(flagServeSnapshotCacheMB << 20),
+	}
+	s.metrics = newServerMetrics(s.idx)
+	s.scanned = map[string]bool{}
+
+	mux := http.NewServeMux()
+	// Serve each shot data.
+	mux.Handle("/data/", s.idx)
+	// Serve pointer to latest.
+	mux.HandleFunc("/latest/", func(w http.ResponseWriter, req *http.Request) {
+		savename := strings.TrimPrefix(req.URL.Path, "/latest/")
+		jsonCfg := s.idx.latest(savename, requestPrefix(req))
+		if jsonCfg == nil || !requestAccess(req).allowed(savename) {
+			http.NotFound(w, req)
+			return
+		}
+		noteSave(req, savename)
+		jsonCfg.serve(w, req)
+	})
+	// Stream changes.
+	mux.Handle("/events", s.idx.events)
+	// Serve the API.
+	mux.Handle("/api/v1/", &apiV1{idx: s.idx})
+	mux.HandleFunc("/api/snapshot", s.serveSnapshot)
+	// Serve basic site.
+	mux.Handle("/", s.listingMux)
+	mux.HandleFunc("/shots.json", func(w http.ResponseWriter, req *http.Request) {
+		s.idx.listingFor(requestAccess(req), requestPrefix(req)).serve(w, req)
+	})
+	// Serve map viewer, with metadata for link previews.
+	mux.Handle("/map/", s.withViewerMetadata(http.StripPrefix("/map", s.viewerMux)))
+	mux.HandleFunc("/map/preview", s.servePreview)
+	mux.HandleFunc("/oembed", s.serveOEmbed)
+	s.handler = mux
+	if flagServeAuthConfig != "" {
+		auth, err := loadAuthConfig(flagServeAuthConfig)
+		if err != nil {
+			return nil, err
+		}
+		s.handler = auth.wrap(s.handler)
+	}
+	if flagServeCompress {
+		s.handler = withCompression(s.handler, flagServeBrotli)
+	}
+	// Metrics and health checks do not reveal any save, so they are not
+	// subject to authentication; scrapers and probes rarely support it.
+	outer := http.NewServeMux()
+	if flagServeMetricsPath != "" {
+		outer.Handle(flagServeMetricsPath, s.metrics.handler())
+	}
+	outer.HandleFunc("/healthz", func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Cache-Control", cacheNone)
+		fmt.Fprintln(w, "ok")
+	})
+	outer.HandleFunc("/readyz", func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Cache-Control", cacheNone)
+		if !s.ready.Load() {
+			http.Error(w, "initial scan not done", http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprintln(w, "ok")
+	})
+	outer.Handle("/", s.handler)
+	s.handler = outer
+	s.handler = s.metrics.wrap(s.handler)
+	if flagServeAccessLog != "" {
+		al, err := newAccessLogger(flagServeAccessLog, flagServeAccessLogFormat)
+		if err != nil {
+			return nil, err
+		}
+		s.handler = al.wrap(s.handler)
+	}
+	basePath, err := normalizeBasePath(flagServeBasePath)
+	if err != nil {
+		return nil, err
 	}
-	s.updateMux()
-	return s
+	trusted, err := parseNetworks(flagServeTrustedProxies)
+	if err != nil {
+		return nil, fmt.Errorf("invalid --trusted_proxies: %w", err)
+	}
+	// Outermost, so all other handlers - including metrics - see paths
+	// without the base path.
+	s.handler = withBasePath(s.handler, basePath, trusted)
+	return s, nil
 }
 
-// watch regularly updates the list of available maps. Current implementation is
-// the dumbest possible one - it just rescan files every few seconds and
-// recreate a completely new mux in that case.
+// watch keeps the list of available maps up to date. It relies on filesystem
+// notifications when available, and regularly does a full rescan as a safety
+// net - e.g., for filesystems which do not support notifications or if
+// notifications are lost.
+//
+// The initial scan happens here, so the server can listen meanwhile; it is
+// not ready until that scan succeeds. For roots with notifications, putting
+// the watches in place is that scan.
 func (s *Server) watch(ctx context.Context) {
+	var unwatched []*serveRoot
+	for _, root := range s.roots {
+		// Notifications are only available for local directories.
+		local, ok := root.storage.(*storage.Local)
+		if !flagServeNotify || !ok {
+			unwatched = append(unwatched, root)
+			continue
+		}
+		if err := s.watchRoot(ctx, root, local.Dir()); err != nil {
+			slog.Error("filesystem notifications not available, relying on rescan only", "dir", local.Dir(), "err", err)
+			unwatched = append(unwatched, root)
+		}
+	}
+	s.rescan(unwatched)
+
 	for {
-		// Update list of maps regular, with some fuzzing.
-		delay := time.Duration(8000+rand.Int63n(2000)) * time.Millisecond
+		// Full rescan, with some fuzzing.
+		delay := flagServeRescan + time.Duration(rand.Int63n(int64(flagServeRescan)/5+1))
 		select {
 		case <-time.After(delay):
 		case <-ctx.Done():
 			return
 		}
-		s.updateMux()
+		s.rescan(s.roots)
 	}
 }
 
-func (s *Server) updateMux() {
-	// Find all existing mapshots.
-	shots, err := findShots(s.baseDir)
+// watchRoot sets up filesystem notifications for a root, doing its initial
+// scan along the way.
+func (s *Server) watchRoot(ctx context.Context, root *serveRoot, dir string) error {
+	sw, err := newShotWatcher(root, dir, s.idx)
 	if err != nil {
-		shots = nil
-		glog.Errorf("unable to find mapshots at %s: %v", s.baseDir, err)
-	}
-
-	// Build shots.json
-	sort.Slice(shots, func(i, j int) bool {
-		return shots[i].json.TicksPlayed > shots[j].json.TicksPlayed
-	})
-	kwShots := map[string]*ShotsJSONSave{}
-	var savenames []string
-	for _, shot := range shots {
-		if kwShots[shot.savename] == nil {
-			savenames = append(savenames, shot.savename)
-			kwShots[shot.savename] = &ShotsJSONSave{
-				Savename: shot.savename,
-			}
-		}
-		kwShots[shot.savename].Versions = append(kwShots[shot.savename].Versions, &ShotsJSONInfo{
-			Name:        shot.name,
-			EncodedPath: shot.encodedPath,
-			TicksPlayed: shot.json.TicksPlayed,
-		})
+		return err
 	}
-	sort.Strings(savenames)
-
-	var data ShotsJSON
-	for _, savename := range savenames {
-		data.All = append(data.All, kwShots[savename])
-	}
-
-	jsonData, err := json.Marshal(data)
+	start := time.Now()
+	shots, failed, err := sw.scan()
 	if err != nil {
-		jsonData = nil
-		glog.Errorf("unable to build shots.json: %v", err)
+		sw.close()
+		return err
 	}
+	s.metrics.observeScan(root.name, start, failed, nil)
+	s.idx.reset(root.name, shots)
+	s.scanned[root.name] = true
+	go sw.run(ctx)
+	return nil
+}
 
-	// Serve each shot data
-	mux := http.NewServeMux()
-	for _, shot := range shots {
-		mux.Handle(shot.muxPath, http.StripPrefix(shot.muxPath, http.FileServer(http.Dir(shot.fsPath))))
-	}
-
-	// Serve pointer to latest
-	for _, versions := range data.All {
-		savename := versions.Savename
-		if len(versions.Versions) < 1 {
-			continue
-		}
-		latest := versions.Versions[0]
-
-		cfg := &MapshotConfigJSON{
-			EncodedPath: latest.EncodedPath,
-		}
-		jsonCfg, err := json.Marshal(cfg)
+// rescan does a full scan of the given roots and replaces the index content.
+func (s *Server) rescan(roots []*serveRoot) {
+	for _, root := range roots {
+		start := time.Now()
+		shots, failed, err := findShots(root)
+		s.metrics.observeScan(root.name, start, failed, err)
 		if err != nil {
-			glog.Errorf("unable to build mapshot config: %v", err)
+			// Keep the current content of that root; it is likely more
+			// accurate than nothing.
+			slog.Error("unable to find mapshots", "storage", root.storage.String(), "err", err)
+			continue
 		}
-		mux.HandleFunc("/latest/"+savename, func(w http.ResponseWriter, req *http.Request) {
-			w.Header().Set("Content-Type", "application/json")
-			w.Write(jsonCfg)
-		})
+		s.idx.reset(root.name, shots)
+		s.scanned[root.name] = true
 	}
-
-	// Serve basic site.
-	mux.Handle("/", s.listingMux)
-	mux.HandleFunc("/shots.json", func(w http.ResponseWriter, req *http.Request) {
-		w.Header().Set("Content-Type", "application/json")
-		w.Write(jsonData)
-	})
-
-	// Serve map viewer.
-	mux.Handle("/map/", http.StripPrefix("/map", s.viewerMux))
-
-	s.m.Lock()
-	defer s.m.Unlock()
-	// Only update if reading did not fail - or if it was the first call, to
-	// make sure we always have a mux.
-	if shots != nil || s.mux == nil {
-		s.mux = mux
+	if !s.ready.Load() && len(s.scanned) == len(s.roots) {
+		slog.Info("initial scan done, ready")
+		s.ready.Store(true)
 	}
 }
 
 func (s *Server) ServeHTTP(w http.ResponseWriter, req *http.Request) {
-	s.m.Lock()
-	mux := s.mux
-	s.m.Unlock()
-	mux.ServeHTTP(w, req)
+	s.handler.ServeHTTP(w, req)
 }
 
 var cmdServe = &cobra.Command{
@@ -273,45 +570,132 @@ It serves data from Factorio script-output directory.
 	`,
 	Args: cobra.NoArgs,
 	RunE: func(cmd *cobra.Command, args []string) error {
-		baseDir, err := factorioSettings.ScriptOutput()
+		// Storages are created from the parent context: they must keep
+		// working while in-flight requests are drained.
+		roots, err := parseRoots(cmd.Context(), flagServeRoots)
 		if err != nil {
 			return err
 		}
-		fmt.Printf("Serving data from %s\n", baseDir)
-		s := newServer(baseDir, builtinListingMux, builtinViewerMux)
-		go s.watch(cmd.Context())
+		for _, root := range roots {
+			if root.name == "" {
+				fmt.Printf("Serving data from %s\n", root.storage)
+			} else {
+				fmt.Printf("Serving data from %s as %s\n", root.storage, root.name)
+			}
+		}
+		s, err := newServer(
+			roots,
+			buildMux(embed.ListingFiles, flagServeCompress, flagServeCompress && flagServeBrotli),
+			buildMux(embed.ViewerFiles, flagServeCompress, flagServeCompress && flagServeBrotli),
+			func() ([]byte, error) { return []byte(embed.ViewerFiles["index.html"]), nil },
+		)
+		if err != nil {
+			return err
+		}
+		ctx, stop := signal.NotifyContext(cmd.Context(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+		go s.watch(ctx)
 
-		addr := fmt.Sprintf(":%d", port)
-		fmt.Printf("Listening on %s ...\n", addr)
-		return http.ListenAndServe(addr, s)
+		return listenAndServe(ctx, s, s.idx.events.close)
 	},
 }
 
-func buildMux(files map[string]string) *http.ServeMux {
+// buildMux serves the built-in frontend files. As they only change with the
+// binary, their ETag is derived from the hash of the embedded content. When
+// compression is enabled, compressed variants are prepared once here, instead
+// of on each request.
+func buildMux(files map[string]string, gz bool, br bool) *http.ServeMux {
 	mux := http.NewServeMux()
 	for fname, content := range files {
-		fname := fname
-		content := content
-		mux.HandleFunc("/"+fname, func(w http.ResponseWriter, req *http.Request) {
-			b := bytes.NewReader([]byte(content))
-			http.ServeContent(w, req, fname, builtinModTime, b)
-		})
+		ctype := mime.TypeByExtension(path.Ext(fname))
+		if ctype == "" {
+			ctype = http.DetectContentType([]byte(content))
+		}
+		etag := fmt.Sprintf(`"%s-%s"`, embed.VersionHash[:16], fname)
+		p := newPrecompressed([]byte(content), ctype, etag, gz, br)
+		cache := cacheBuiltin
+		if hashedFilename.MatchString(fname) {
+			cache = cacheImmutable
+		}
+		serve := func(w http.ResponseWriter, req *http.Request) {
+			w.Header().Set("Cache-Control", cache)
+			p.serve(w, req)
+		}
+		mux.HandleFunc("/"+fname, serve)
 		if fname == "index.html" {
-			mux.HandleFunc("/", func(w http.ResponseWriter, req *http.Request) {
-				b := bytes.NewReader([]byte(content))
-				http.ServeContent(w, req, fname, builtinModTime, b)
-			})
+			mux.HandleFunc("/", serve)
 		}
 	}
 	return mux
 }
 
-var port int
-var builtinModTime = time.Now()
-var builtinListingMux = buildMux(embed.ListingFiles)
-var builtinViewerMux = buildMux(embed.ViewerFiles)
+var (
+	port                       int
+	flagServeNotify            bool
+	flagServeRescan            time.Duration
+	flagServeIncomplete        bool
+	flagServeAbandonAfter      time.Duration
+	flagServeCompress          bool
+	flagServeBrotli            bool
+	flagServeAuthConfig        string
+	flagServeTLSCert           string
+	flagServeTLSKey            string
+	flagServeTLSClientCA       string
+	flagServeRedirectPort      int
+	flagServeRoots             []string
+	flagServeMetricsPath       string
+	flagServeAccessLog         string
+	flagServeAccessLogFormat   string
+	flagServeListen            string
+	flagServeReadHeaderTimeout time.Duration
+	flagServeReadTimeout       time.Duration
+	flagServeWriteTimeout      time.Duration
+	flagServeIdleTimeout       time.Duration
+	flagServeShutdownTimeout   time.Duration
+	flagServeBasePath          string
+	flagServeTrustedProxies    []string
+	flagServeThumbnails        bool
+	flagServeThumbnailSize     int
+	flagServeThumbnailFormat   string
+	flagServeThumbnailCache    string
+	flagServeSnapshotCacheMB   int64
+	flagServeMissingTiles      string
+)
 
 func init() {
 	cmdServe.PersistentFlags().IntVar(&port, "port", 8080, "Port to listen on.")
+	cmdServe.PersistentFlags().StringVar(&flagServeListen, "listen", "", "Address to listen on, as host:port, or unix:<path> for a Unix socket. Overrides --port. Ignored when started through systemd socket activation.")
+	cmdServe.PersistentFlags().DurationVar(&flagServeReadHeaderTimeout, "read_header_timeout", 10*time.Second, "Maximum time to read the headers of a request.")
+	cmdServe.PersistentFlags().DurationVar(&flagServeReadTimeout, "read_timeout", time.Minute, "Maximum time to read a full request.")
+	cmdServe.PersistentFlags().DurationVar(&flagServeWriteTimeout, "write_timeout", 5*time.Minute, "Maximum time to write a response. Does not apply to event streams.")
+	cmdServe.PersistentFlags().DurationVar(&flagServeIdleTimeout, "idle_timeout", 2*time.Minute, "How long to keep idle keep-alive connections open.")
+	cmdServe.PersistentFlags().DurationVar(&flagServeShutdownTimeout, "shutdown_timeout", 30*time.Second, "On SIGINT or SIGTERM, how long to wait for in-flight requests to finish before exiting.")
+	cmdServe.PersistentFlags().StringVar(&flagServeBasePath, "base_path", "", "URL path under which everything is served, e.g., /factorio/maps when behind a reverse proxy forwarding https://example.org/factorio/maps/ as is.")
+	cmdServe.PersistentFlags().StringSliceVar(&flagServeTrustedProxies, "trusted_proxies", nil, "Networks, in CIDR notation, of reverse proxies allowed to set X-Forwarded-Prefix - i.e., the path prefix they removed before forwarding the request - X-Forwarded-Proto and X-Forwarded-Host. Those headers are ignored on requests from anywhere else.")
+	cmdServe.PersistentFlags().BoolVar(&flagServeNotify, "notify", true, "Use filesystem notifications to detect new mapshots as soon as they are created.")
+	cmdServe.PersistentFlags().DurationVar(&flagServeRescan, "rescan_interval", 5*time.Minute, "Interval between full rescans of the available mapshots. Acts as a safety net when filesystem notifications are missed or not available.")
+	cmdServe.PersistentFlags().BoolVar(&flagServeIncomplete, "show_incomplete", false, "Also list mapshots which are still being rendered or whose rendering was abandoned. They are never used as latest version of a save.")
+	cmdServe.PersistentFlags().DurationVar(&flagServeAbandonAfter, "abandon_after", time.Hour, "A mapshot which is not complete and has seen no new tiles for that long is considered abandoned.")
+	cmdServe.PersistentFlags().BoolVar(&flagServeCompress, "compress", true, "Compress responses (JSON, HTML, Javascript, ...) with gzip when the browser supports it. Tiles are never compressed.")
+	cmdServe.PersistentFlags().BoolVar(&flagServeBrotli, "brotli", false, "Also support Brotli compression, preferred over gzip by browsers. Requires --compress.")
+	cmdServe.PersistentFlags().BoolVar(&flagServeThumbnails, "thumbnails", true, "Provide a preview thumbnail of each surface of complete mapshots. Missing thumbnails are built on first use and stored in --thumbnail_cache; see 'mapshot thumbnails' to build them ahead of time.")
+	cmdServe.PersistentFlags().IntVar(&flagServeThumbnailSize, "thumbnail_size", 512, "Maximum width and height of thumbnails, in pixels.")
+	cmdServe.PersistentFlags().StringVar(&flagServeThumbnailFormat, "thumbnail_format", imageJPEG, "Format of thumbnails: jpeg or png.")
+	thumbnailCache := ""
+	if dir, err := os.UserCacheDir(); err == nil {
+		thumbnailCache = filepath.Join(dir, "mapshot", "thumbnails")
+	}
+	cmdServe.PersistentFlags().StringVar(&flagServeThumbnailCache, "thumbnail_cache", thumbnailCache, "Directory where thumbnails built by the server are stored. Mapshots are never modified. If empty, thumbnails are only kept in memory.")
+	cmdServe.PersistentFlags().Int64Var(&flagServeSnapshotCacheMB, "snapshot_cache_mb", 64, "Memory used to keep recently rendered snapshots and link previews of complete mapshots, in MiB. Disabled if 0.")
+	cmdServe.PersistentFlags().StringVar(&flagServeMissingTiles, "missing_tiles", missingTilesEmpty, "How to answer requests for tiles which do not exist according to the tiles.json manifest of their mapshot: empty, with a 204 No Content response - the viewer then uses less detailed tiles; placeholder, with a transparent image; or storage, to ignore manifests and look up the storage, answering 404 Not Found.")
+	cmdServe.PersistentFlags().StringVar(&flagServeAuthConfig, "auth_config", "", "JSON file describing users allowed to access the server and which saves they can see. If not specified, everything is accessible without authentication.")
+	cmdServe.PersistentFlags().StringVar(&flagServeTLSCert, "tls_cert", "", "If set, serve HTTPS using this PEM certificate file. It is reloaded automatically when it changes.")
+	cmdServe.PersistentFlags().StringVar(&flagServeTLSKey, "tls_key", "", "PEM private key file for --tls_cert. It is reloaded automatically when it changes.")
+	cmdServe.PersistentFlags().StringVar(&flagServeTLSClientCA, "tls_client_ca", "", "If set, require clients to present a TLS certificate signed by one of the CAs in this PEM bundle.")
+	cmdServe.PersistentFlags().IntVar(&flagServeRedirectPort, "http_redirect_port", 0, "With --tls_cert, also listen for plain HTTP on this port and redirect to HTTPS, on the port the server listens on. Not available with unix sockets. Disabled if 0.")
+	cmdServe.PersistentFlags().StringVar(&flagServeMetricsPath, "metrics_path", "/metrics", "Path where Prometheus metrics are exposed, without authentication. Disabled if empty.")
+	cmdServe.PersistentFlags().StringVar(&flagServeAccessLog, "access_log", "", "File to append a line to for each request served; - for stdout. Disabled if empty.")
+	cmdServe.PersistentFlags().StringVar(&flagServeAccessLogFormat, "access_log_format", accessLogCommon, "Format of the access log: common (Common Log Format) or json, which includes the savename and shot ID of the request.")
+	cmdServe.PersistentFlags().StringArrayVar(&flagServeRoots, "root", nil, "Directory or S3 URL (s3://<bucket>/<prefix>) to serve, in the form name=location; can be repeated. Each root is served under its own namespace. A single root can be given without name. If not specified, Factorio script-output directory is served without namespace.")
 	cmdRoot.AddCommand(cmdServe)
 }
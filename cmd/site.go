@@ -0,0 +1,173 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/Palats/mapshot/embed"
+	"github.com/Palats/mapshot/storage"
+	"github.com/spf13/cobra"
+)
+
+// The static site follows the same URL layout as `mapshot serve`, with only
+// relative links, so it works from any base path:
+//   index.html, ...        The listing.
+//   shots.json             All the complete shots.
+//   latest/<savename>      Pointer to the latest shot of each save.
+//   map/index.html, ...    The viewer.
+//   data/<name>/...        Content of the shots.
+
+// writeSiteFile writes a file of the site, creating directories as needed.
+func writeSiteFile(dir string, name string, content []byte) error {
+	filename := filepath.Join(dir, filepath.FromSlash(name))
+	if err := os.MkdirAll(filepath.Dir(filename), 0755); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(filename, content, 0644); err != nil {
+		return fmt.Errorf("unable to write %s: %w", filename, err)
+	}
+	return nil
+}
+
+// exportSite writes a static version of what `mapshot serve` provides for the
+// roots. Only complete shots are exported.
+func exportSite(ctx context.Context, roots []*serveRoot, dir string) error {
+	idx := newShotIndex(false, nil, nil)
+	for _, root := range roots {
+		shots, _, err := findShots(root)
+		if err != nil {
+			return fmt.Errorf("unable to find mapshots at %s: %w", root.storage, err)
+		}
+		idx.reset(root.name, shots)
+
+		dataDir := filepath.Join(dir, "data", filepath.FromSlash(root.name))
+		if err := os.MkdirAll(dataDir, 0755); err != nil {
+			return err
+		}
+		target, err := storage.NewLocal(dataDir)
+		if err != nil {
+			return err
+		}
+		p := &publisher{
+			source:   root.storage,
+			target:   target,
+			force:    flagExportForce,
+			parallel: flagExportParallel,
+			// Static hosts cannot look into archives.
+			extract: true,
+			// Nor recreate pruned tiles.
+			restoreTiles: true,
+		}
+		for _, si := range shots {
+			if si.status != shotComplete {
+				continue
+			}
+			if err := p.publishShot(ctx, si.location); err != nil {
+				return err
+			}
+		}
+	}
+
+	// Dynamic content of the server, precomputed. Encoded paths are made
+	// relative to the file referencing them.
+	listing := &ShotsJSON{}
+	for _, savename := range idx.savenames() {
+		save := &ShotsJSONSave{Savename: savename}
+		for _, si := range idx.saveShots(savename) {
+			if si.status != shotComplete {
+				continue
+			}
+			save.Root = si.root
+			save.Versions = append(save.Versions, &ShotsJSONInfo{
+				Name:        si.name,
+				EncodedPath: strings.TrimPrefix(si.encodedPath, "/"),
+				TicksPlayed: si.json.TicksPlayed,
+			})
+		}
+		if len(save.Versions) == 0 {
+			continue
+		}
+		listing.All = append(listing.All, save)
+
+		// latest/<savename> is relative to the latest/ directory.
+		up := strings.Repeat("../", strings.Count(savename, "/")+1)
+		latest, err := json.Marshal(&MapshotConfigJSON{EncodedPath: up + save.Versions[0].EncodedPath})
+		if err != nil {
+			return err
+		}
+		if err := writeSiteFile(dir, path.Join("latest", savename), latest); err != nil {
+			return err
+		}
+	}
+	shotsJSON, err := json.Marshal(listing)
+	if err != nil {
+		return err
+	}
+	if err := writeSiteFile(dir, "shots.json", shotsJSON); err != nil {
+		return err
+	}
+
+	for fname, content := range embed.ViewerFiles {
+		if err := writeSiteFile(dir, path.Join("map", fname), []byte(content)); err != nil {
+			return err
+		}
+	}
+	// Keep GitHub Pages from processing the site with Jekyll.
+	if err := writeSiteFile(dir, ".nojekyll", nil); err != nil {
+		return err
+	}
+	// The listing is written last, so it only shows up once everything else
+	// is available.
+	for fname, content := range embed.ListingFiles {
+		if err := writeSiteFile(dir, fname, []byte(content)); err != nil {
+			return err
+		}
+	}
+	fmt.Printf("Exported %d saves to %s\n", len(listing.All), dir)
+	return nil
+}
+
+var cmdExportSite = &cobra.Command{
+	Use:   "export-site <dir>",
+	Short: "Write a static website with the listing, the viewer and the mapshots.",
+	Long: `Write a static website with the listing, the viewer and the mapshots.
+
+The website provides the same pages as 'mapshot serve', without requiring a
+server: it can be deployed on GitHub Pages or any plain web host. Only complete
+mapshots are exported; archived mapshots are extracted. When exporting again to
+the same directory, mapshots already there are skipped.
+
+By default, mapshots are read from Factorio script-output directory. Use --root
+to export other directories or S3 buckets, as for 'mapshot serve'.
+`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if flagExportParallel < 1 {
+			return fmt.Errorf("--parallel must be at least 1")
+		}
+		roots, err := parseRoots(cmd.Context(), flagExportRoots)
+		if err != nil {
+			return err
+		}
+		return exportSite(cmd.Context(), roots, args[0])
+	},
+}
+
+var (
+	flagExportRoots    []string
+	flagExportForce    bool
+	flagExportParallel int
+)
+
+func init() {
+	cmdExportSite.PersistentFlags().StringArrayVar(&flagExportRoots, "root", nil, "Where to find mapshots, as with 'serve'. Can be repeated, as name=location.")
+	cmdExportSite.PersistentFlags().BoolVar(&flagExportForce, "force", false, "Copy mapshots even if already exported.")
+	cmdExportSite.PersistentFlags().IntVar(&flagExportParallel, "parallel", 8, "Number of files to copy concurrently.")
+	cmdRoot.AddCommand(cmdExportSite)
+}
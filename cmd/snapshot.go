@@ -0,0 +1,210 @@
+package cmd
+
+import (
+	"bytes"
+	"container/list"
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"runtime"
+	"strconv"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+)
+
+// Size of snapshots when not specified, and maximum width and height.
+const (
+	snapshotWidth   = 800
+	snapshotHeight  = 600
+	snapshotMaxSize = 4096
+)
+
+// snapshotKey identifies a rendered viewport. The content of complete shots
+// never changes, so neither does the image for a given key.
+type snapshotKey struct {
+	root, id      string
+	surface       int
+	x, y, z       float64
+	width, height int
+	format        string
+}
+
+func (k snapshotKey) String() string {
+	return fmt.Sprintf("%s/%s/%d/%g/%g/%g/%dx%d.%s", k.root, k.id, k.surface, k.x, k.y, k.z, k.width, k.height, k.format)
+}
+
+type snapshotEntry struct {
+	key  snapshotKey
+	data []byte
+}
+
+// snapshotCache renders images of viewports and keeps the most recently used
+// ones in memory, up to a total size.
+type snapshotCache struct {
+	maxBytes int64
+	group    singleflight.Group
+	// Limits the number of concurrent renders, which are CPU intensive.
+	renders chan struct{}
+
+	m       sync.Mutex
+	entries map[snapshotKey]*list.Element
+	// Values are *snapshotEntry, most recently used first.
+	lru  *list.List
+	size int64
+}
+
+func newSnapshotCache(maxBytes int64) *snapshotCache {
+	return &snapshotCache{
+		maxBytes: maxBytes,
+		renders:  make(chan struct{}, runtime.GOMAXPROCS(0)),
+		entries:  map[snapshotKey]*list.Element{},
+		lru:      list.New(),
+	}
+}
+
+// get returns the image of the target at the given size, rendering it if
+// needed. Only snapshots of complete shots are kept, as tiles of other shots
+// can still change.
+func (c *snapshotCache) get(t *viewerTarget, width, height int, format string) ([]byte, error) {
+	key := snapshotKey{
+		root:    t.shot.root,
+		id:      t.shot.id,
+		surface: t.surface.SurfaceIdx,
+		x:       t.view.x,
+		y:       t.view.y,
+		z:       t.view.z,
+		width:   width,
+		height:  height,
+		format:  format,
+	}
+	c.m.Lock()
+	if e := c.entries[key]; e != nil {
+		c.lru.MoveToFront(e)
+		c.m.Unlock()
+		return e.Value.(*snapshotEntry).data, nil
+	}
+	c.m.Unlock()
+
+	v, err, _ := c.group.Do(key.String(), func() (interface{}, error) {
+		c.renders <- struct{}{}
+		defer func() { <-c.renders }()
+		img, err := renderViewport(t.shot, t.surface, t.view, width, height)
+		if err != nil {
+			return nil, err
+		}
+		var buf bytes.Buffer
+		if err := encodeImage(&buf, img, format); err != nil {
+			return nil, err
+		}
+		data := buf.Bytes()
+		if t.shot.status == shotComplete {
+			c.add(key, data)
+		}
+		return data, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return v.([]byte), nil
+}
+
+// add keeps the snapshot, evicting the least recently used ones as needed.
+func (c *snapshotCache) add(key snapshotKey, data []byte) {
+	size := int64(len(data))
+	if size > c.maxBytes {
+		return
+	}
+	c.m.Lock()
+	defer c.m.Unlock()
+	if _, ok := c.entries[key]; ok {
+		return
+	}
+	for c.size+size > c.maxBytes {
+		e := c.lru.Back()
+		old := c.lru.Remove(e).(*snapshotEntry)
+		delete(c.entries, old.key)
+		c.size -= int64(len(old.data))
+	}
+	c.entries[key] = c.lru.PushFront(&snapshotEntry{key: key, data: data})
+	c.size += size
+}
+
+// serveViewport sends an image of the target, at the given size.
+func (s *Server) serveViewport(w http.ResponseWriter, req *http.Request, t *viewerTarget, width, height int, format string) {
+	noteShot(req, t.shot)
+	data, err := s.snapshots.get(t, width, height, format)
+	if err != nil {
+		slog.Error("unable to render viewport", "shot", t.shot.name, "surface", t.surface.SurfaceName, "err", err)
+		http.Error(w, "unable to render image", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "image/"+format)
+	// Targets designated through the latest shot of a save change when a new
+	// shot is available.
+	if !t.latest && t.shot.status == shotComplete {
+		w.Header().Set("Cache-Control", cacheImmutable)
+	} else {
+		w.Header().Set("Cache-Control", cacheShort)
+	}
+	http.ServeContent(w, req, "", time.Time{}, bytes.NewReader(data))
+}
+
+// serveSnapshot implements /api/snapshot, which provides an image of a
+// viewport of a shot. It takes the same parameters as the viewer to designate
+// the shot and the viewport - `path` or `l`, `s`, `x`, `y`, `z` - along with
+// the size of the image, `w` and `h`, and its `format`, jpeg or png.
+func (s *Server) serveSnapshot(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	query := req.URL.Query()
+	// Unlike the viewer, invalid values are reported.
+	for _, key := range []string{"x", "y", "z"} {
+		if v := query.Get(key); v != "" {
+			if f, err := strconv.ParseFloat(v, 64); err != nil || math.IsNaN(f) || math.IsInf(f, 0) {
+				http.Error(w, fmt.Sprintf("invalid value %q for %s", v, key), http.StatusBadRequest)
+				return
+			}
+		}
+	}
+	size := func(key string, def int) (int, error) {
+		v := query.Get(key)
+		if v == "" {
+			return def, nil
+		}
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > snapshotMaxSize {
+			return 0, fmt.Errorf("invalid value %q for %s; must be between 1 and %d", v, key, snapshotMaxSize)
+		}
+		return n, nil
+	}
+	width, err := size("w", snapshotWidth)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	height, err := size("h", snapshotHeight)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	format := query.Get("format")
+	if format == "" {
+		format = imagePNG
+	}
+	if err := checkImageFormat(format); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	t := s.resolveViewer(req, query)
+	if t == nil {
+		http.NotFound(w, req)
+		return
+	}
+	s.serveViewport(w, req, t, width, height, format)
+}
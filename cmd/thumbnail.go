@@ -0,0 +1,368 @@
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"io/fs"
+	"log/slog"
+	"math"
+	"net/http"
+	"os"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Palats/mapshot/shot"
+	"github.com/Palats/mapshot/storage"
+	"github.com/spf13/cobra"
+	"golang.org/x/sync/singleflight"
+)
+
+// Image formats of generated images.
+const (
+	imageJPEG = "jpeg"
+	imagePNG  = "png"
+)
+
+// imageExt returns the file extension of the image format.
+func imageExt(format string) string {
+	if format == imageJPEG {
+		return ".jpg"
+	}
+	return "." + format
+}
+
+// checkImageFormat validates the name of an image format.
+func checkImageFormat(format string) error {
+	if format != imageJPEG && format != imagePNG {
+		return fmt.Errorf("unknown image format %q; expected %s or %s", format, imageJPEG, imagePNG)
+	}
+	return nil
+}
+
+// encodeImage writes the image in the given format.
+func encodeImage(w io.Writer, img image.Image, format string) error {
+	if format == imagePNG {
+		return png.Encode(w, img)
+	}
+	return jpeg.Encode(w, img, &jpeg.Options{Quality: 85})
+}
+
+// thumbnailName is the name of the thumbnail of a surface. Thumbnails of shot
+// directories are stored in the directory; those of archived shots next to
+// the archive, prefixed by the name of the shot directory.
+func thumbnailName(surface *shot.Surface, format string) string {
+	return fmt.Sprintf("thumbnail_s%d%s", surface.SurfaceIdx, imageExt(format))
+}
+
+// thumbnailPattern matches thumbnailName, capturing the surface index and the
+// extension.
+var thumbnailPattern = regexp.MustCompile(`^thumbnail_s(\d+)\.(jpg|png)$`)
+
+// thumbnailLocation is where the thumbnail of the surface is stored, in the
+// storage of the shot.
+func thumbnailLocation(si *shotInfo, surface *shot.Surface, format string) string {
+	name := thumbnailName(surface, format)
+	if dir := archivedShotDir(si.location); dir != "" {
+		return dir + "." + name
+	}
+	return path.Join(si.location, name)
+}
+
+// buildThumbnail draws an overview of the whole surface, from the least
+// detailed tiles, fitting in a square of size pixels.
+func buildThumbnail(si *shotInfo, surface *shot.Surface, size int, format string) ([]byte, error) {
+	area := shot.BoundingBox{LeftTop: surface.WorldMin, RightBottom: surface.WorldMax}
+	width := area.RightBottom.X - area.LeftTop.X
+	height := area.RightBottom.Y - area.LeftTop.Y
+	if width <= 0 || height <= 0 {
+		return nil, fmt.Errorf("%s: surface %s has an empty area", si.name, surface.SurfaceName)
+	}
+	scale := float64(size) / math.Max(width, height)
+	img := image.NewRGBA(image.Rect(0, 0, max(1, int(math.Round(width*scale))), max(1, int(math.Round(height*scale)))))
+	// Same as areas not rendered by the mod in the viewer.
+	draw.Draw(img, img.Bounds(), image.NewUniform(color.Black), image.Point{}, draw.Src)
+	if err := drawArea(si, surface, surface.ZoomMin, area, img); err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if err := encodeImage(&buf, img, format); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// thumbnailer provides thumbnails of shots. Those written next to the shots by
+// 'mapshot thumbnails' are used as is; missing ones are built on first use and
+// stored in a cache directory, or kept in memory without one. Shots themselves
+// are never modified.
+type thumbnailer struct {
+	size   int
+	format string
+	// Where built thumbnails are stored; nil to keep them in memory.
+	cache *storage.Local
+	group singleflight.Group
+
+	m sync.Mutex
+	// Thumbnails which could not be cached, keyed by shot key and name;
+	// oldest first in order.
+	memory map[string][]byte
+	order  []string
+}
+
+// thumbnailMemoryEntries is the number of thumbnails kept in memory when they
+// cannot be cached.
+const thumbnailMemoryEntries = 256
+
+// newThumbnailer creates a thumbnailer storing the thumbnails it builds in the
+// cache directory, created if needed. They are kept in memory if cacheDir is
+// empty or cannot be used.
+func newThumbnailer(size int, format string, cacheDir string) (*thumbnailer, error) {
+	if err := checkImageFormat(format); err != nil {
+		return nil, err
+	}
+	if size < 1 {
+		return nil, fmt.Errorf("invalid thumbnail size %d", size)
+	}
+	t := &thumbnailer{
+		size:   size,
+		format: format,
+		memory: map[string][]byte{},
+	}
+	if cacheDir != "" {
+		cache, err := func() (*storage.Local, error) {
+			if err := os.MkdirAll(cacheDir, 0755); err != nil {
+				return nil, err
+			}
+			return storage.NewLocal(cacheDir)
+		}()
+		if err != nil {
+			slog.Warn("unable to use thumbnail cache directory, keeping thumbnails in memory", "dir", cacheDir, "err", err)
+		} else {
+			t.cache = cache
+		}
+	}
+	return t, nil
+}
+
+// cacheName returns where the thumbnail of the surface is stored in the cache
+// directory, or "" if the shot has no usable ID. Shot IDs are unique, and their
+// content does not change, so thumbnails never need to be invalidated.
+func (t *thumbnailer) cacheName(si *shotInfo, surface *shot.Surface) string {
+	if si.id == "" || strings.ContainsAny(si.id, `/\`) || !fs.ValidPath(si.id) {
+		return ""
+	}
+	return path.Join(si.id, fmt.Sprintf("s%d-%d%s", surface.SurfaceIdx, t.size, imageExt(t.format)))
+}
+
+// name returns the name of the thumbnail of the surface, relative to the
+// encoded path of the shot.
+func (t *thumbnailer) name(surface *shot.Surface) string {
+	return thumbnailName(surface, t.format)
+}
+
+// get returns the thumbnail of the surface, building it if needed.
+func (t *thumbnailer) get(ctx context.Context, si *shotInfo, surface *shot.Surface) ([]byte, error) {
+	location := thumbnailLocation(si, surface, t.format)
+	key := path.Join(si.root, location)
+	t.m.Lock()
+	data := t.memory[key]
+	t.m.Unlock()
+	if data != nil {
+		return data, nil
+	}
+	if data, err := fs.ReadFile(si.store, location); err == nil {
+		return data, nil
+	}
+	cacheName := ""
+	if t.cache != nil {
+		cacheName = t.cacheName(si, surface)
+	}
+	if cacheName != "" {
+		if data, err := fs.ReadFile(t.cache, cacheName); err == nil {
+			return data, nil
+		}
+	}
+
+	v, err, _ := t.group.Do(key, func() (interface{}, error) {
+		data, err := buildThumbnail(si, surface, t.size, t.format)
+		if err != nil {
+			return nil, err
+		}
+		slog.Info("thumbnail built", "shot", si.name, "surface", surface.SurfaceName)
+		if cacheName != "" {
+			// Storing is worth finishing even if the client went away.
+			err := t.cache.Put(context.WithoutCancel(ctx), cacheName, bytes.NewReader(data), int64(len(data)))
+			if err == nil {
+				return data, nil
+			}
+			slog.Warn("unable to store thumbnail, keeping it in memory", "name", cacheName, "cache", t.cache.Dir(), "err", err)
+		}
+		t.m.Lock()
+		defer t.m.Unlock()
+		if len(t.order) >= thumbnailMemoryEntries {
+			delete(t.memory, t.order[0])
+			t.order = t.order[1:]
+		}
+		t.memory[key] = data
+		t.order = append(t.order, key)
+		return data, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return v.([]byte), nil
+}
+
+// serve sends the thumbnail named in the request, relative to the shot.
+func (t *thumbnailer) serve(w http.ResponseWriter, req *http.Request, si *shotInfo, name string) {
+	match := thumbnailPattern.FindStringSubmatch(name)
+	if match == nil || match[2] != imageExt(t.format)[1:] || si.status != shotComplete {
+		http.NotFound(w, req)
+		return
+	}
+	surface := si.json.Surface(match[1])
+	if surface == nil {
+		http.NotFound(w, req)
+		return
+	}
+	data, err := t.get(req.Context(), si, surface)
+	if err != nil {
+		slog.Error("unable to build thumbnail", "shot", si.name, "surface", surface.SurfaceName, "err", err)
+		http.Error(w, "unable to build thumbnail", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "image/"+t.format)
+	w.Header().Set("Cache-Control", cacheImmutable)
+	w.Header().Set("ETag", strconv.Quote(si.id+"-"+name))
+	http.ServeContent(w, req, "", time.Time{}, bytes.NewReader(data))
+}
+
+// isThumbnail indicates whether the path, relative to a shot, is one of its
+// thumbnails.
+func isThumbnail(name string) bool {
+	return thumbnailPattern.MatchString(name)
+}
+
+var cmdThumbnails = &cobra.Command{
+	Use:   "thumbnails [shot or save]...",
+	Short: "Build preview thumbnails of mapshots.",
+	Long: `Build preview thumbnails of mapshots.
+
+A thumbnail is built for each surface of each complete mapshot, from its least
+detailed tiles. Thumbnails are stored in the mapshot directory - or next to the
+archive for archived mapshots - where 'mapshot serve' finds them. The server
+builds missing thumbnails on demand, in its own cache directory; this command
+avoids that delay, and makes thumbnails part of the mapshot. As 'mapshot
+publish' skips mapshots already published, run it before publishing.
+
+Arguments are shots or save directories, as for 'mapshot publish'. Without
+arguments, all mapshots of the source are processed. Existing thumbnails are
+kept unless --force is given.
+`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		ctx := cmd.Context()
+		sourceLocation := flagThumbnailsSource
+		if sourceLocation == "" {
+			var err error
+			if sourceLocation, err = factorioSettings.ScriptOutput(); err != nil {
+				return err
+			}
+		}
+		store, err := storage.New(ctx, sourceLocation, s3Settings)
+		if err != nil {
+			return err
+		}
+		root := &serveRoot{location: sourceLocation, storage: store}
+
+		var locations []string
+		if len(args) == 0 {
+			shots, _, err := findShots(root)
+			if err != nil {
+				return err
+			}
+			for _, si := range shots {
+				locations = append(locations, si.location)
+			}
+		}
+		for _, arg := range args {
+			location, err := publishLocation(store, arg)
+			if err != nil {
+				return err
+			}
+			if isShotDir(store, location) || archivedShotDir(location) != "" {
+				locations = append(locations, location)
+				continue
+			}
+			l, err := saveShots(store, location)
+			if err != nil {
+				return err
+			}
+			locations = append(locations, l...)
+		}
+
+		t, err := newThumbnailer(flagThumbnailsSize, flagThumbnailsFormat, "")
+		if err != nil {
+			return err
+		}
+		count, failed := 0, 0
+		for _, location := range locations {
+			si, err := loadShot(root, location)
+			if err != nil {
+				return err
+			}
+			if si.status != shotComplete {
+				fmt.Printf("%s: skipped, render is not complete (%s)\n", location, si.status)
+				continue
+			}
+			for _, surface := range si.json.Surfaces {
+				l := thumbnailLocation(si, surface, t.format)
+				if _, err := store.Stat(l); err == nil && !flagThumbnailsForce {
+					continue
+				}
+				data, err := buildThumbnail(si, surface, t.size, t.format)
+				if err != nil {
+					// Keep going; other shots might be fine.
+					fmt.Printf("%s: unable to build thumbnail of %s: %v\n", location, surface.DisplayName(), err)
+					failed++
+					continue
+				}
+				if err := store.Put(ctx, l, bytes.NewReader(data), int64(len(data))); err != nil {
+					return fmt.Errorf("unable to write %s: %w", l, err)
+				}
+				fmt.Printf("%s: thumbnail of %s written\n", location, surface.DisplayName())
+				count++
+			}
+		}
+		fmt.Printf("%d thumbnails written\n", count)
+		if failed > 0 {
+			return fmt.Errorf("%d thumbnails could not be built", failed)
+		}
+		return nil
+	},
+}
+
+var (
+	flagThumbnailsSource string
+	flagThumbnailsForce  bool
+	flagThumbnailsSize   int
+	flagThumbnailsFormat string
+)
+
+func init() {
+	cmdThumbnails.PersistentFlags().StringVar(&flagThumbnailsSource, "source", "", "Where to find mapshots; a directory or s3://<bucket>/<prefix>. Defaults to Factorio script-output directory.")
+	cmdThumbnails.PersistentFlags().BoolVar(&flagThumbnailsForce, "force", false, "Rebuild thumbnails which already exist.")
+	cmdThumbnails.PersistentFlags().IntVar(&flagThumbnailsSize, "size", 512, "Maximum width and height of thumbnails, in pixels.")
+	cmdThumbnails.PersistentFlags().StringVar(&flagThumbnailsFormat, "format", imageJPEG, "Format of thumbnails: jpeg or png.")
+	cmdRoot.AddCommand(cmdThumbnails)
+}
@@ -0,0 +1,254 @@
+package cmd
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"io"
+)
+
+// Size, in pixels, of the tiles of TIFF images.
+const tiffTileSize = 256
+
+// Values of TIFF field types.
+const (
+	tiffShort = 3
+	tiffLong  = 4
+	tiffLong8 = 16
+)
+
+// tiledTIFF writes an RGB TIFF image split in tiles, so that it can be written
+// a few rows at a time without keeping the whole image in memory. Tiles are
+// compressed with Deflate. Images which might not fit in 4GiB are written as
+// BigTIFF.
+type tiledTIFF struct {
+	w             io.WriteSeeker
+	width, height int
+	big           bool
+	// Position in w.
+	pos int64
+	// Next row to write.
+	y int
+	// Location of each tile written so far, row by row.
+	offsets, counts []uint64
+
+	buf bytes.Buffer
+	zw  *zlib.Writer
+	raw []byte
+}
+
+func newTiledTIFF(w io.WriteSeeker, width, height int) (*tiledTIFF, error) {
+	// Compression should keep it smaller than raw pixels, but leave some
+	// margin.
+	return newTiledTIFFFormat(w, width, height, int64(width)*int64(height)*3 > 3<<30)
+}
+
+// newTiledTIFFFormat is like newTiledTIFF, with the choice of writing BigTIFF
+// or not.
+func newTiledTIFFFormat(w io.WriteSeeker, width, height int, big bool) (*tiledTIFF, error) {
+	t := &tiledTIFF{
+		w:      w,
+		width:  width,
+		height: height,
+		big:    big,
+		raw:    make([]byte, tiffTileSize*tiffTileSize*3),
+	}
+	t.zw = zlib.NewWriter(&t.buf)
+	// The header points to the directory describing the image, which is
+	// written at the end, once the location of tiles is known.
+	header := []byte{'I', 'I', 42, 0, 0, 0, 0, 0}
+	if t.big {
+		header = []byte{'I', 'I', 43, 0, 8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}
+	}
+	if err := t.write(header); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+func (t *tiledTIFF) write(b []byte) error {
+	n, err := t.w.Write(b)
+	t.pos += int64(n)
+	return err
+}
+
+// writeRows writes the next rows of the image. Except for the last rows of
+// the image, the number of rows must be a multiple of tiffTileSize.
+func (t *tiledTIFF) writeRows(img *image.RGBA) error {
+	b := img.Bounds()
+	if b.Min.Y != t.y || b.Min.X != 0 || b.Dx() != t.width || b.Max.Y > t.height {
+		return fmt.Errorf("unexpected rows %v; expected rows from %d", b, t.y)
+	}
+	if b.Max.Y != t.height && b.Dy()%tiffTileSize != 0 {
+		return fmt.Errorf("%d rows is not a multiple of the tile size", b.Dy())
+	}
+	for ty := b.Min.Y; ty < b.Max.Y; ty += tiffTileSize {
+		for tx := 0; tx < t.width; tx += tiffTileSize {
+			if err := t.writeTile(img, tx, ty); err != nil {
+				return err
+			}
+		}
+	}
+	t.y = b.Max.Y
+	return nil
+}
+
+// writeTile writes the tile with the given pixel as top left corner. Tiles
+// are padded with black on the right and bottom edges of the image.
+func (t *tiledTIFF) writeTile(img *image.RGBA, tx, ty int) error {
+	clear(t.raw)
+	b := img.Bounds()
+	for y := 0; y < tiffTileSize && ty+y < b.Max.Y; y++ {
+		row := t.raw[y*tiffTileSize*3 : (y+1)*tiffTileSize*3]
+		src := img.Pix[img.PixOffset(tx, ty+y):]
+		for x := 0; x < tiffTileSize && tx+x < b.Max.X; x++ {
+			row[x*3] = src[x*4]
+			row[x*3+1] = src[x*4+1]
+			row[x*3+2] = src[x*4+2]
+		}
+		// Horizontal differencing, which makes Deflate much more efficient
+		// on photographic content. Done from the end, as each sample is
+		// replaced by its difference with the previous one.
+		for i := len(row) - 1; i >= 3; i-- {
+			row[i] -= row[i-3]
+		}
+	}
+	t.buf.Reset()
+	t.zw.Reset(&t.buf)
+	if _, err := t.zw.Write(t.raw); err != nil {
+		return err
+	}
+	if err := t.zw.Close(); err != nil {
+		return err
+	}
+	t.offsets = append(t.offsets, uint64(t.pos))
+	t.counts = append(t.counts, uint64(t.buf.Len()))
+	return t.write(t.buf.Bytes())
+}
+
+// tiffField is an entry of a TIFF directory.
+type tiffField struct {
+	tag, typ uint16
+	count    uint64
+	// Values, encoded.
+	data []byte
+}
+
+func (t *tiledTIFF) shorts(tag uint16, values ...uint16) tiffField {
+	data := make([]byte, 2*len(values))
+	for i, v := range values {
+		binary.LittleEndian.PutUint16(data[2*i:], v)
+	}
+	return tiffField{tag: tag, typ: tiffShort, count: uint64(len(values)), data: data}
+}
+
+// longs encodes the values as LONG, or LONG8 for BigTIFF.
+func (t *tiledTIFF) longs(tag uint16, values ...uint64) tiffField {
+	if t.big {
+		data := make([]byte, 8*len(values))
+		for i, v := range values {
+			binary.LittleEndian.PutUint64(data[8*i:], v)
+		}
+		return tiffField{tag: tag, typ: tiffLong8, count: uint64(len(values)), data: data}
+	}
+	data := make([]byte, 4*len(values))
+	for i, v := range values {
+		binary.LittleEndian.PutUint32(data[4*i:], uint32(v))
+	}
+	return tiffField{tag: tag, typ: tiffLong, count: uint64(len(values)), data: data}
+}
+
+// close writes the directory describing the image. It does not close the
+// underlying writer.
+func (t *tiledTIFF) close() error {
+	if t.y != t.height {
+		return fmt.Errorf("only %d rows out of %d were written", t.y, t.height)
+	}
+	// Sorted by tag, as required.
+	fields := []tiffField{
+		t.longs(256, uint64(t.width)),  // ImageWidth
+		t.longs(257, uint64(t.height)), // ImageLength
+		t.shorts(258, 8, 8, 8),         // BitsPerSample
+		t.shorts(259, 8),               // Compression: Deflate
+		t.shorts(262, 2),               // PhotometricInterpretation: RGB
+		t.shorts(277, 3),               // SamplesPerPixel
+		t.shorts(284, 1),               // PlanarConfiguration: contiguous
+		t.shorts(317, 2),               // Predictor: horizontal differencing
+		t.shorts(322, tiffTileSize),    // TileWidth
+		t.shorts(323, tiffTileSize),    // TileLength
+		t.longs(324, t.offsets...),     // TileOffsets
+		t.longs(325, t.counts...),      // TileByteCounts
+	}
+
+	// Directories must start on a word boundary.
+	if t.pos%2 != 0 {
+		if err := t.write([]byte{0}); err != nil {
+			return err
+		}
+	}
+	ifdOffset := uint64(t.pos)
+	order := binary.LittleEndian
+	var ifd, extra []byte
+	// Sizes of the number of entries, of an entry and of an offset.
+	countSize, entrySize, inline := 2, 12, 4
+	if t.big {
+		countSize, entrySize, inline = 8, 20, 8
+		ifd = order.AppendUint64(ifd, uint64(len(fields)))
+	} else {
+		ifd = order.AppendUint16(ifd, uint16(len(fields)))
+	}
+	// Values which do not fit in an entry are written right after the
+	// directory, which ends with the offset of the next one.
+	extraOffset := ifdOffset + uint64(countSize+len(fields)*entrySize+inline)
+	for _, f := range fields {
+		ifd = order.AppendUint16(ifd, f.tag)
+		ifd = order.AppendUint16(ifd, f.typ)
+		value := make([]byte, inline)
+		if len(f.data) <= inline {
+			copy(value, f.data)
+		} else {
+			off := extraOffset + uint64(len(extra))
+			if t.big {
+				order.PutUint64(value, off)
+			} else {
+				order.PutUint32(value, uint32(off))
+			}
+			extra = append(extra, f.data...)
+			if len(extra)%2 != 0 {
+				extra = append(extra, 0)
+			}
+		}
+		if t.big {
+			ifd = order.AppendUint64(ifd, f.count)
+		} else {
+			ifd = order.AppendUint32(ifd, uint32(f.count))
+		}
+		ifd = append(ifd, value...)
+	}
+	// No other directory.
+	ifd = append(ifd, make([]byte, inline)...)
+	if err := t.write(ifd); err != nil {
+		return err
+	}
+	if err := t.write(extra); err != nil {
+		return err
+	}
+
+	// Point the header to the directory.
+	headerOffset := int64(4)
+	value := order.AppendUint32(nil, uint32(ifdOffset))
+	if t.big {
+		headerOffset = 8
+		value = order.AppendUint64(nil, ifdOffset)
+	}
+	if _, err := t.w.Seek(headerOffset, io.SeekStart); err != nil {
+		return err
+	}
+	if _, err := t.w.Write(value); err != nil {
+		return err
+	}
+	_, err := t.w.Seek(0, io.SeekEnd)
+	return err
+}
@@ -0,0 +1,273 @@
+package cmd
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"io"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/image/tiff"
+)
+
+// testTIFFImage returns an image with both smooth and noisy areas.
+func testTIFFImage(width, height int) *image.RGBA {
+	r := rand.New(rand.NewPCG(1, 2))
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			i := img.PixOffset(x, y)
+			img.Pix[i] = uint8(x)
+			img.Pix[i+1] = uint8(y)
+			img.Pix[i+2] = uint8(r.IntN(256))
+			img.Pix[i+3] = 255
+		}
+	}
+	return img
+}
+
+// writeTestTIFF writes the image, a few rows at a time, and returns the
+// content of the file.
+func writeTestTIFF(t *testing.T, img *image.RGBA, rows int, big bool) []byte {
+	t.Helper()
+	f, err := os.Create(filepath.Join(t.TempDir(), "test.tiff"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	b := img.Bounds()
+	tt, err := newTiledTIFFFormat(f, b.Dx(), b.Dy(), big)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for y := 0; y < b.Dy(); y += rows {
+		if err := tt.writeRows(img.SubImage(image.Rect(0, y, b.Dx(), min(y+rows, b.Dy()))).(*image.RGBA)); err != nil {
+			t.Fatalf("writeRows(%d) failed: %v", y, err)
+		}
+	}
+	if err := tt.close(); err != nil {
+		t.Fatalf("close() failed: %v", err)
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	data, err := io.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// readTestTIFFFields reads the fields of the first directory of a little
+// endian TIFF or BigTIFF file, as unsigned integers.
+func readTestTIFFFields(data []byte) (map[uint16][]uint64, bool, error) {
+	order := binary.LittleEndian
+	if len(data) < 16 || string(data[:2]) != "II" {
+		return nil, false, fmt.Errorf("invalid header %q", data[:min(len(data), 16)])
+	}
+	big := order.Uint16(data[2:]) == 43
+	countSize, entrySize, inline := 2, 12, 4
+	offset := uint64(order.Uint32(data[4:]))
+	if big {
+		countSize, entrySize, inline = 8, 20, 8
+		offset = order.Uint64(data[8:])
+	}
+	if offset%2 != 0 || offset+uint64(countSize) > uint64(len(data)) {
+		return nil, big, fmt.Errorf("invalid directory offset %d", offset)
+	}
+	count := uint64(order.Uint16(data[offset:]))
+	if big {
+		count = order.Uint64(data[offset:])
+	}
+	fields := map[uint16][]uint64{}
+	for i := uint64(0); i < count; i++ {
+		entry := data[offset+uint64(countSize)+i*uint64(entrySize):]
+		tag, typ := order.Uint16(entry), order.Uint16(entry[2:])
+		n := uint64(order.Uint32(entry[4:]))
+		value := entry[8:]
+		if big {
+			n = order.Uint64(entry[4:])
+			value = entry[12:]
+		}
+		size := map[uint16]uint64{tiffShort: 2, tiffLong: 4, tiffLong8: 8}[typ]
+		if size == 0 {
+			return nil, big, fmt.Errorf("tag %d: unexpected type %d", tag, typ)
+		}
+		if n*size > uint64(inline) {
+			off := uint64(order.Uint32(value))
+			if big {
+				off = order.Uint64(value)
+			}
+			value = data[off:]
+		}
+		for j := uint64(0); j < n; j++ {
+			switch size {
+			case 2:
+				fields[tag] = append(fields[tag], uint64(order.Uint16(value[2*j:])))
+			case 4:
+				fields[tag] = append(fields[tag], uint64(order.Uint32(value[4*j:])))
+			default:
+				fields[tag] = append(fields[tag], order.Uint64(value[8*j:]))
+			}
+		}
+	}
+	return fields, big, nil
+}
+
+// decodeTestTIFFTiles decodes the tiles as written by tiledTIFF; that
+// supports BigTIFF, unlike golang.org/x/image/tiff.
+func decodeTestTIFFTiles(fields map[uint16][]uint64, data []byte) (*image.RGBA, error) {
+	width, height := int(fields[256][0]), int(fields[257][0])
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	across := (width + tiffTileSize - 1) / tiffTileSize
+	offsets, counts := fields[324], fields[325]
+	for i, off := range offsets {
+		zr, err := zlib.NewReader(bytes.NewReader(data[off : off+counts[i]]))
+		if err != nil {
+			return nil, fmt.Errorf("tile %d: %w", i, err)
+		}
+		raw, err := io.ReadAll(zr)
+		if err != nil {
+			return nil, fmt.Errorf("tile %d: %w", i, err)
+		}
+		if len(raw) != tiffTileSize*tiffTileSize*3 {
+			return nil, fmt.Errorf("tile %d: %d bytes", i, len(raw))
+		}
+		tx, ty := (i%across)*tiffTileSize, (i/across)*tiffTileSize
+		for y := 0; y < tiffTileSize; y++ {
+			row := raw[y*tiffTileSize*3 : (y+1)*tiffTileSize*3]
+			for j := 3; j < len(row); j++ {
+				row[j] += row[j-3]
+			}
+			for x := 0; x < tiffTileSize; x++ {
+				if !(image.Point{tx + x, ty + y}.In(img.Bounds())) {
+					if row[3*x] != 0 || row[3*x+1] != 0 || row[3*x+2] != 0 {
+						return nil, fmt.Errorf("tile %d: padding at %d,%d is not black", i, x, y)
+					}
+					continue
+				}
+				p := img.PixOffset(tx+x, ty+y)
+				copy(img.Pix[p:p+3], row[3*x:3*x+3])
+				img.Pix[p+3] = 255
+			}
+		}
+	}
+	return img, nil
+}
+
+// comparePixels returns an error describing the first pixel which differs.
+func comparePixels(got, want image.Image) error {
+	if got.Bounds() != want.Bounds() {
+		return fmt.Errorf("bounds are %v, want %v", got.Bounds(), want.Bounds())
+	}
+	b := want.Bounds()
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			if g, w := got.At(x, y), want.At(x, y); g != w {
+				return fmt.Errorf("pixel %d,%d is %v, want %v", x, y, g, w)
+			}
+		}
+	}
+	return nil
+}
+
+func TestTiledTIFF(t *testing.T) {
+	tests := []struct {
+		desc          string
+		width, height int
+		// Rows written at once.
+		rows int
+		big  bool
+	}{
+		{desc: "single tile", width: 100, height: 60, rows: tiffTileSize},
+		{desc: "exact tiles", width: 2 * tiffTileSize, height: tiffTileSize, rows: tiffTileSize},
+		{desc: "partial tiles", width: 300, height: 520, rows: tiffTileSize},
+		{desc: "all rows at once", width: 300, height: 520, rows: 520},
+		{desc: "BigTIFF", width: 300, height: 520, rows: tiffTileSize, big: true},
+	}
+	for _, tc := range tests {
+		t.Run(tc.desc, func(t *testing.T) {
+			img := testTIFFImage(tc.width, tc.height)
+			data := writeTestTIFF(t, img, tc.rows, tc.big)
+
+			fields, big, err := readTestTIFFFields(data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if big != tc.big {
+				t.Errorf("BigTIFF = %v, want %v", big, tc.big)
+			}
+			tiles := ((tc.width + tiffTileSize - 1) / tiffTileSize) * ((tc.height + tiffTileSize - 1) / tiffTileSize)
+			if len(fields[324]) != tiles || len(fields[325]) != tiles {
+				t.Errorf("%d tile offsets and %d byte counts, want %d", len(fields[324]), len(fields[325]), tiles)
+			}
+			got, err := decodeTestTIFFTiles(fields, data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := comparePixels(got, img); err != nil {
+				t.Error(err)
+			}
+
+			if tc.big {
+				return
+			}
+			decoded, err := tiff.Decode(bytes.NewReader(data))
+			if err != nil {
+				t.Fatalf("tiff.Decode() failed: %v", err)
+			}
+			if err := comparePixels(decoded, img); err != nil {
+				t.Errorf("tiff.Decode(): %v", err)
+			}
+		})
+	}
+}
+
+func TestTiledTIFFErrors(t *testing.T) {
+	img := testTIFFImage(300, 520)
+	rows := func(y0, y1 int) *image.RGBA {
+		return img.SubImage(image.Rect(0, y0, 300, y1)).(*image.RGBA)
+	}
+	tests := []struct {
+		desc string
+		// Rows successfully written before.
+		before []*image.RGBA
+		rows   *image.RGBA
+	}{
+		{desc: "not the first rows", rows: rows(tiffTileSize, 2*tiffTileSize)},
+		{desc: "rows written twice", before: []*image.RGBA{rows(0, tiffTileSize)}, rows: rows(0, tiffTileSize)},
+		{desc: "not a multiple of the tile size", rows: rows(0, 100)},
+		{desc: "partial width", rows: img.SubImage(image.Rect(0, 0, 200, tiffTileSize)).(*image.RGBA)},
+		{desc: "beyond the image", rows: testTIFFImage(300, 3*tiffTileSize)},
+	}
+	for _, tc := range tests {
+		t.Run(tc.desc, func(t *testing.T) {
+			f, err := os.Create(filepath.Join(t.TempDir(), "test.tiff"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer f.Close()
+			tt, err := newTiledTIFF(f, 300, 520)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, r := range tc.before {
+				if err := tt.writeRows(r); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := tt.writeRows(tc.rows); err == nil {
+				t.Errorf("writeRows(%v) succeeded, want error", tc.rows.Bounds())
+			}
+			// The image is incomplete.
+			if err := tt.close(); err == nil {
+				t.Errorf("close() succeeded, want error")
+			}
+		})
+	}
+}
@@ -0,0 +1,143 @@
+package cmd
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// certCheckInterval is how often the certificate files are checked for
+// changes.
+const certCheckInterval = 10 * time.Second
+
+// certReloader provides the TLS certificate, reloading it when its files
+// change - e.g., when renewed by certbot.
+type certReloader struct {
+	certFile, keyFile string
+
+	m    sync.Mutex
+	cert *tls.Certificate
+	// Modification time & size of the files when last loaded.
+	stamp string
+}
+
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	r := &certReloader{
+		certFile: certFile,
+		keyFile:  keyFile,
+	}
+	if err := r.reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// fileStamp summarizes the state of the files, to detect changes.
+func fileStamp(filenames ...string) (string, error) {
+	stamp := ""
+	for _, filename := range filenames {
+		info, err := os.Stat(filename)
+		if err != nil {
+			return "", err
+		}
+		stamp += fmt.Sprintf("%s:%d:%d;", filename, info.ModTime().UnixNano(), info.Size())
+	}
+	return stamp, nil
+}
+
+// reload loads the certificate if the files changed since last time. On error,
+// the previous certificate is kept.
+func (r *certReloader) reload() error {
+	stamp, err := fileStamp(r.certFile, r.keyFile)
+	if err != nil {
+		return err
+	}
+	r.m.Lock()
+	unchanged := stamp == r.stamp
+	r.m.Unlock()
+	if unchanged {
+		return nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return fmt.Errorf("unable to load TLS certificate: %w", err)
+	}
+	r.m.Lock()
+	defer r.m.Unlock()
+	if r.cert != nil {
+		slog.Info("TLS certificate reloaded", "file", r.certFile)
+	}
+	r.cert = &cert
+	r.stamp = stamp
+	return nil
+}
+
+// watch regularly checks for changes of the certificate files.
+func (r *certReloader) watch() {
+	for range time.Tick(certCheckInterval) {
+		if err := r.reload(); err != nil {
+			// Files might be in the middle of being replaced; try again later.
+			slog.Error("unable to reload TLS certificate", "err", err)
+		}
+	}
+}
+
+func (r *certReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.m.Lock()
+	defer r.m.Unlock()
+	return r.cert, nil
+}
+
+// tlsConfig builds the TLS configuration from the flags.
+func tlsConfig() (*tls.Config, error) {
+	if flagServeTLSKey == "" {
+		return nil, fmt.Errorf("--tls_cert requires --tls_key")
+	}
+	reloader, err := newCertReloader(flagServeTLSCert, flagServeTLSKey)
+	if err != nil {
+		return nil, err
+	}
+	go reloader.watch()
+
+	cfg := &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: reloader.getCertificate,
+	}
+	if flagServeTLSClientCA != "" {
+		raw, err := ioutil.ReadFile(flagServeTLSClientCA)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read client CA: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(raw) {
+			return nil, fmt.Errorf("no certificate found in %s", flagServeTLSClientCA)
+		}
+		cfg.ClientCAs = pool
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return cfg, nil
+}
+
+// redirectToHTTPS sends all requests to the HTTPS server.
+func redirectToHTTPS(httpsPort int) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		host := req.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if httpsPort != 443 {
+			host = net.JoinHostPort(host, strconv.Itoa(httpsPort))
+		}
+		target := "https://" + host + req.URL.RequestURI()
+		http.Redirect(w, req, target, http.StatusMovedPermanently)
+	})
+}
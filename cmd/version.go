@@ -2,9 +2,9 @@ package cmd
 
 import (
 	"fmt"
+	"log/slog"
 
 	"github.com/Palats/mapshot/embed"
-	"github.com/golang/glog"
 	"github.com/spf13/cobra"
 )
 
@@ -14,7 +14,7 @@ var cmdVersion = &cobra.Command{
 	Args:  cobra.NoArgs,
 	Run: func(cmd *cobra.Command, args []string) {
 		fmt.Println(embed.Version)
-		glog.Infof("Version hash: %s", embed.VersionHash)
+		slog.Info("version", "hash", embed.VersionHash)
 	},
 }
 
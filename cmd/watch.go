@@ -0,0 +1,244 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"time"
+
+	"github.com/Palats/mapshot/shot"
+	"github.com/fsnotify/fsnotify"
+)
+
+// watchDebounce is how long to wait for a quiet period before processing
+// filesystem changes. That avoids reading a mapshot.json which is still being
+// written.
+const watchDebounce = 500 * time.Millisecond
+
+// watchMaxDelay is the longest time changes wait to be processed, even when
+// there is no quiet period - e.g., while a shot is being written.
+const watchMaxDelay = 5 * time.Second
+
+// shotWatcher uses filesystem notifications (inotify on Linux) to keep a shot
+// index up to date.
+//
+// Watches are put on all directories of the base directory, except for the
+// content of shots themselves - their mapshot.json is written before any of
+// the tiles, and the tile directories are not relevant for discovery. Shots
+// are reloaded when their mapshot.json or manifests change.
+type shotWatcher struct {
+	root *serveRoot
+	// Local directory of the root.
+	baseDir string
+	idx     *shotIndex
+	watcher *fsnotify.Watcher
+
+	// Paths which have seen changes and are waiting to be processed.
+	pending map[string]bool
+}
+
+func newShotWatcher(root *serveRoot, baseDir string, idx *shotIndex) (*shotWatcher, error) {
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, fmt.Errorf("unable to create filesystem watcher: %w", err)
+	}
+	return &shotWatcher{
+		root:    root,
+		baseDir: baseDir,
+		idx:     idx,
+		watcher: w,
+		pending: map[string]bool{},
+	}, nil
+}
+
+// scan puts watches on the whole base directory, and returns the shots found
+// while doing so, as findShots does. That way, the initial scan of the root
+// does not need another walk of the directories. The watcher must be closed
+// on error.
+func (sw *shotWatcher) scan() ([]*shotInfo, int, error) {
+	var shots []*shotInfo
+	failed := 0
+	err := sw.addTree(sw.baseDir, func(location string) {
+		shot, err := loadShot(sw.root, location)
+		if err != nil {
+			slog.Error("unable to load mapshot", "root", sw.root.name, "location", location, "err", err)
+			failed++
+			return
+		}
+		shots = append(shots, shot)
+	})
+	if err != nil {
+		return nil, failed, err
+	}
+	return shots, failed, nil
+}
+
+// close releases the watches, for watchers which are not run.
+func (sw *shotWatcher) close() error {
+	return sw.watcher.Close()
+}
+
+// addTree puts watches on dir and its subdirectories, skipping the content of
+// shots. found is called with the location of the shots seen while doing so.
+func (sw *shotWatcher) addTree(dir string, found func(location string)) error {
+	return filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				// Directory might have been removed in between.
+				return nil
+			}
+			return err
+		}
+		location := sw.location(path)
+		if !info.IsDir() {
+			if d := archivedShotDir(location); d != "" && !isShotDir(sw.root.storage, d) {
+				found(location)
+			}
+			return nil
+		}
+		if err := sw.watcher.Add(path); err != nil {
+			return fmt.Errorf("unable to watch %s: %w", path, err)
+		}
+		if isShotDir(sw.root.storage, location) {
+			found(location)
+			return filepath.SkipDir
+		}
+		return nil
+	})
+}
+
+// location converts a filesystem path to a location in the storage of the
+// root.
+func (sw *shotWatcher) location(p string) string {
+	rel, err := filepath.Rel(sw.baseDir, p)
+	if err != nil {
+		// Cannot happen: all watched paths are within the base directory.
+		slog.Error("unable to get relative path", "path", p, "err", err)
+		return p
+	}
+	return filepath.ToSlash(rel)
+}
+
+// key returns the index key of the shot at the given location.
+func (sw *shotWatcher) key(location string) string {
+	return path.Join(sw.root.name, location)
+}
+
+// loadShot reads the shot at the given location and updates the index.
+//
+// The directory of a shot takes precedence over its archives, which are
+// dropped once the directory is in the index. As both are served under the
+// same name, doing it in that order does not announce the shot as removed.
+func (sw *shotWatcher) loadShot(location string) {
+	shot, err := loadShot(sw.root, location)
+	if err != nil {
+		slog.Error("unable to load shot", "root", sw.root.name, "location", location, "err", err)
+		return
+	}
+	slog.Info("shot updated", "shot", shot.name)
+	sw.idx.put(shot)
+	if archivedShotDir(location) == "" {
+		for _, archive := range shotArchives(sw.root.storage, location) {
+			sw.idx.remove(sw.key(archive))
+		}
+	}
+}
+
+// process handles a single changed path.
+func (sw *shotWatcher) process(p string) {
+	location := sw.location(p)
+	info, err := os.Stat(p)
+	if errors.Is(err, os.ErrNotExist) {
+		if isShotManifest(location) && isShotDir(sw.root.storage, path.Dir(location)) {
+			sw.loadShot(path.Dir(location))
+			return
+		}
+		if path.Base(location) == shot.Filename {
+			location = path.Dir(location)
+		}
+		// The shot might have been replaced by an archive; it is loaded
+		// first for the same reason as in loadShot.
+		for _, archive := range shotArchives(sw.root.storage, location) {
+			sw.loadShot(archive)
+		}
+		sw.idx.remove(sw.key(location))
+		return
+	}
+	if err != nil {
+		slog.Error("unable to stat", "path", p, "err", err)
+		return
+	}
+
+	if !info.IsDir() {
+		if path.Base(location) == shot.Filename {
+			sw.loadShot(path.Dir(location))
+		} else if isShotManifest(location) && isShotDir(sw.root.storage, path.Dir(location)) {
+			// Manifests are only read once per loaded shot.
+			sw.loadShot(path.Dir(location))
+		} else if d := archivedShotDir(location); d != "" && !isShotDir(sw.root.storage, d) {
+			sw.loadShot(location)
+		}
+		return
+	}
+	// Directories created within a shot (e.g., tiles) are not interesting.
+	if sw.idx.isShot(sw.key(path.Dir(location))) {
+		return
+	}
+	// Shots might have been created before the watches were in place.
+	if err := sw.addTree(p, sw.loadShot); err != nil {
+		slog.Error("unable to watch new directory", "err", err)
+	}
+}
+
+// run processes filesystem events until the context is cancelled.
+func (sw *shotWatcher) run(ctx context.Context) {
+	defer sw.watcher.Close()
+
+	// flush fires after a quiet period; deadline bounds how long the first
+	// pending change waits.
+	var flush, deadline <-chan time.Time
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case ev, ok := <-sw.watcher.Events:
+			if !ok {
+				return
+			}
+			slog.Debug("filesystem event", "event", ev.String())
+			if ev.Op == fsnotify.Chmod {
+				continue
+			}
+			sw.pending[ev.Name] = true
+			flush = time.After(watchDebounce)
+			if deadline == nil {
+				deadline = time.After(watchMaxDelay)
+			}
+		case err, ok := <-sw.watcher.Errors:
+			if !ok {
+				return
+			}
+			// Typically happens on queue overflow, which means some events were
+			// lost. The periodic rescan will catch up.
+			slog.Error("filesystem watcher error", "err", err)
+		case <-flush:
+			sw.flush()
+			flush, deadline = nil, nil
+		case <-deadline:
+			sw.flush()
+			flush, deadline = nil, nil
+		}
+	}
+}
+
+// flush processes the pending changes.
+func (sw *shotWatcher) flush() {
+	for path := range sw.pending {
+		sw.process(path)
+	}
+	sw.pending = map[string]bool{}
+}
@@ -0,0 +1,234 @@
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"image/color"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/Palats/mapshot/shot"
+	"github.com/Palats/mapshot/storage"
+)
+
+// startTestWatcher scans the root and watches it until the end of the test.
+func startTestWatcher(t *testing.T, root *serveRoot, dir string, idx *shotIndex) {
+	t.Helper()
+	sw, err := newShotWatcher(root, dir, idx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	shots, failed, err := sw.scan()
+	if err != nil || failed > 0 {
+		sw.close()
+		t.Fatalf("scan() = %d failed, %v", failed, err)
+	}
+	idx.reset(root.name, shots)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		sw.run(ctx)
+		close(done)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+}
+
+// waitFor waits until cond is true, failing the test after a while.
+func waitFor(t *testing.T, desc string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", desc)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+// collectEvents waits for the watcher to process pending changes, and returns
+// the events received meanwhile.
+func collectEvents(ch chan shotEvent) []string {
+	time.Sleep(watchDebounce + 300*time.Millisecond)
+	return drainEvents(ch)
+}
+
+func TestShotWatcher(t *testing.T) {
+	root, dir := newTestRoot(t)
+	// Found by the initial scan.
+	writeTestShot(t, dir, "save/d-1", 100, shot.StatusComplete)
+
+	idx := newShotIndex(false, nil, nil)
+	events := idx.events.subscribe()
+	startTestWatcher(t, root, dir, idx)
+	if got, want := drainEvents(events), []string{"shot-added save save/d-1", "latest-changed save save/d-1"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("events of the initial scan = %q, want %q", got, want)
+	}
+
+	steps := []struct {
+		desc string
+		do   func()
+		// Shot which must be in the index once done.
+		waitKey string
+		// Shot which must not be in the index once done.
+		waitNoKey string
+
+		wantEvents []string
+		wantLatest map[string]string
+	}{
+		{
+			desc:       "render started",
+			do:         func() { writeTestShot(t, dir, "save/d-2", 200, shot.StatusInProgress) },
+			waitKey:    "save/d-2",
+			wantLatest: map[string]string{"save": "save/d-1"},
+		},
+		{
+			desc:       "render completed",
+			do:         func() { writeTestShot(t, dir, "save/d-2", 200, shot.StatusComplete) },
+			waitKey:    "save/d-2",
+			wantEvents: []string{"shot-added save save/d-2", "latest-changed save save/d-2"},
+			wantLatest: map[string]string{"save": "save/d-2"},
+		},
+		{
+			desc:       "new save directory",
+			do:         func() { writeTestShot(t, dir, "other/sub/d-3", 10, shot.StatusComplete) },
+			waitKey:    "other/sub/d-3",
+			wantEvents: []string{"shot-added other/sub other/sub/d-3", "latest-changed other/sub other/sub/d-3"},
+			wantLatest: map[string]string{"save": "save/d-2", "other/sub": "other/sub/d-3"},
+		},
+		{
+			desc:       "archive",
+			do:         func() { writeTestShotArchive(t, dir, "save/d-4.zip", 300) },
+			waitKey:    "save/d-4.zip",
+			wantEvents: []string{"shot-added save save/d-4", "latest-changed save save/d-4"},
+			wantLatest: map[string]string{"save": "save/d-4", "other/sub": "other/sub/d-3"},
+		},
+		{
+			// The directory takes precedence; it is served at the same URL.
+			desc:       "archive extracted",
+			do:         func() { writeTestShot(t, dir, "save/d-4", 300, shot.StatusComplete) },
+			waitKey:    "save/d-4",
+			waitNoKey:  "save/d-4.zip",
+			wantLatest: map[string]string{"save": "save/d-4", "other/sub": "other/sub/d-3"},
+		},
+		{
+			// The archive is used again.
+			desc: "extracted directory removed",
+			do: func() {
+				if err := os.RemoveAll(filepath.Join(dir, "save", "d-4")); err != nil {
+					t.Fatal(err)
+				}
+			},
+			waitKey:    "save/d-4.zip",
+			waitNoKey:  "save/d-4",
+			wantLatest: map[string]string{"save": "save/d-4", "other/sub": "other/sub/d-3"},
+		},
+		{
+			desc: "archive removed",
+			do: func() {
+				if err := os.Remove(filepath.Join(dir, "save", "d-4.zip")); err != nil {
+					t.Fatal(err)
+				}
+			},
+			waitNoKey:  "save/d-4.zip",
+			wantEvents: []string{"shot-removed save save/d-4", "latest-changed save save/d-2"},
+			wantLatest: map[string]string{"save": "save/d-2", "other/sub": "other/sub/d-3"},
+		},
+		{
+			desc: "save directory removed",
+			do: func() {
+				if err := os.RemoveAll(filepath.Join(dir, "other")); err != nil {
+					t.Fatal(err)
+				}
+			},
+			waitNoKey:  "other/sub/d-3",
+			wantEvents: []string{"shot-removed other/sub other/sub/d-3", "latest-changed other/sub"},
+			wantLatest: map[string]string{"save": "save/d-2"},
+		},
+	}
+	for _, step := range steps {
+		step.do()
+		if step.waitKey != "" {
+			waitFor(t, step.desc, func() bool { return idx.isShot(step.waitKey) })
+		}
+		if step.waitNoKey != "" {
+			waitFor(t, step.desc, func() bool { return !idx.isShot(step.waitNoKey) })
+		}
+		if got := collectEvents(events); !reflect.DeepEqual(got, step.wantEvents) {
+			t.Errorf("%s: events = %q, want %q", step.desc, got, step.wantEvents)
+		}
+		if _, latest := indexState(idx); !reflect.DeepEqual(latest, step.wantLatest) {
+			t.Errorf("%s: latest shots = %q, want %q", step.desc, latest, step.wantLatest)
+		}
+	}
+}
+
+// TestShotWatcherManifests checks that the manifests of a shot, which are read
+// once per loaded shot, are read again when they change.
+func TestShotWatcherManifests(t *testing.T) {
+	ctx := context.Background()
+	root, dir := newTestRoot(t)
+	store := root.storage.(storage.Writable)
+	writeTestShot(t, dir, "save/d-1", 100, shot.StatusComplete)
+	const (
+		existing = "s1zoom_0/tile_0_0.jpg"
+		missing  = "s1zoom_0/tile_-1_-1.jpg"
+		uniform  = "s1zoom_0/tile_-1_0.jpg"
+	)
+	if err := store.Put(ctx, "save/d-1/"+existing, bytes.NewReader([]byte("jpg")), 3); err != nil {
+		t.Fatal(err)
+	}
+
+	idx := newShotIndex(false, nil, nil)
+	startTestWatcher(t, root, dir, idx)
+	current := func() *shotInfo {
+		idx.m.Lock()
+		defer idx.m.Unlock()
+		return idx.shots["save/d-1"]
+	}
+	si := current()
+	if si == nil {
+		t.Fatal("shot not found by the initial scan")
+	}
+	// Without manifests; that also reads them.
+	if si.tileMissing(missing) {
+		t.Errorf("tileMissing(%q) = true without manifest, want false", missing)
+	}
+	if _, ok := si.uniformTile(uniform); ok {
+		t.Errorf("uniformTile(%q) found without manifest", uniform)
+	}
+
+	if _, err := writeTilesManifest(ctx, si); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "tiles manifest", func() bool { return current().tileMissing(missing) })
+	if current().tileMissing(existing) {
+		t.Errorf("tileMissing(%q) = true, want false", existing)
+	}
+
+	raw := []byte(`{"tiles": {"` + uniform + `": "#102030"}}`)
+	if err := store.Put(ctx, "save/d-1/s1zoom_uniform.json", bytes.NewReader(raw), int64(len(raw))); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "pruned tiles manifest", func() bool {
+		_, ok := current().uniformTile(uniform)
+		return ok
+	})
+	want := uniformTile{color: color.RGBA{0x10, 0x20, 0x30, 0xff}, size: 16}
+	if got, _ := current().uniformTile(uniform); got != want {
+		t.Errorf("uniformTile(%q) = %+v, want %+v", uniform, got, want)
+	}
+
+	if err := store.Remove(ctx, "save/d-1/s1zoom_uniform.json"); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "removed pruned tiles manifest", func() bool {
+		_, ok := current().uniformTile(uniform)
+		return !ok
+	})
+}
@@ -9,13 +9,13 @@ import (
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"log/slog"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"runtime"
 	"strings"
 
-	"github.com/golang/glog"
 	"github.com/mitchellh/go-homedir"
 	"github.com/otiai10/copy"
 	"github.com/spf13/pflag"
@@ -42,7 +42,7 @@ type Factorio struct {
 func New(s *Settings) (*Factorio, error) {
 	datadir := s.DataDir()
 	if datadir == "" {
-		return nil, fmt.Errorf("no factorio data dir found; use --alsologtostderr for more info and --%sdatadir to specify its location", s.flagPrefix)
+		return nil, fmt.Errorf("no factorio data dir found; use --log_level=info for more info and --%sdatadir to specify its location", s.flagPrefix)
 	}
 	scriptOutput, err := s.ScriptOutput()
 	if err != nil {
@@ -107,13 +107,13 @@ func (f *Factorio) FindSaveFile(name string) (string, error) {
 	for _, c := range candidates {
 		_, err := os.Stat(c)
 		if err == nil {
-			glog.Infof("Looking for save %q; %s exists.", name, c)
+			slog.Info("looking for save: found", "save", name, "path", c)
 			return c, nil
 		}
 		if !os.IsNotExist(err) {
 			return "", nil
 		}
-		glog.Infof("Looking for save %q; %s does not exists.", name, c)
+		slog.Info("looking for save: does not exist", "save", name, "path", c)
 	}
 	return "", os.ErrNotExist
 }
@@ -121,7 +121,7 @@ func (f *Factorio) FindSaveFile(name string) (string, error) {
 // Run factorio.
 func (f *Factorio) Run(ctx context.Context, args []string) error {
 	args = append(append([]string{}, args...), f.extraArgs...)
-	glog.Infof("Running factorio with args: %v", args)
+	slog.Info("running factorio", "binary", f.binary, "args", args)
 	cmd := exec.Command(f.binary, args...)
 	if f.verbose {
 		cmd.Stdout = os.Stdout
@@ -134,9 +134,9 @@ func (f *Factorio) Run(ctx context.Context, args []string) error {
 			return
 		case <-ctx.Done():
 			if f.keepRunning {
-				glog.Infof("interrupt requested, but keep_running specified")
+				slog.Info("interrupt requested, but keep_running specified")
 			} else {
-				glog.Infof("interrupt requested")
+				slog.Info("interrupt requested")
 				if runtime.GOOS == "windows" {
 					// On Windows, os.Interrupt is a no-op, so be a bit more direct.
 					cmd.Process.Signal(os.Kill)
@@ -148,7 +148,7 @@ func (f *Factorio) Run(ctx context.Context, args []string) error {
 	}()
 	err := cmd.Run()
 	close(done)
-	glog.Infof("Factorio returned: %v", err)
+	slog.Info("factorio returned", "err", err)
 	return err
 }
 
@@ -180,10 +180,10 @@ func (f *Factorio) CopyMods(dstMods string, filterOut []string) error {
 		if idx := strings.LastIndex(modName, "_"); idx >= 0 {
 			modName = modName[:idx]
 		}
-		glog.Infof("copying mod %s from %s to %s", modName, src, dst)
+		slog.Info("copying mod", "mod", modName, "src", src, "dst", dst)
 
 		if filtered[modName] {
-			glog.Infof("ignoring mod file %q", src)
+			slog.Info("ignoring mod file", "path", src)
 			continue
 		}
 		// Fiddle with the mod list to remove filtered mods.
@@ -203,7 +203,7 @@ func (f *Factorio) CopyMods(dstMods string, filterOut []string) error {
 			if err := mlist.Write(dst); err != nil {
 				return err
 			}
-			glog.Infof("created mod-list.json")
+			slog.Info("created mod-list.json", "path", dst)
 			foundModList = true
 			continue
 		}
@@ -213,7 +213,7 @@ func (f *Factorio) CopyMods(dstMods string, filterOut []string) error {
 		if err != nil {
 			return fmt.Errorf("unable to copy %q to %q: %w", src, dst, err)
 		}
-		glog.Infof("copied mod file %q to %q", src, dst)
+		slog.Info("copied mod file", "src", src, "dst", dst)
 	}
 
 	if !foundModList {
@@ -267,26 +267,26 @@ func (s *Settings) DataDir() string {
 	for _, c := range candidates {
 		s, err := homedir.Expand(c)
 		if err != nil {
-			glog.Infof("Unable to expand %s: %v", c, err)
+			slog.Info("unable to expand path", "path", c, "err", err)
 			continue
 		}
 		info, err := os.Stat(s)
 		if os.IsNotExist(err) {
-			glog.Infof("Path %s does not exists, skipped", s)
+			slog.Info("path does not exist, skipped", "path", s)
 			continue
 		}
 		if !info.IsDir() {
-			glog.Infof("Path %s is a file, skipped", s)
+			slog.Info("path is a file, skipped", "path", s)
 			continue
 		}
-		glog.Infof("Found factorio data dir: %s", s)
+		slog.Info("found factorio data dir", "path", s)
 		match = s
 	}
 	if match == "" {
-		glog.Infof("No Factorio data dir found")
+		slog.Info("no factorio data dir found")
 		return ""
 	}
-	glog.Infof("Using Factorio data dir: %s", match)
+	slog.Info("using factorio data dir", "path", match)
 	return match
 }
 
@@ -295,7 +295,7 @@ func (s *Settings) ScriptOutput() (string, error) {
 	if s.scriptOutput == "" {
 		dataDir := s.DataDir()
 		if dataDir == "" {
-			return "", fmt.Errorf("no factorio data dir found; use --alsologtostderr for more info; use --%sscriptoutput to specify directly the script-output location", s.flagPrefix)
+			return "", fmt.Errorf("no factorio data dir found; use --log_level=info for more info; use --%sscriptoutput to specify directly the script-output location", s.flagPrefix)
 		}
 		// Don't check extra subpath when using the default script-output
 		// location - Factorio might not have created it by default, and not
@@ -341,26 +341,26 @@ func (s *Settings) Binary() (string, error) {
 	for _, c := range candidates {
 		s, err := homedir.Expand(c)
 		if err != nil {
-			glog.Infof("Unable to expand %s: %v", c, err)
+			slog.Info("unable to expand path", "path", c, "err", err)
 			continue
 		}
 		info, err := os.Stat(s)
 		if os.IsNotExist(err) {
-			glog.Infof("Path %s does not exists, skipped", s)
+			slog.Info("path does not exist, skipped", "path", s)
 			continue
 		}
 		if info.IsDir() {
-			glog.Infof("Path %s is a directory, skipped", s)
+			slog.Info("path is a directory, skipped", "path", s)
 			continue
 		}
-		glog.Infof("Factorio binary found: %s", s)
+		slog.Info("found factorio binary", "path", s)
 		match = s
 	}
 	if match == "" {
-		glog.Infof("No factorio binary found")
-		return "", fmt.Errorf("no factorio binary found; use --alsologtostderr for more info and --%sbinary to specify its location", s.flagPrefix)
+		slog.Info("no factorio binary found")
+		return "", fmt.Errorf("no factorio binary found; use --log_level=info for more info and --%sbinary to specify its location", s.flagPrefix)
 	}
-	glog.Infof("Using Factorio binary: %s", match)
+	slog.Info("using factorio binary", "path", match)
 	return match, nil
 }
 
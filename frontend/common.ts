@@ -46,6 +46,8 @@ export interface FactorioTag {
     text: string,
 }
 
+// Content of mapshot.json. The Go equivalent is in shot/shot.go, and the JSON
+// Schema in shot/mapshot.schema.json - keep them in sync.
 export interface MapshotJSON {
     // A unique ID generated for this render.
     unique_id: string,
@@ -66,6 +68,14 @@ export interface MapshotJSON {
 
     // Rendering info per surface.
     surfaces: MapshotSurfaceJSON[];
+
+    // JPEG quality of the rendered tiles. Absent for mapshots generated by
+    // older versions.
+    jpgquality?: number,
+
+    // "in-progress" while tiles are being written, "complete" once done.
+    // Absent for mapshots generated by older versions.
+    status?: string,
 }
 
 // Information about a single exported rendered surface.
@@ -114,6 +124,8 @@ export interface ShotsJSON {
 }
 
 export interface ShotsJSONSave {
+    // Only set when the server has multiple roots.
+    root?: string;
     savename: string;
     versions: ShotsJSONInfo[];
 }
@@ -122,6 +134,22 @@ export interface ShotsJSONInfo {
     name: string;
     encoded_path: string;
     ticks_played: number;
+    // Only present when the render is not complete: "in-progress" or "abandoned".
+    status?: string;
+    // Preview of the first surface; absent when thumbnails are disabled.
+    thumbnail_url?: string;
+}
+
+// Payload of the events sent by the CLI on `/events` (Server-Sent Events).
+// Event types are `shot-added`, `shot-removed` and `latest-changed`. Shot
+// fields are the same as in shots.json; for `latest-changed`, they are absent
+// when the save has no complete shot anymore.
+export interface ShotEvent {
+    savename: string;
+    name?: string;
+    encoded_path?: string;
+    ticks_played?: number;
+    status?: string;
 }
 
 export function parseNumber(v: any, defvalue: number): number {
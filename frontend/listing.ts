@@ -57,6 +57,14 @@ class MapshotListing extends LitElement {
                 padding: 0.1ex 1ex 0.1ex 1ex;
                 margin: 1ex 0.1ex 0 0.1ex;
                 border-radius: 1ex;
+                overflow: auto;
+            }
+            img.thumbnail {
+                float: right;
+                max-width: 256px;
+                max-height: 160px;
+                margin: 1ex;
+                border-radius: 0.5ex;
             }
         `;
     }
@@ -66,6 +74,23 @@ class MapshotListing extends LitElement {
             return html`No mapshots have been found. Create some and re-start mapshot server.`;
         }
 
+        // When serving multiple roots, saves are grouped by root. The server
+        // sends them sorted, so saves of a root are contiguous.
+        let groups: { root?: string, saves: common.ShotsJSONSave[] }[] = [];
+        for (const save of this.shots.all) {
+            if (groups.length == 0 || groups[groups.length - 1].root != save.root) {
+                groups.push({ root: save.root, saves: [] });
+            }
+            groups[groups.length - 1].saves.push(save);
+        }
+
+        return html`${groups.map((group) => html`
+            ${group.root ? html`<h1>${group.root}</h1>` : ''}
+            ${this.renderSaves(group.saves)}
+        `)}`;
+    }
+
+    renderSaves(saves: common.ShotsJSONSave[]) {
         // The encoded_path gets itself encoded - i.e., double encoding. Reason
         // is that we really want to get the encoded path on the receiving page.
         // So, without encodeURI, the encoded path would get decoded, and
@@ -73,18 +98,23 @@ class MapshotListing extends LitElement {
         // from the Go server, as it would then do a partial encoding (spaces
         // but not square bracket) which Go mux routing seems to have trouble
         // with.
+        // Encoded paths might be relative to the listing - e.g., for a static
+        // export - while the viewer is one level below; make them absolute.
+        const absolute = (encodedPath: string) => new URL(encodedPath, document.baseURI).pathname;
         return html`
-                ${this.shots.all.map((save) => html`
+                ${saves.map((save) => html`
                     <div class="savename">
-                        <h2>${save.savename} <a href="map?l=${save.savename}">[permalink]</a></h2>
+                        ${save.versions[0].thumbnail_url ? html`<a href="map/?l=${save.savename}"><img class="thumbnail" src="${save.versions[0].thumbnail_url}" alt="Overview of ${save.savename}" loading="lazy"></a>` : ''}
+                        <h2>${save.savename} <a href="map/?l=${save.savename}">[permalink]</a></h2>
                         <factorio-ticks .ticks=${save.versions[0].ticks_played}></factorio-ticks>
                         <p>
                         Available versions:
                         <ul>
                             ${save.versions.map((si) => html`
                                 <li>
-                                    <a href="map?path=${encodeURI(si.encoded_path)}"><factorio-relticks .ticks=${si.ticks_played} .refticks=${save.versions[0].ticks_played}></factorio-relticks></a>
+                                    <a href="map/?path=${encodeURI(absolute(si.encoded_path))}"><factorio-relticks .ticks=${si.ticks_played} .refticks=${save.versions[0].ticks_played}></factorio-relticks></a>
                                     (<factorio-ticks .ticks=${si.ticks_played}></factorio-ticks>)
+                                    ${si.status ? html`<em>[${si.status}]</em>` : ''}
                                 </li>`)}
                         </ul>
                     </div>
@@ -95,8 +125,26 @@ class MapshotListing extends LitElement {
 
 // ------ Bootstrap ------
 
-fetch('shots.json')
-    .then(resp => resp.json())
-    .then((shots: common.ShotsJSON) => {
-        render(html`<mapshot-listing .shots=${shots}>foo</mapshot-listing>`, document.body);
-    });
\ No newline at end of file
+function refresh() {
+    fetch('shots.json')
+        .then(resp => resp.json())
+        .then((shots: common.ShotsJSON) => {
+            render(html`<mapshot-listing .shots=${shots}>foo</mapshot-listing>`, document.body);
+        });
+}
+
+refresh();
+
+// Reload the listing when the server reports changes. The listing is also
+// reloaded when reconnecting, as events might have been missed meanwhile.
+const events = new EventSource('events');
+let connected = false;
+events.addEventListener('open', () => {
+    if (connected) {
+        refresh();
+    }
+    connected = true;
+});
+for (const kind of ['shot-added', 'shot-removed']) {
+    events.addEventListener(kind, () => refresh());
+}
\ No newline at end of file
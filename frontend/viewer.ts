@@ -305,10 +305,31 @@ declare var MAPSHOT_CONFIG: common.MapshotConfig;
 
 const params = new URLSearchParams(window.location.search);
 if (params.get("l")) {
-    fetch("/latest/" + params.get("l"))
-        .then(resp => resp.json())
+    const savename = params.get("l");
+    // Relative URLs, to work both from the server and from a static export,
+    // whatever the base path.
+    fetch("../latest/" + savename)
+        .then(resp => resp.json().then((config: common.MapshotConfig) => {
+            // The path might be relative to the pointer itself, as in static
+            // exports.
+            if (config.encoded_path) {
+                config.encoded_path = new URL(config.encoded_path, resp.url).pathname;
+            }
+            return config;
+        }))
         .then((config: common.MapshotConfig) => {
             load(config);
+
+            // Switch to the new render when one is available. The current
+            // position is kept in the URL, so a reload preserves it. Static
+            // exports have no events; the connection then just fails.
+            const events = new EventSource("../events");
+            events.addEventListener("latest-changed", (e: Event) => {
+                const data: common.ShotEvent = JSON.parse((e as MessageEvent).data);
+                if (data.savename == savename && data.encoded_path && data.encoded_path != config.encoded_path) {
+                    window.location.reload();
+                }
+            });
         });
 } else {
     const config = JSON.parse(JSON.stringify(MAPSHOT_CONFIG ?? {}));
@@ -101,8 +101,10 @@ function mapshot(params)
     end
   end
 
-  -- Write metadata.
-  helpers.write_file(data_prefix .. "mapshot.json", helpers.table_to_json({
+  -- Write metadata. It is written before the screenshots are requested, so
+  -- it is marked as in progress; it gets rewritten once all the tiles have been
+  -- written - see mark_complete().
+  local metadata = {
     savename = params.savename,
     unique_id = unique_id,
     map_id = map_id,
@@ -113,7 +115,10 @@ function mapshot(params)
     surfaces = surface_infos,
     game_version = game_version,
     active_mods = active_mods,
-  }))
+    jpgquality = params.jpgquality,
+    status = "in-progress",
+  }
+  helpers.write_file(data_prefix .. "mapshot.json", helpers.table_to_json(metadata))
 
   -- Create the serving html.
   for fname, contentfunc in pairs(generated.files) do
@@ -133,9 +138,14 @@ function mapshot(params)
     local r = helpers.write_file(prefix .. fname, content)
   end
 
-  -- Generate all the tiles.
+  -- Generate all the tiles. With `singlelayer`, only the most detailed layer is
+  -- rendered; the CLI builds the other layers from it.
   for _, surface_info in ipairs(surface_infos) do
-    for render_zoom = surface_info.zoom_min, surface_info.zoom_max do
+    local first_zoom = surface_info.zoom_min
+    if params.singlelayer then
+      first_zoom = surface_info.zoom_max
+    end
+    for render_zoom = first_zoom, surface_info.zoom_max do
       local tile_size = surface_info.tile_size / math.pow(2, render_zoom)
       local layer_prefix = data_prefix .. surface_info.file_prefix .. render_zoom .. "/"
       gen_layer(params, tile_size, surface_info.render_size, surface_info.world_min, surface_info.world_max, layer_prefix, game.surfaces[surface_info.surface_idx])
@@ -145,7 +155,16 @@ function mapshot(params)
   game.print("Mapshot: all screenshots started, might take a while to render; location: " .. data_prefix)
   log("Mapshot: all screenshots started, might take a while to render; location: " .. data_prefix)
 
-  return data_prefix
+  return data_prefix, metadata
+end
+
+-- Rewrite mapshot.json to indicate that all the tiles have been written. This
+-- must be called only once the screenshots are finished - i.e., after
+-- set_wait_for_screenshots_to_finish, on a later tick.
+function mark_complete(data_prefix, metadata)
+  metadata.status = "complete"
+  helpers.write_file(data_prefix .. "mapshot.json", helpers.table_to_json(metadata))
+  log("Mapshot: marked as complete; location: " .. data_prefix)
 end
 
 -- Check if a surface should be rendered.
@@ -400,7 +419,9 @@ script.on_event(defines.events.on_tick, function(evt)
 
   if params.onstartup ~= "" then
     log("onstartup requested id=" .. params.onstartup)
-    local data_prefix = mapshot(params)
+    -- Lets the CLI know that Factorio is up and rendering started.
+    helpers.write_file("mapshot-started-" .. params.onstartup, "")
+    local data_prefix, metadata = mapshot(params)
 
     -- Ensure that screen shots are written before marking as done.
     game.set_wait_for_screenshots_to_finish()
@@ -414,6 +435,11 @@ script.on_event(defines.events.on_tick, function(evt)
     -- but before removing it, more testing is needed.
     script.on_event(defines.events.on_tick, function(evt)
       restore_surface_show_clouds()
+      -- With `singlelayer`, the mapshot is complete only once the CLI has
+      -- built the other layers; it takes care of marking it.
+      if not params.singlelayer then
+        mark_complete(data_prefix, metadata)
+      end
 
       log("marking as done @" .. evt.tick)
       script.on_event(defines.events.on_tick, nil)
@@ -422,6 +448,34 @@ script.on_event(defines.events.on_tick, function(evt)
   end
 end)
 
+-- Mark as complete the mapshots of the `/mapshot` command once their
+-- screenshots are written, i.e., on a later tick. They are kept in `storage`,
+-- so they are not lost when the game is saved in between and all the peers of a
+-- multiplayer game agree on them. on_nth_tick is used instead of on_tick to
+-- leave the on-startup handler alone.
+function complete_pending(evt)
+  local remaining = {}
+  for _, pending in ipairs(storage.pending_completions) do
+    if evt.tick > pending.tick then
+      mark_complete(pending.data_prefix, pending.metadata)
+    else
+      table.insert(remaining, pending)
+    end
+  end
+  storage.pending_completions = remaining
+  if #remaining == 0 then
+    script.on_nth_tick(1, nil)
+  end
+end
+
+-- Handlers depending on `storage` must be registered again when a game is
+-- loaded.
+script.on_load(function()
+  if storage.pending_completions ~= nil and #storage.pending_completions > 0 then
+    script.on_nth_tick(1, complete_pending)
+  end
+end)
+
 -- Register the command.
 -- It seems that on_init+on_load sometime don't trigger (neither of them) when
 -- doing weird things with --mod-directory and list of active mods.
@@ -443,7 +497,20 @@ commands.add_command("mapshot", "screenshot the whole map", function(evt)
   if evt.parameter ~= nil and #evt.parameter > 0 then
     params.savename = evt.parameter
   end
-  mapshot(params)
+  -- Only the CLI can build the layers which are not rendered.
+  params.singlelayer = false
+  local data_prefix, metadata = mapshot(params)
+
+  -- Mark the mapshot as complete once the screenshots are written. As with the
+  -- on-startup mode, wait for the next tick to be safe.
+  game.set_wait_for_screenshots_to_finish()
+  storage.pending_completions = storage.pending_completions or {}
+  table.insert(storage.pending_completions, {
+    data_prefix = data_prefix,
+    metadata = metadata,
+    tick = game.tick,
+  })
+  script.on_nth_tick(1, complete_pending)
 
   -- Restore state of surfaces show_clouds.
   -- Unfortunately, it means the screenshots will contain the clouds.
@@ -105,4 +105,14 @@ data:extend({
         hidden = true,
         order = "302",
     },
+    {
+        type = "bool-setting",
+        name = "singlelayer",
+        setting_type = "runtime-per-user",
+        default_value = false,
+        localised_name = "Single layer",
+        localised_description = "Only render the most detailed layer; the CLI builds the other layers from it.",
+        hidden = true,
+        order = "303",
+    },
 })
@@ -0,0 +1,76 @@
+package shot
+
+import (
+	"bytes"
+	_ "embed" // For the schema.
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/santhosh-tekuri/jsonschema/v5"
+)
+
+// Schema is the JSON Schema of mapshot.json.
+//
+//go:embed mapshot.schema.json
+var Schema []byte
+
+// schemaURL is the identifier of the schema, as declared in its `$id`.
+const schemaURL = "https://github.com/Palats/mapshot/shot/mapshot.schema.json"
+
+var compiledSchema = func() *jsonschema.Schema {
+	c := jsonschema.NewCompiler()
+	if err := c.AddResource(schemaURL, bytes.NewReader(Schema)); err != nil {
+		panic(fmt.Sprintf("invalid mapshot.json schema: %v", err))
+	}
+	return c.MustCompile(schemaURL)
+}()
+
+// ValidationError lists all the problems found when validating a
+// mapshot.json against the schema.
+type ValidationError struct {
+	// Problems found, one per line, in the form `<json pointer>: <message>`.
+	Problems []string
+}
+
+func (e *ValidationError) Error() string {
+	return "mapshot.json does not match schema:\n  " + strings.Join(e.Problems, "\n  ")
+}
+
+// Validate checks the raw content of a mapshot.json against the schema. It
+// returns a *ValidationError if the content is valid JSON but does not match.
+func Validate(raw []byte) error {
+	var v interface{}
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.UseNumber()
+	if err := dec.Decode(&v); err != nil {
+		return fmt.Errorf("invalid JSON: %w", err)
+	}
+	err := compiledSchema.Validate(v)
+	if err == nil {
+		return nil
+	}
+	verr, ok := err.(*jsonschema.ValidationError)
+	if !ok {
+		return err
+	}
+	ve := &ValidationError{}
+	collectProblems(verr, ve)
+	return ve
+}
+
+// collectProblems records the leaves of the validation error tree; the
+// intermediate nodes only repeat that their children failed.
+func collectProblems(verr *jsonschema.ValidationError, ve *ValidationError) {
+	if len(verr.Causes) == 0 {
+		loc := verr.InstanceLocation
+		if loc == "" {
+			loc = "/"
+		}
+		ve.Problems = append(ve.Problems, fmt.Sprintf("%s: %s", loc, verr.Message))
+		return
+	}
+	for _, c := range verr.Causes {
+		collectProblems(c, ve)
+	}
+}
@@ -0,0 +1,458 @@
+// Package shot models the content of a mapshot render - i.e., the
+// `mapshot.json` file written by the mod next to the tiles.
+//
+// It mirrors the TypeScript definitions in frontend/common.ts.
+package shot
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"io/ioutil"
+	"math"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// Filename is the name of the file describing a render, in its directory.
+const Filename = "mapshot.json"
+
+// Values of Mapshot.Status.
+const (
+	// StatusInProgress is set by the mod before requesting the screenshots.
+	StatusInProgress = "in-progress"
+	// StatusComplete is set by the mod once all the tiles have been written.
+	StatusComplete = "complete"
+)
+
+// Array is a list as written by Factorio. Factorio serializes empty tables
+// as `{}`, so an empty JSON object is accepted as an empty list. It is always
+// serialized back as a JSON array.
+type Array[T any] []T
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (a *Array[T]) UnmarshalJSON(data []byte) error {
+	trimmed := bytes.TrimSpace(data)
+	if bytes.Equal(trimmed, []byte("null")) {
+		*a = nil
+		return nil
+	}
+	if len(trimmed) > 0 && trimmed[0] == '{' {
+		var obj map[string]json.RawMessage
+		if err := json.Unmarshal(trimmed, &obj); err != nil {
+			return err
+		}
+		if len(obj) > 0 {
+			return fmt.Errorf("expected a list, got a non-empty object")
+		}
+		*a = Array[T]{}
+		return nil
+	}
+	var l []T
+	if err := json.Unmarshal(trimmed, &l); err != nil {
+		return err
+	}
+	*a = l
+	return nil
+}
+
+// MarshalJSON implements json.Marshaler.
+func (a Array[T]) MarshalJSON() ([]byte, error) {
+	if a == nil {
+		return []byte("[]"), nil
+	}
+	return json.Marshal([]T(a))
+}
+
+// LocalisedString is either a plain string or a Factorio localised string -
+// i.e., a list whose first element is a translation key.
+type LocalisedString json.RawMessage
+
+// UnmarshalJSON implements json.Unmarshaler.
+func (ls *LocalisedString) UnmarshalJSON(data []byte) error {
+	*ls = append((*ls)[0:0], data...)
+	return nil
+}
+
+// MarshalJSON implements json.Marshaler.
+func (ls LocalisedString) MarshalJSON() ([]byte, error) {
+	if len(ls) == 0 {
+		return []byte("null"), nil
+	}
+	return ls, nil
+}
+
+// String returns a human readable version. Localised strings are not
+// translated; the translation key is returned instead.
+func (ls LocalisedString) String() string {
+	var s string
+	if err := json.Unmarshal(ls, &s); err == nil {
+		return s
+	}
+	var l []json.RawMessage
+	if err := json.Unmarshal(ls, &l); err == nil && len(l) > 0 {
+		if err := json.Unmarshal(l[0], &s); err == nil {
+			return s
+		}
+	}
+	return ""
+}
+
+// Position is a position in Factorio world coordinates.
+type Position struct {
+	X float64 `json:"x"`
+	Y float64 `json:"y"`
+}
+
+// BoundingBox is an area in Factorio world coordinates.
+type BoundingBox struct {
+	LeftTop     Position `json:"left_top"`
+	RightBottom Position `json:"right_bottom"`
+}
+
+// Color is a Factorio color, with components between 0 and 1.
+type Color struct {
+	R float64 `json:"r"`
+	G float64 `json:"g"`
+	B float64 `json:"b"`
+	A float64 `json:"a"`
+}
+
+// Icon is a Factorio SignalID.
+type Icon struct {
+	Name string `json:"name"`
+	Type string `json:"type,omitempty"`
+}
+
+// Player is a player present on a surface at render time.
+type Player struct {
+	Name     string   `json:"name"`
+	Color    Color    `json:"color"`
+	Position Position `json:"position"`
+}
+
+// Station is a train stop.
+type Station struct {
+	BackerName  string      `json:"backer_name"`
+	BoundingBox BoundingBox `json:"bounding_box"`
+}
+
+// Tag is a map label (chart tag).
+type Tag struct {
+	ForceName  string   `json:"force_name"`
+	ForceIndex int      `json:"force_index"`
+	Icon       *Icon    `json:"icon,omitempty"`
+	TagNumber  int      `json:"tag_number"`
+	Position   Position `json:"position"`
+	Text       string   `json:"text"`
+}
+
+// Surface is the rendering information of a single game surface.
+type Surface struct {
+	// The name of the game surface that was rendered.
+	SurfaceName string `json:"surface_name"`
+	// The in-game index of that surface.
+	SurfaceIdx int `json:"surface_idx"`
+	// The localised name of this surface. If it's a planet or a space
+	// platform, then the corresponding name is used here instead.
+	SurfaceLocalisedName LocalisedString `json:"surface_localised_name,omitempty"`
+	IsPlanet             bool            `json:"is_planet,omitempty"`
+	IsSpacePlatform      bool            `json:"is_space_platform,omitempty"`
+
+	// Prefix for where to find the tile files.
+	FilePrefix string `json:"file_prefix"`
+	// Size of a tile in in-game units for the least detailed layer.
+	TileSize float64 `json:"tile_size"`
+	// Size of a tile, in pixels.
+	RenderSize int `json:"render_size"`
+	// Area rendered.
+	WorldMin Position `json:"world_min"`
+	WorldMax Position `json:"world_max"`
+	// Minimal available zoom level index (least detailed).
+	ZoomMin int `json:"zoom_min"`
+	// Maximal available zoom level index (most detailed).
+	ZoomMax int `json:"zoom_max"`
+
+	// Position of the player; only in older versions.
+	Player   *Position      `json:"player,omitempty"`
+	Players  Array[Player]  `json:"players"`
+	Stations Array[Station] `json:"stations"`
+	Tags     Array[Tag]     `json:"tags"`
+}
+
+// DisplayName is the name to use in UIs for that surface.
+func (s *Surface) DisplayName() string {
+	if n := s.SurfaceLocalisedName.String(); n != "" {
+		return n
+	}
+	return s.SurfaceName
+}
+
+// TileSizeAt returns the size of tiles, in in-game units, at the given zoom
+// level. Each zoom level doubles the resolution of the previous one.
+func (s *Surface) TileSizeAt(zoom int) float64 {
+	return s.TileSize / math.Pow(2, float64(zoom))
+}
+
+// TileRange returns the coordinates of the first and last tiles, inclusive,
+// covering the rendered area at the given zoom level.
+func (s *Surface) TileRange(zoom int) (minX, minY, maxX, maxY int) {
+	ts := s.TileSizeAt(zoom)
+	return int(math.Floor(s.WorldMin.X / ts)), int(math.Floor(s.WorldMin.Y / ts)),
+		int(math.Floor(s.WorldMax.X / ts)), int(math.Floor(s.WorldMax.Y / ts))
+}
+
+// TilePath returns the location of a tile, relative to the render directory.
+// Tiles which would only contain empty areas might not exist.
+func (s *Surface) TilePath(zoom, x, y int) string {
+	return fmt.Sprintf("%s%d/tile_%d_%d.jpg", s.FilePrefix, zoom, x, y)
+}
+
+// UniformTilesPath returns the location of the UniformTiles of the surface,
+// relative to the render directory.
+func (s *Surface) UniformTilesPath() string {
+	return s.FilePrefix + "uniform.json"
+}
+
+// UniformTiles lists the tiles of a surface which were removed by `mapshot
+// optimize` as they had a single color - e.g., water or the background of
+// space platforms. Such tiles must be recreated from their color.
+type UniformTiles struct {
+	// Color of each tile, as #rrggbb, keyed by the location of the tile
+	// relative to the render directory - see TilePath.
+	Tiles map[string]string `json:"tiles"`
+}
+
+// TilesFilename is the name of the file listing the tiles of a render, in its
+// directory.
+const TilesFilename = "tiles.json"
+
+// Tiles lists which tiles of a render exist, per surface and zoom level. The
+// mod does not write tiles which would only contain empty areas.
+type Tiles struct {
+	Surfaces []*SurfaceTiles `json:"surfaces"`
+}
+
+// SurfaceTiles lists which tiles of a surface exist.
+type SurfaceTiles struct {
+	// Same as Surface.FilePrefix.
+	FilePrefix string       `json:"file_prefix"`
+	Levels     []*TileLevel `json:"levels"`
+}
+
+// TileLevel lists which tiles of a zoom level exist, as a bitmap of the area
+// from (MinX, MinY) of Width x Height tiles - see Surface.TileRange. Tile
+// (x, y) exists if bit i%8 of byte i/8 is set, with
+// i = (y-MinY)*Width + (x-MinX).
+type TileLevel struct {
+	Zoom   int `json:"zoom"`
+	MinX   int `json:"min_x"`
+	MinY   int `json:"min_y"`
+	Width  int `json:"width"`
+	Height int `json:"height"`
+	// Encoded as base64 in JSON.
+	Bitmap []byte `json:"bitmap"`
+}
+
+// NewTileLevel returns a level without any tile, covering the tiles of the
+// surface at that zoom level.
+func NewTileLevel(s *Surface, zoom int) *TileLevel {
+	minX, minY, maxX, maxY := s.TileRange(zoom)
+	l := &TileLevel{
+		Zoom:   zoom,
+		MinX:   minX,
+		MinY:   minY,
+		Width:  maxX - minX + 1,
+		Height: maxY - minY + 1,
+	}
+	l.Bitmap = make([]byte, (l.Width*l.Height+7)/8)
+	return l
+}
+
+func (l *TileLevel) index(x, y int) (int, bool) {
+	if x < l.MinX || y < l.MinY || x >= l.MinX+l.Width || y >= l.MinY+l.Height {
+		return 0, false
+	}
+	i := (y-l.MinY)*l.Width + (x - l.MinX)
+	return i, i/8 < len(l.Bitmap)
+}
+
+// Has indicates whether the tile exists.
+func (l *TileLevel) Has(x, y int) bool {
+	i, ok := l.index(x, y)
+	return ok && l.Bitmap[i/8]&(1<<(i%8)) != 0
+}
+
+// Set marks the tile as existing. Tiles outside of the level are ignored.
+func (l *TileLevel) Set(x, y int) {
+	if i, ok := l.index(x, y); ok {
+		l.Bitmap[i/8] |= 1 << (i % 8)
+	}
+}
+
+// Lookup indicates whether the tile exists, given its location relative to
+// the render directory - see Surface.TilePath. known is false when the
+// location is not one of a tile listed here.
+func (t *Tiles) Lookup(name string) (exists, known bool) {
+	for _, st := range t.Surfaces {
+		rest, ok := strings.CutPrefix(name, st.FilePrefix)
+		if !ok {
+			continue
+		}
+		var zoom, x, y int
+		if _, err := fmt.Sscanf(rest, "%d/tile_%d_%d.jpg", &zoom, &x, &y); err != nil {
+			continue
+		}
+		if s := (&Surface{FilePrefix: st.FilePrefix}); s.TilePath(zoom, x, y) != name {
+			continue
+		}
+		for _, l := range st.Levels {
+			if l.Zoom == zoom {
+				return l.Has(x, y), true
+			}
+		}
+	}
+	return false, false
+}
+
+// Mapshot is the content of mapshot.json.
+type Mapshot struct {
+	// A unique ID generated for this render.
+	UniqueID string `json:"unique_id"`
+	// The name of the save - not reliable, as it can be customized. This is
+	// mostly the subdir that was used.
+	Savename string `json:"savename"`
+	// A short ID of the map, derived from MapExchange.
+	MapID string `json:"map_id"`
+
+	// game.tick
+	Tick int64 `json:"tick"`
+	// game.ticks_played
+	TicksPlayed int64 `json:"ticks_played"`
+	// Seed of the map.
+	Seed int64 `json:"seed"`
+	// Factorio map exchange string.
+	MapExchange string `json:"map_exchange,omitempty"`
+
+	// Version of the base game.
+	GameVersion string `json:"game_version,omitempty"`
+	// Versions of the other active mods, keyed by mod name.
+	ActiveMods map[string]string `json:"active_mods,omitempty"`
+
+	// JPEG quality of the rendered tiles - the `jpgquality` setting. 0 for
+	// mapshots generated by older versions.
+	JPGQuality int `json:"jpgquality,omitempty"`
+
+	// StatusInProgress while tiles are being written, StatusComplete once
+	// done. Empty for mapshots generated by older versions.
+	Status string `json:"status,omitempty"`
+
+	// Rendering info per surface.
+	Surfaces Array[*Surface] `json:"surfaces"`
+}
+
+// legacyMapshot is the format of older versions, before support for multiple
+// surfaces. The rendering info was directly at the top level.
+type legacyMapshot struct {
+	Surfaces   json.RawMessage `json:"surfaces"`
+	TileSize   float64         `json:"tile_size"`
+	RenderSize int             `json:"render_size"`
+	WorldMin   Position        `json:"world_min"`
+	WorldMax   Position        `json:"world_max"`
+	ZoomMin    int             `json:"zoom_min"`
+	ZoomMax    int             `json:"zoom_max"`
+	Player     *Position       `json:"player,omitempty"`
+	Players    Array[Player]   `json:"players"`
+	Stations   Array[Station]  `json:"stations"`
+	Tags       Array[Tag]      `json:"tags"`
+}
+
+// Parse decodes the content of a mapshot.json file. Data from older versions
+// is converted to the current format.
+func Parse(raw []byte) (*Mapshot, error) {
+	m := &Mapshot{}
+	if err := json.Unmarshal(raw, m); err != nil {
+		return nil, fmt.Errorf("invalid mapshot.json: %w", err)
+	}
+
+	legacy := &legacyMapshot{}
+	if err := json.Unmarshal(raw, legacy); err != nil {
+		return nil, fmt.Errorf("invalid mapshot.json: %w", err)
+	}
+	if legacy.Surfaces == nil {
+		// Same conversion as done in the viewer.
+		m.Surfaces = Array[*Surface]{{
+			SurfaceName: "nauvis",
+			SurfaceIdx:  1,
+			FilePrefix:  "zoom_",
+			TileSize:    legacy.TileSize,
+			RenderSize:  legacy.RenderSize,
+			WorldMin:    legacy.WorldMin,
+			WorldMax:    legacy.WorldMax,
+			ZoomMin:     legacy.ZoomMin,
+			ZoomMax:     legacy.ZoomMax,
+			Player:      legacy.Player,
+			Players:     legacy.Players,
+			Stations:    legacy.Stations,
+			Tags:        legacy.Tags,
+		}}
+	}
+	return m, nil
+}
+
+// Load reads and decodes mapshot.json from the given render directory.
+func Load(dir string) (*Mapshot, error) {
+	filename := filepath.Join(dir, Filename)
+	raw, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read %s: %w", filename, err)
+	}
+	m, err := Parse(raw)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", filename, err)
+	}
+	return m, nil
+}
+
+// LoadFS reads mapshot.json from the given directory of the filesystem.
+func LoadFS(fsys fs.FS, dir string) (*Mapshot, error) {
+	filename := path.Join(dir, Filename)
+	raw, err := fs.ReadFile(fsys, filename)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read %s: %w", filename, err)
+	}
+	m, err := Parse(raw)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", filename, err)
+	}
+	return m, nil
+}
+
+// Summary returns a copy without the bulky parts - map exchange string and
+// per surface lists. This is suitable to keep in memory for many renders.
+func (m *Mapshot) Summary() *Mapshot {
+	c := *m
+	c.MapExchange = ""
+	c.Surfaces = nil
+	for _, s := range m.Surfaces {
+		sc := *s
+		sc.Player = nil
+		sc.Players = nil
+		sc.Stations = nil
+		sc.Tags = nil
+		c.Surfaces = append(c.Surfaces, &sc)
+	}
+	return &c
+}
+
+// Surface finds a surface by index or name. Returns nil if not found.
+func (m *Mapshot) Surface(key string) *Surface {
+	for _, s := range m.Surfaces {
+		if fmt.Sprint(s.SurfaceIdx) == key || s.SurfaceName == key {
+			return s
+		}
+	}
+	return nil
+}
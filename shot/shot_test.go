@@ -0,0 +1,368 @@
+package shot
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestArrayUnmarshal(t *testing.T) {
+	tests := []struct {
+		desc    string
+		input   string
+		want    Array[int]
+		wantErr bool
+	}{
+		{desc: "list", input: `[1, 2, 3]`, want: Array[int]{1, 2, 3}},
+		{desc: "empty list", input: `[]`, want: Array[int]{}},
+		{desc: "empty table from Factorio", input: `{}`, want: Array[int]{}},
+		{desc: "empty table with spaces", input: ` { } `, want: Array[int]{}},
+		{desc: "null", input: `null`, want: nil},
+		{desc: "non-empty object", input: `{"1": 3}`, wantErr: true},
+		{desc: "wrong element type", input: `["a"]`, wantErr: true},
+		{desc: "not a list", input: `42`, wantErr: true},
+	}
+	for _, tc := range tests {
+		t.Run(tc.desc, func(t *testing.T) {
+			var got Array[int]
+			err := json.Unmarshal([]byte(tc.input), &got)
+			if tc.wantErr {
+				if err == nil {
+					t.Fatalf("Unmarshal(%s) = %v, expected an error", tc.input, got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Unmarshal(%s) failed: %v", tc.input, err)
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("Unmarshal(%s) = %#v, want %#v", tc.input, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestArrayMarshal(t *testing.T) {
+	tests := []struct {
+		desc  string
+		input Array[string]
+		want  string
+	}{
+		{desc: "nil", input: nil, want: `[]`},
+		{desc: "empty", input: Array[string]{}, want: `[]`},
+		{desc: "values", input: Array[string]{"a", "b"}, want: `["a","b"]`},
+	}
+	for _, tc := range tests {
+		t.Run(tc.desc, func(t *testing.T) {
+			// Through a struct, as Array is used in practice.
+			raw, err := json.Marshal(struct {
+				L Array[string] `json:"l"`
+			}{tc.input})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, want := string(raw), `{"l":`+tc.want+`}`; got != want {
+				t.Errorf("Marshal(%#v) = %s, want %s", tc.input, got, want)
+			}
+		})
+	}
+}
+
+func TestLocalisedString(t *testing.T) {
+	tests := []struct {
+		desc  string
+		input string
+		// Expected result of String().
+		want string
+	}{
+		{desc: "plain string", input: `"Nauvis"`, want: "Nauvis"},
+		{desc: "localised", input: `["space-location-name.nauvis"]`, want: "space-location-name.nauvis"},
+		{desc: "localised with parameters", input: `["","a",["b"]]`, want: ""},
+		{desc: "nested key", input: `[["a"]]`, want: ""},
+		{desc: "empty list", input: `[]`, want: ""},
+		{desc: "number", input: `12`, want: ""},
+	}
+	for _, tc := range tests {
+		t.Run(tc.desc, func(t *testing.T) {
+			var ls LocalisedString
+			if err := json.Unmarshal([]byte(tc.input), &ls); err != nil {
+				t.Fatalf("Unmarshal(%s) failed: %v", tc.input, err)
+			}
+			if got := ls.String(); got != tc.want {
+				t.Errorf("String() = %q, want %q", got, tc.want)
+			}
+			// The original value is kept as-is.
+			raw, err := json.Marshal(ls)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(raw) != tc.input {
+				t.Errorf("Marshal() = %s, want %s", raw, tc.input)
+			}
+		})
+	}
+}
+
+func TestLocalisedStringEmpty(t *testing.T) {
+	s := &Surface{SurfaceName: "nauvis"}
+	if got := s.DisplayName(); got != "nauvis" {
+		t.Errorf("DisplayName() = %q, want %q", got, "nauvis")
+	}
+	raw, err := json.Marshal(s.SurfaceLocalisedName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(raw) != "null" {
+		t.Errorf("Marshal() = %s, want null", raw)
+	}
+}
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		desc  string
+		input string
+		want  *Mapshot
+	}{
+		{
+			desc: "current format",
+			input: `{
+				"unique_id": "abcd",
+				"savename": "mysave",
+				"ticks_played": 1234,
+				"status": "complete",
+				"surfaces": [{
+					"surface_name": "vulcanus",
+					"surface_idx": 3,
+					"surface_localised_name": ["space-location-name.vulcanus"],
+					"is_planet": true,
+					"file_prefix": "s3zoom_",
+					"tile_size": 1024,
+					"render_size": 1024,
+					"world_min": {"x": -10, "y": -20},
+					"world_max": {"x": 30, "y": 40},
+					"zoom_min": 0,
+					"zoom_max": 5,
+					"players": {},
+					"stations": [{"backer_name": "A", "bounding_box": {"left_top": {"x": 1, "y": 2}, "right_bottom": {"x": 3, "y": 4}}}],
+					"tags": {}
+				}]
+			}`,
+			want: &Mapshot{
+				UniqueID:    "abcd",
+				Savename:    "mysave",
+				TicksPlayed: 1234,
+				Status:      StatusComplete,
+				Surfaces: Array[*Surface]{{
+					SurfaceName:          "vulcanus",
+					SurfaceIdx:           3,
+					SurfaceLocalisedName: LocalisedString(`["space-location-name.vulcanus"]`),
+					IsPlanet:             true,
+					FilePrefix:           "s3zoom_",
+					TileSize:             1024,
+					RenderSize:           1024,
+					WorldMin:             Position{X: -10, Y: -20},
+					WorldMax:             Position{X: 30, Y: 40},
+					ZoomMin:              0,
+					ZoomMax:              5,
+					Players:              Array[Player]{},
+					Stations: Array[Station]{{
+						BackerName:  "A",
+						BoundingBox: BoundingBox{LeftTop: Position{X: 1, Y: 2}, RightBottom: Position{X: 3, Y: 4}},
+					}},
+					Tags: Array[Tag]{},
+				}},
+			},
+		},
+		{
+			desc: "legacy single surface",
+			input: `{
+				"unique_id": "old",
+				"savename": "oldsave",
+				"tile_size": 512,
+				"render_size": 256,
+				"world_min": {"x": -1, "y": -2},
+				"world_max": {"x": 3, "y": 4},
+				"zoom_min": 1,
+				"zoom_max": 6,
+				"player": {"x": 5, "y": 6},
+				"stations": {},
+				"tags": []
+			}`,
+			want: &Mapshot{
+				UniqueID: "old",
+				Savename: "oldsave",
+				Surfaces: Array[*Surface]{{
+					SurfaceName: "nauvis",
+					SurfaceIdx:  1,
+					FilePrefix:  "zoom_",
+					TileSize:    512,
+					RenderSize:  256,
+					WorldMin:    Position{X: -1, Y: -2},
+					WorldMax:    Position{X: 3, Y: 4},
+					ZoomMin:     1,
+					ZoomMax:     6,
+					Player:      &Position{X: 5, Y: 6},
+					Stations:    Array[Station]{},
+					Tags:        Array[Tag]{},
+				}},
+			},
+		},
+		{
+			desc:  "no surface rendered",
+			input: `{"unique_id": "empty", "surfaces": {}}`,
+			want: &Mapshot{
+				UniqueID: "empty",
+				Surfaces: Array[*Surface]{},
+			},
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.desc, func(t *testing.T) {
+			got, err := Parse([]byte(tc.input))
+			if err != nil {
+				t.Fatalf("Parse() failed: %v", err)
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				gotRaw, _ := json.MarshalIndent(got, "", "  ")
+				wantRaw, _ := json.MarshalIndent(tc.want, "", "  ")
+				t.Errorf("Parse() = %s\nwant %s", gotRaw, wantRaw)
+			}
+		})
+	}
+}
+
+func TestParseInvalid(t *testing.T) {
+	for _, input := range []string{
+		`not json`,
+		`{"surfaces": {"a": 1}}`,
+		`{"surfaces": "nauvis"}`,
+	} {
+		if _, err := Parse([]byte(input)); err == nil {
+			t.Errorf("Parse(%s) succeeded, expected an error", input)
+		}
+	}
+}
+
+// testSurface covers tiles (-2, -1) to (1, 0) at zoom 0, and (-4, -2) to
+// (3, 0) at zoom 1.
+func testSurface() *Surface {
+	return &Surface{
+		FilePrefix: "d-1/s1zoom_",
+		TileSize:   64,
+		WorldMin:   Position{X: -100, Y: -50},
+		WorldMax:   Position{X: 100, Y: 30},
+	}
+}
+
+func TestNewTileLevel(t *testing.T) {
+	tests := []struct {
+		zoom int
+		want TileLevel
+	}{
+		{0, TileLevel{Zoom: 0, MinX: -2, MinY: -1, Width: 4, Height: 2, Bitmap: make([]byte, 1)}},
+		{1, TileLevel{Zoom: 1, MinX: -4, MinY: -2, Width: 8, Height: 3, Bitmap: make([]byte, 3)}},
+		{2, TileLevel{Zoom: 2, MinX: -7, MinY: -4, Width: 14, Height: 6, Bitmap: make([]byte, 11)}},
+	}
+	for _, tc := range tests {
+		if got := NewTileLevel(testSurface(), tc.zoom); !reflect.DeepEqual(*got, tc.want) {
+			t.Errorf("NewTileLevel(zoom=%d) = %+v, want %+v", tc.zoom, *got, tc.want)
+		}
+	}
+}
+
+func TestTileLevel(t *testing.T) {
+	l := NewTileLevel(testSurface(), 1)
+	set := [][2]int{{-4, -2}, {3, 0}, {0, -1}, {-1, 0}}
+	for _, p := range set {
+		l.Set(p[0], p[1])
+	}
+	// Outside of the level; ignored.
+	for _, p := range [][2]int{{-5, -2}, {4, 0}, {0, -3}, {0, 1}} {
+		l.Set(p[0], p[1])
+	}
+
+	tests := []struct {
+		x, y int
+		want bool
+	}{
+		{-4, -2, true},
+		{3, 0, true},
+		{0, -1, true},
+		{-1, 0, true},
+		{-3, -2, false},
+		{1, -1, false},
+		{3, -1, false},
+		{-5, -2, false},
+		{4, 0, false},
+		{0, -3, false},
+		{0, 1, false},
+	}
+	check := func(desc string, l *TileLevel) {
+		for _, tc := range tests {
+			if got := l.Has(tc.x, tc.y); got != tc.want {
+				t.Errorf("%s: Has(%d, %d) = %v, want %v", desc, tc.x, tc.y, got, tc.want)
+			}
+		}
+	}
+	check("built", l)
+
+	raw, err := json.Marshal(l)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded TileLevel
+	if err := json.Unmarshal(raw, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	check("decoded", &decoded)
+
+	// A bitmap too short for the level, e.g., from a damaged file, must not
+	// cause a panic.
+	short := *l
+	short.Bitmap = short.Bitmap[:1]
+	if short.Has(3, 0) {
+		t.Errorf("Has(3, 0) with a truncated bitmap = true, want false")
+	}
+	short.Set(3, 0)
+}
+
+func TestTilesLookup(t *testing.T) {
+	s := testSurface()
+	l0, l1 := NewTileLevel(s, 0), NewTileLevel(s, 1)
+	l0.Set(-2, -1)
+	l1.Set(3, 0)
+	tiles := &Tiles{Surfaces: []*SurfaceTiles{
+		{FilePrefix: s.FilePrefix, Levels: []*TileLevel{l0, l1}},
+		{FilePrefix: "d-1/s3zoom_", Levels: []*TileLevel{NewTileLevel(s, 0)}},
+	}}
+
+	tests := []struct {
+		name       string
+		wantExists bool
+		wantKnown  bool
+	}{
+		{name: "d-1/s1zoom_0/tile_-2_-1.jpg", wantExists: true, wantKnown: true},
+		{name: "d-1/s1zoom_1/tile_3_0.jpg", wantExists: true, wantKnown: true},
+		{name: "d-1/s1zoom_0/tile_0_0.jpg", wantExists: false, wantKnown: true},
+		// Outside of the rendered area.
+		{name: "d-1/s1zoom_0/tile_5_5.jpg", wantExists: false, wantKnown: true},
+		{name: "d-1/s3zoom_0/tile_-2_-1.jpg", wantExists: false, wantKnown: true},
+		// Zoom level not listed.
+		{name: "d-1/s1zoom_2/tile_0_0.jpg", wantExists: false, wantKnown: false},
+		// Unknown surface.
+		{name: "d-1/s2zoom_0/tile_0_0.jpg", wantExists: false, wantKnown: false},
+		// Not tiles, or not in the canonical form.
+		{name: "d-1/s1zoom_0/tile_0_0.png", wantExists: false, wantKnown: false},
+		{name: "d-1/s1zoom_0/tile_00_0.jpg", wantExists: false, wantKnown: false},
+		{name: "d-1/s1zoom_0/tile_0_0.jpg.bak", wantExists: false, wantKnown: false},
+		{name: "d-1/s1zoom_0/tile_+1_0.jpg", wantExists: false, wantKnown: false},
+		{name: "d-1/s1zoom_0/uniform.json", wantExists: false, wantKnown: false},
+		{name: "d-1/mapshot.json", wantExists: false, wantKnown: false},
+	}
+	for _, tc := range tests {
+		exists, known := tiles.Lookup(tc.name)
+		if exists != tc.wantExists || known != tc.wantKnown {
+			t.Errorf("Lookup(%q) = %v, %v; want %v, %v", tc.name, exists, known, tc.wantExists, tc.wantKnown)
+		}
+	}
+}
@@ -0,0 +1,102 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// Local is a storage on the local filesystem.
+type Local struct {
+	dir  string
+	fsys fs.FS
+}
+
+// NewLocal creates a storage for the given directory. Symlinks are evaluated
+// once, when creating the storage.
+func NewLocal(dir string) (*Local, error) {
+	realDir, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return nil, fmt.Errorf("unable to eval symlinks for %s: %w", dir, err)
+	}
+	info, err := os.Stat(realDir)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return nil, fmt.Errorf("%s is not a directory", realDir)
+	}
+	return &Local{
+		dir:  realDir,
+		fsys: os.DirFS(realDir),
+	}, nil
+}
+
+// Dir returns the directory of the storage, with symlinks evaluated.
+func (l *Local) Dir() string {
+	return l.dir
+}
+
+// Open implements fs.FS. Files are *os.File.
+func (l *Local) Open(name string) (fs.File, error) {
+	return l.fsys.Open(name)
+}
+
+// Stat implements fs.StatFS.
+func (l *Local) Stat(name string) (fs.FileInfo, error) {
+	return fs.Stat(l.fsys, name)
+}
+
+// ReadDir implements fs.ReadDirFS.
+func (l *Local) ReadDir(name string) ([]fs.DirEntry, error) {
+	return fs.ReadDir(l.fsys, name)
+}
+
+// Put implements Writable. The file is written next to its destination, then
+// renamed.
+func (l *Local) Put(ctx context.Context, name string, r io.Reader, size int64) error {
+	if !fs.ValidPath(name) {
+		return &fs.PathError{Op: "put", Path: name, Err: fs.ErrInvalid}
+	}
+	dst := filepath.Join(l.dir, filepath.FromSlash(name))
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(dst), "."+filepath.Base(dst)+".tmp-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := io.Copy(tmp, r); err != nil {
+		tmp.Close()
+		return fmt.Errorf("unable to write %s: %w", dst, err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("unable to write %s: %w", dst, err)
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), dst)
+}
+
+// Remove implements Writable.
+func (l *Local) Remove(ctx context.Context, name string) error {
+	if !fs.ValidPath(name) || name == "." {
+		return &fs.PathError{Op: "remove", Path: name, Err: fs.ErrInvalid}
+	}
+	err := os.Remove(filepath.Join(l.dir, filepath.FromSlash(name)))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+func (l *Local) String() string {
+	return l.dir
+}
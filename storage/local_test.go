@@ -0,0 +1,122 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLocal(t *testing.T) {
+	store, err := NewLocal(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	testWritable(t, store)
+}
+
+func TestNewLocal(t *testing.T) {
+	dir := t.TempDir()
+	target := filepath.Join(dir, "target")
+	if err := os.Mkdir(target, 0755); err != nil {
+		t.Fatal(err)
+	}
+	link := filepath.Join(dir, "link")
+	if err := os.Symlink(target, link); err != nil {
+		t.Fatal(err)
+	}
+	store, err := NewLocal(link)
+	if err != nil {
+		t.Fatalf("NewLocal() failed: %v", err)
+	}
+	// Symlinks are evaluated once.
+	realTarget, err := filepath.EvalSymlinks(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if store.Dir() != realTarget {
+		t.Errorf("Dir() = %q, want %q", store.Dir(), realTarget)
+	}
+
+	file := filepath.Join(dir, "file")
+	if err := os.WriteFile(file, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	for _, d := range []string{file, filepath.Join(dir, "missing")} {
+		if _, err := NewLocal(d); err == nil {
+			t.Errorf("NewLocal(%q) succeeded, expected an error", d)
+		}
+	}
+}
+
+// failingReader returns some content, then fails.
+type failingReader struct {
+	sent bool
+}
+
+func (r *failingReader) Read(b []byte) (int, error) {
+	if r.sent {
+		return 0, errors.New("read failure")
+	}
+	r.sent = true
+	return copy(b, "partial"), nil
+}
+
+func TestLocalPutAtomic(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	store, err := NewLocal(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Put(ctx, "d/file.txt", strings.NewReader("old"), 3); err != nil {
+		t.Fatal(err)
+	}
+
+	// A reader of the previous version keeps seeing it: the file is replaced,
+	// not rewritten in place.
+	f, err := store.Open("d/file.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if err := store.Put(ctx, "d/file.txt", strings.NewReader("new content"), 11); err != nil {
+		t.Fatal(err)
+	}
+	got, err := ioutil.ReadAll(f)
+	if err != nil || string(got) != "old" {
+		t.Errorf("content seen by previous reader = %q, %v; want \"old\"", got, err)
+	}
+
+	// A failed write leaves the file as it was.
+	if err := store.Put(ctx, "d/file.txt", &failingReader{}, 100); err == nil {
+		t.Fatalf("Put() with a failing reader succeeded, expected an error")
+	}
+	got, err = os.ReadFile(filepath.Join(dir, "d", "file.txt"))
+	if err != nil || string(got) != "new content" {
+		t.Errorf("content after failed Put() = %q, %v; want \"new content\"", got, err)
+	}
+
+	// No temporary file is left behind, either way.
+	entries, err := os.ReadDir(filepath.Join(dir, "d"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Name() != "file.txt" {
+		var names []string
+		for _, e := range entries {
+			names = append(names, e.Name())
+		}
+		t.Errorf("directory content = %q, want only file.txt", names)
+	}
+	info, err := os.Stat(filepath.Join(dir, "d", "file.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0644 {
+		t.Errorf("file mode = %v, want 0644", info.Mode().Perm())
+	}
+}
@@ -0,0 +1,330 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"mime"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+	"github.com/spf13/pflag"
+)
+
+// S3Settings configures access to S3-compatible object stores. Credentials
+// are taken from the environment (AWS_ACCESS_KEY_ID & AWS_SECRET_ACCESS_KEY,
+// or MINIO_ACCESS_KEY & MINIO_SECRET_KEY), from ~/.aws/credentials, or from
+// the instance metadata when running on AWS.
+type S3Settings struct {
+	endpoint string
+	region   string
+	insecure bool
+}
+
+// Register adds flags to configure S3 access on the flagset.
+func (s *S3Settings) Register(flags *pflag.FlagSet, prefix string) *S3Settings {
+	flags.StringVar(&s.endpoint, prefix+"endpoint", "s3.amazonaws.com", "Host (and port) of the S3-compatible service; e.g., localhost:9000 for a local MinIO.")
+	flags.StringVar(&s.region, prefix+"region", "", "Region of the bucket. Auto-detected if empty.")
+	flags.BoolVar(&s.insecure, prefix+"insecure", false, "Use plain HTTP instead of HTTPS to talk to the S3 service.")
+	return s
+}
+
+// S3 is a storage in a S3 bucket, under a prefix. S3 has no directories; they
+// are derived from the `/` in keys.
+type S3 struct {
+	ctx    context.Context
+	client *minio.Client
+	bucket string
+	// Either empty or ending with `/`.
+	prefix string
+}
+
+// NewS3 creates a storage from a URL of the form `s3://<bucket>/<prefix>`.
+func NewS3(ctx context.Context, location string, settings *S3Settings) (*S3, error) {
+	u, err := url.Parse(location)
+	if err != nil || u.Scheme != "s3" || u.Host == "" {
+		return nil, fmt.Errorf("invalid S3 location %q; expected s3://<bucket>/<prefix>", location)
+	}
+	if settings == nil {
+		settings = &S3Settings{endpoint: "s3.amazonaws.com"}
+	}
+	creds := credentials.NewChainCredentials([]credentials.Provider{
+		&credentials.EnvAWS{},
+		&credentials.EnvMinio{},
+		&credentials.FileAWSCredentials{},
+		&credentials.IAM{},
+	})
+	client, err := minio.New(settings.endpoint, &minio.Options{
+		Creds:  creds,
+		Secure: !settings.insecure,
+		Region: settings.region,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("unable to create S3 client: %w", err)
+	}
+	prefix := strings.Trim(u.Path, "/")
+	if prefix != "" {
+		prefix += "/"
+	}
+	s := &S3{
+		ctx:    ctx,
+		client: client,
+		bucket: u.Host,
+		prefix: prefix,
+	}
+	exists, err := client.BucketExists(ctx, s.bucket)
+	if err != nil {
+		return nil, fmt.Errorf("unable to access bucket %q: %w", s.bucket, err)
+	}
+	if !exists {
+		return nil, fmt.Errorf("bucket %q does not exist", s.bucket)
+	}
+	return s, nil
+}
+
+// key returns the object key of a fs.FS path.
+func (s *S3) key(name string) string {
+	if name == "." {
+		return s.prefix
+	}
+	return s.prefix + name
+}
+
+// isNotFound indicates whether the error means that the object does not
+// exist.
+func isNotFound(err error) bool {
+	code := minio.ToErrorResponse(err).Code
+	return code == "NoSuchKey" || code == "NotFound"
+}
+
+// isDir indicates whether there are objects below the given path.
+func (s *S3) isDir(name string) (bool, error) {
+	if name == "." {
+		return true, nil
+	}
+	opts := minio.ListObjectsOptions{Prefix: s.key(name) + "/", MaxKeys: 1}
+	ctx, cancel := context.WithCancel(s.ctx)
+	defer cancel()
+	for obj := range s.client.ListObjects(ctx, s.bucket, opts) {
+		if obj.Err != nil {
+			return false, obj.Err
+		}
+		return true, nil
+	}
+	return false, nil
+}
+
+// Open implements fs.FS. Content of files is fetched lazily, with ranged
+// requests when seeking.
+func (s *S3) Open(name string) (fs.File, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+	if name != "." {
+		obj, err := s.client.GetObject(s.ctx, s.bucket, s.key(name), minio.GetObjectOptions{})
+		if err != nil {
+			return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+		}
+		info, err := obj.Stat()
+		if err == nil {
+			return &s3File{Object: obj, info: fileInfoFromObject(name, info)}, nil
+		}
+		obj.Close()
+		if !isNotFound(err) {
+			return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+		}
+	}
+	dir, err := s.isDir(name)
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+	if !dir {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+	return &s3Dir{s: s, name: name}, nil
+}
+
+// Stat implements fs.StatFS.
+func (s *S3) Stat(name string) (fs.FileInfo, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: fs.ErrInvalid}
+	}
+	if name != "." {
+		info, err := s.client.StatObject(s.ctx, s.bucket, s.key(name), minio.StatObjectOptions{})
+		if err == nil {
+			return fileInfoFromObject(name, info), nil
+		}
+		if !isNotFound(err) {
+			return nil, &fs.PathError{Op: "stat", Path: name, Err: err}
+		}
+	}
+	dir, err := s.isDir(name)
+	if err != nil {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: err}
+	}
+	if !dir {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: fs.ErrNotExist}
+	}
+	return &s3FileInfo{name: path.Base(name), dir: true}, nil
+}
+
+// ReadDir implements fs.ReadDirFS.
+func (s *S3) ReadDir(name string) ([]fs.DirEntry, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: fs.ErrInvalid}
+	}
+	prefix := s.key(name)
+	if name != "." {
+		prefix += "/"
+	}
+	var entries []fs.DirEntry
+	for obj := range s.client.ListObjects(s.ctx, s.bucket, minio.ListObjectsOptions{Prefix: prefix}) {
+		if obj.Err != nil {
+			return nil, &fs.PathError{Op: "readdir", Path: name, Err: obj.Err}
+		}
+		rel := strings.TrimPrefix(obj.Key, prefix)
+		if rel == "" {
+			// Placeholder object for the directory itself.
+			continue
+		}
+		if strings.HasSuffix(rel, "/") {
+			entries = append(entries, &s3FileInfo{name: strings.TrimSuffix(rel, "/"), dir: true})
+			continue
+		}
+		entries = append(entries, fileInfoFromObject(rel, obj))
+	}
+	if len(entries) == 0 && name != "." {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: fs.ErrNotExist}
+	}
+	// The listing is sorted by key, but objects come before the common
+	// prefixes - i.e., directories - of each page; fs.ReadDir sorts by name.
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+	return entries, nil
+}
+
+// Put implements Writable. Objects only become visible once fully uploaded.
+func (s *S3) Put(ctx context.Context, name string, r io.Reader, size int64) error {
+	if !fs.ValidPath(name) || name == "." {
+		return &fs.PathError{Op: "put", Path: name, Err: fs.ErrInvalid}
+	}
+	opts := minio.PutObjectOptions{
+		ContentType: mime.TypeByExtension(path.Ext(name)),
+	}
+	if _, err := s.client.PutObject(ctx, s.bucket, s.key(name), r, size, opts); err != nil {
+		return &fs.PathError{Op: "put", Path: name, Err: err}
+	}
+	return nil
+}
+
+// Remove implements Writable.
+func (s *S3) Remove(ctx context.Context, name string) error {
+	if !fs.ValidPath(name) || name == "." {
+		return &fs.PathError{Op: "remove", Path: name, Err: fs.ErrInvalid}
+	}
+	// S3 does not report missing objects on removal.
+	if err := s.client.RemoveObject(ctx, s.bucket, s.key(name), minio.RemoveObjectOptions{}); err != nil {
+		return &fs.PathError{Op: "remove", Path: name, Err: err}
+	}
+	return nil
+}
+
+func (s *S3) String() string {
+	return fmt.Sprintf("s3://%s/%s", s.bucket, s.prefix)
+}
+
+// s3File is an object opened for reading. minio.Object provides Read, Seek,
+// ReadAt and Close.
+type s3File struct {
+	*minio.Object
+	info *s3FileInfo
+}
+
+func (f *s3File) Stat() (fs.FileInfo, error) {
+	return f.info, nil
+}
+
+// s3Dir is a directory, derived from the object keys.
+type s3Dir struct {
+	s       *S3
+	name    string
+	entries []fs.DirEntry
+	read    bool
+}
+
+func (d *s3Dir) Stat() (fs.FileInfo, error) {
+	return &s3FileInfo{name: path.Base(d.name), dir: true}, nil
+}
+
+func (d *s3Dir) Read([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.name, Err: fs.ErrInvalid}
+}
+
+func (d *s3Dir) Close() error {
+	return nil
+}
+
+// ReadDir implements fs.ReadDirFile.
+func (d *s3Dir) ReadDir(n int) ([]fs.DirEntry, error) {
+	if !d.read {
+		entries, err := d.s.ReadDir(d.name)
+		if err != nil {
+			return nil, err
+		}
+		d.entries = entries
+		d.read = true
+	}
+	if n <= 0 {
+		entries := d.entries
+		d.entries = nil
+		return entries, nil
+	}
+	if len(d.entries) == 0 {
+		return nil, io.EOF
+	}
+	if n > len(d.entries) {
+		n = len(d.entries)
+	}
+	entries := d.entries[:n]
+	d.entries = d.entries[n:]
+	return entries, nil
+}
+
+// s3FileInfo implements both fs.FileInfo and fs.DirEntry.
+type s3FileInfo struct {
+	name    string
+	size    int64
+	modTime time.Time
+	dir     bool
+}
+
+func fileInfoFromObject(name string, obj minio.ObjectInfo) *s3FileInfo {
+	return &s3FileInfo{
+		name:    path.Base(name),
+		size:    obj.Size,
+		modTime: obj.LastModified,
+	}
+}
+
+func (fi *s3FileInfo) Name() string               { return fi.name }
+func (fi *s3FileInfo) Size() int64                { return fi.size }
+func (fi *s3FileInfo) ModTime() time.Time         { return fi.modTime }
+func (fi *s3FileInfo) IsDir() bool                { return fi.dir }
+func (fi *s3FileInfo) Sys() interface{}           { return nil }
+func (fi *s3FileInfo) Info() (fs.FileInfo, error) { return fi, nil }
+
+func (fi *s3FileInfo) Mode() fs.FileMode {
+	if fi.dir {
+		return fs.ModeDir | 0555
+	}
+	return 0444
+}
+
+func (fi *s3FileInfo) Type() fs.FileMode {
+	return fi.Mode().Type()
+}
@@ -0,0 +1,311 @@
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeS3 implements the part of the S3 API used by the S3 storage, with a
+// single bucket. Requests are not authenticated.
+type fakeS3 struct {
+	bucket  string
+	modTime time.Time
+
+	m       sync.Mutex
+	objects map[string][]byte
+}
+
+func newFakeS3(bucket string) *fakeS3 {
+	return &fakeS3{
+		bucket:  bucket,
+		modTime: time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC),
+		objects: map[string][]byte{},
+	}
+}
+
+// keys returns the keys of the objects, sorted.
+func (f *fakeS3) keys() []string {
+	f.m.Lock()
+	defer f.m.Unlock()
+	return f.sortedKeysLocked()
+}
+
+func (f *fakeS3) writeError(w http.ResponseWriter, req *http.Request, code int, s3Code string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(code)
+	if req.Method != http.MethodHead {
+		fmt.Fprintf(w, "<Error><Code>%s</Code><Message>%s</Message></Error>", s3Code, s3Code)
+	}
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(req.URL.Path, "/"), "/")
+	if bucket != f.bucket {
+		f.writeError(w, req, http.StatusNotFound, "NoSuchBucket")
+		return
+	}
+	if key == "" {
+		switch {
+		case req.Method == http.MethodHead:
+		case req.Method == http.MethodGet && req.URL.Query().Has("location"):
+			fmt.Fprint(w, `<LocationConstraint xmlns="http://s3.amazonaws.com/doc/2006-03-01/"></LocationConstraint>`)
+		case req.Method == http.MethodGet:
+			f.list(w, req)
+		default:
+			f.writeError(w, req, http.StatusMethodNotAllowed, "MethodNotAllowed")
+		}
+		return
+	}
+
+	switch req.Method {
+	case http.MethodGet, http.MethodHead:
+		f.m.Lock()
+		content, ok := f.objects[key]
+		f.m.Unlock()
+		if !ok {
+			f.writeError(w, req, http.StatusNotFound, "NoSuchKey")
+			return
+		}
+		w.Header().Set("ETag", fmt.Sprintf(`"%x"`, len(content)))
+		w.Header().Set("Content-Type", "application/octet-stream")
+		http.ServeContent(w, req, "", f.modTime, bytes.NewReader(content))
+	case http.MethodPut:
+		content, err := readS3Body(req)
+		if err != nil {
+			f.writeError(w, req, http.StatusBadRequest, "IncompleteBody")
+			return
+		}
+		f.m.Lock()
+		f.objects[key] = content
+		f.m.Unlock()
+		w.Header().Set("ETag", fmt.Sprintf(`"%x"`, len(content)))
+	case http.MethodDelete:
+		f.m.Lock()
+		delete(f.objects, key)
+		f.m.Unlock()
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		f.writeError(w, req, http.StatusMethodNotAllowed, "MethodNotAllowed")
+	}
+}
+
+// readS3Body returns the content of an uploaded object. Over plain HTTP, the
+// client sends it in signed chunks: `<hex size>;chunk-signature=...\r\n`,
+// the data, `\r\n`, until a chunk of size 0.
+func readS3Body(req *http.Request) ([]byte, error) {
+	if !strings.HasPrefix(req.Header.Get("X-Amz-Content-Sha256"), "STREAMING-") {
+		return ioutil.ReadAll(req.Body)
+	}
+	r := bufio.NewReader(req.Body)
+	var content bytes.Buffer
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		sizeHex, _, _ := strings.Cut(strings.TrimSpace(line), ";")
+		size, err := strconv.ParseInt(sizeHex, 16, 64)
+		if err != nil {
+			return nil, err
+		}
+		if size == 0 {
+			return content.Bytes(), nil
+		}
+		if _, err := io.CopyN(&content, r, size); err != nil {
+			return nil, err
+		}
+		if _, err := r.Discard(2); err != nil {
+			return nil, err
+		}
+	}
+}
+
+type fakeS3ListResult struct {
+	XMLName        xml.Name `xml:"http://s3.amazonaws.com/doc/2006-03-01/ ListBucketResult"`
+	Name           string
+	Prefix         string
+	Delimiter      string
+	KeyCount       int
+	MaxKeys        int
+	IsTruncated    bool
+	Contents       []fakeS3Object
+	CommonPrefixes []fakeS3Prefix
+}
+
+type fakeS3Object struct {
+	Key          string
+	LastModified string
+	ETag         string
+	Size         int64
+	StorageClass string
+}
+
+type fakeS3Prefix struct {
+	Prefix string
+}
+
+// list implements ListObjectsV2, without pagination.
+func (f *fakeS3) list(w http.ResponseWriter, req *http.Request) {
+	q := req.URL.Query()
+	result := &fakeS3ListResult{
+		Name:      f.bucket,
+		Prefix:    q.Get("prefix"),
+		Delimiter: q.Get("delimiter"),
+		MaxKeys:   1000,
+	}
+	seen := map[string]bool{}
+	f.m.Lock()
+	for _, key := range f.sortedKeysLocked() {
+		rest, ok := strings.CutPrefix(key, result.Prefix)
+		if !ok {
+			continue
+		}
+		if i := strings.Index(rest, result.Delimiter); result.Delimiter != "" && i >= 0 {
+			p := result.Prefix + rest[:i+1]
+			if !seen[p] {
+				seen[p] = true
+				result.CommonPrefixes = append(result.CommonPrefixes, fakeS3Prefix{Prefix: p})
+			}
+			continue
+		}
+		result.Contents = append(result.Contents, fakeS3Object{
+			Key:          key,
+			LastModified: f.modTime.Format(time.RFC3339),
+			ETag:         fmt.Sprintf(`"%x"`, len(f.objects[key])),
+			Size:         int64(len(f.objects[key])),
+			StorageClass: "STANDARD",
+		})
+	}
+	f.m.Unlock()
+	result.KeyCount = len(result.Contents) + len(result.CommonPrefixes)
+	w.Header().Set("Content-Type", "application/xml")
+	xml.NewEncoder(w).Encode(result)
+}
+
+func (f *fakeS3) sortedKeysLocked() []string {
+	var keys []string
+	for k := range f.objects {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// newTestS3 starts a fake S3 service and returns a storage on it, for the
+// given location.
+func newTestS3(t *testing.T, location string) (*S3, *fakeS3) {
+	t.Helper()
+	fake := newFakeS3("bucket")
+	srv := httptest.NewServer(fake)
+	t.Cleanup(srv.Close)
+	t.Setenv("AWS_ACCESS_KEY_ID", "test")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "testsecret")
+	settings := &S3Settings{
+		endpoint: strings.TrimPrefix(srv.URL, "http://"),
+		region:   "us-east-1",
+		insecure: true,
+	}
+	store, err := NewS3(context.Background(), location, settings)
+	if err != nil {
+		t.Fatalf("NewS3(%q) failed: %v", location, err)
+	}
+	return store, fake
+}
+
+func TestS3(t *testing.T) {
+	store, _ := newTestS3(t, "s3://bucket")
+	testWritable(t, store)
+}
+
+func TestS3Prefix(t *testing.T) {
+	for _, location := range []string{"s3://bucket/some/prefix", "s3://bucket/some/prefix/", "s3://bucket//some/prefix"} {
+		t.Run(location, func(t *testing.T) {
+			store, fake := newTestS3(t, location)
+			if got, want := store.String(), "s3://bucket/some/prefix/"; got != want {
+				t.Errorf("String() = %q, want %q", got, want)
+			}
+			// Objects outside of the prefix, including one sharing the
+			// beginning of the prefix, are not visible.
+			fake.objects["outside.txt"] = []byte("outside")
+			fake.objects["some/prefixed.txt"] = []byte("outside")
+			fake.objects["some/other/file.txt"] = []byte("outside")
+			// A directory placeholder, as created by some tools.
+			fake.objects["some/prefix/"] = nil
+
+			testWritable(t, store)
+
+			want := []string{
+				"outside.txt",
+				"some/other/file.txt",
+				"some/prefix/",
+				"some/prefix/save/d-1/mapshot.json",
+				"some/prefix/save/d-1/zoom_0/tile_0_0.jpg",
+				"some/prefix/save/d-1/zoom_0/tile_1_0.jpg",
+				"some/prefix/top.txt",
+				"some/prefix/with space/a file.txt",
+				"some/prefixed.txt",
+			}
+			got := fake.keys()
+			if strings.Join(got, "\n") != strings.Join(want, "\n") {
+				t.Errorf("objects in the bucket:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+			}
+		})
+	}
+}
+
+func TestS3NotFound(t *testing.T) {
+	store, _ := newTestS3(t, "s3://bucket")
+	for _, name := range []string{"missing", "missing/file.txt"} {
+		if _, err := store.Open(name); !errors.Is(err, fs.ErrNotExist) {
+			t.Errorf("Open(%q) = %v, want fs.ErrNotExist", name, err)
+		}
+		if _, err := store.Stat(name); !errors.Is(err, fs.ErrNotExist) {
+			t.Errorf("Stat(%q) = %v, want fs.ErrNotExist", name, err)
+		}
+		if _, err := store.ReadDir(name); !errors.Is(err, fs.ErrNotExist) {
+			t.Errorf("ReadDir(%q) = %v, want fs.ErrNotExist", name, err)
+		}
+	}
+	// An empty bucket still has a root.
+	entries, err := store.ReadDir(".")
+	if err != nil || len(entries) != 0 {
+		t.Errorf("ReadDir(.) = %v, %v; want no entries", entries, err)
+	}
+}
+
+func TestNewS3Errors(t *testing.T) {
+	fake := newFakeS3("bucket")
+	srv := httptest.NewServer(fake)
+	defer srv.Close()
+	t.Setenv("AWS_ACCESS_KEY_ID", "test")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "testsecret")
+	settings := &S3Settings{
+		endpoint: strings.TrimPrefix(srv.URL, "http://"),
+		region:   "us-east-1",
+		insecure: true,
+	}
+	for _, location := range []string{
+		"s3://other-bucket/prefix",
+		"s3:///prefix",
+		"http://bucket/prefix",
+	} {
+		if _, err := NewS3(context.Background(), location, settings); err == nil {
+			t.Errorf("NewS3(%q) succeeded, expected an error", location)
+		}
+	}
+}
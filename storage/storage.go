@@ -0,0 +1,45 @@
+// Package storage abstracts where mapshots are stored, so they can be found
+// and served from either a local directory or an S3-compatible object store.
+//
+// Storages are read through io/fs: paths are slash-separated and relative to
+// the root of the storage.
+package storage
+
+import (
+	"context"
+	"io"
+	"io/fs"
+	"strings"
+)
+
+// Storage is a tree of files - typically, a Factorio script-output directory.
+//
+// Files returned by Open implement io.ReadSeeker and io.ReaderAt, to allow
+// serving ranges and reading archives without fetching them fully.
+type Storage interface {
+	fs.ReadDirFS
+	fs.StatFS
+	// String describes the storage, for logs.
+	String() string
+}
+
+// Writable is a storage which can also be written to.
+type Writable interface {
+	Storage
+	// Put creates or replaces a file with the content of r, which has the
+	// given size. Parent directories are created as needed. Readers never see
+	// a partially written file.
+	Put(ctx context.Context, name string, r io.Reader, size int64) error
+	// Remove deletes a file. Removing a file which does not exist is not an
+	// error.
+	Remove(ctx context.Context, name string) error
+}
+
+// New creates the storage for the given location. It is either a local
+// directory, or a URL of the form `s3://<bucket>/<prefix>`.
+func New(ctx context.Context, location string, s3Settings *S3Settings) (Writable, error) {
+	if strings.HasPrefix(location, "s3://") {
+		return NewS3(ctx, location, s3Settings)
+	}
+	return NewLocal(location)
+}
@@ -0,0 +1,225 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// testWritable runs the same scenario on any storage, which must start empty.
+func testWritable(t *testing.T, store Writable) {
+	ctx := context.Background()
+	files := map[string]string{
+		"top.txt":                      "top",
+		"save/other.txt":               "other",
+		"save/d-1/mapshot.json":        `{"unique_id": "1"}`,
+		"save/d-1/zoom_0/tile_0_0.jpg": strings.Repeat("0123456789", 100),
+		"save/d-1/zoom_0/tile_1_0.jpg": "",
+		"with space/a file.txt":        "spaces",
+	}
+	for name, content := range files {
+		if err := store.Put(ctx, name, strings.NewReader(content), int64(len(content))); err != nil {
+			t.Fatalf("Put(%q) failed: %v", name, err)
+		}
+	}
+
+	t.Run("open", func(t *testing.T) {
+		for name, content := range files {
+			got, err := fs.ReadFile(store, name)
+			if err != nil {
+				t.Errorf("ReadFile(%q) failed: %v", name, err)
+				continue
+			}
+			if string(got) != content {
+				t.Errorf("ReadFile(%q) = %.20q, want %.20q", name, got, content)
+			}
+		}
+	})
+
+	t.Run("random access", func(t *testing.T) {
+		f, err := store.Open("save/d-1/zoom_0/tile_0_0.jpg")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		rs, ok := f.(io.ReadSeeker)
+		if !ok {
+			t.Fatalf("file does not implement io.ReadSeeker")
+		}
+		ra, ok := f.(io.ReaderAt)
+		if !ok {
+			t.Fatalf("file does not implement io.ReaderAt")
+		}
+		buf := make([]byte, 3)
+		if _, err := ra.ReadAt(buf, 512); err != nil || string(buf) != "234" {
+			t.Errorf("ReadAt(512) = %q, %v; want \"234\"", buf, err)
+		}
+		if size, err := rs.Seek(0, io.SeekEnd); err != nil || size != 1000 {
+			t.Errorf("Seek(0, SeekEnd) = %d, %v; want 1000", size, err)
+		}
+		if _, err := rs.Seek(995, io.SeekStart); err != nil {
+			t.Fatal(err)
+		}
+		rest, err := ioutil.ReadAll(rs)
+		if err != nil || string(rest) != "56789" {
+			t.Errorf("read from 995 = %q, %v; want \"56789\"", rest, err)
+		}
+	})
+
+	t.Run("stat", func(t *testing.T) {
+		tests := []struct {
+			name    string
+			isDir   bool
+			size    int64
+			missing bool
+		}{
+			{name: ".", isDir: true},
+			{name: "top.txt", size: 3},
+			{name: "save", isDir: true},
+			{name: "save/d-1", isDir: true},
+			{name: "save/d-1/zoom_0/tile_1_0.jpg", size: 0},
+			{name: "with space/a file.txt", size: 6},
+			{name: "missing", missing: true},
+			{name: "save/missing.txt", missing: true},
+			// Prefix of a key, but not a directory.
+			{name: "save/d", missing: true},
+		}
+		for _, tc := range tests {
+			info, err := store.Stat(tc.name)
+			if tc.missing {
+				if !errors.Is(err, fs.ErrNotExist) {
+					t.Errorf("Stat(%q) = %v, want fs.ErrNotExist", tc.name, err)
+				}
+				if _, err := store.Open(tc.name); !errors.Is(err, fs.ErrNotExist) {
+					t.Errorf("Open(%q) = %v, want fs.ErrNotExist", tc.name, err)
+				}
+				continue
+			}
+			if err != nil {
+				t.Errorf("Stat(%q) failed: %v", tc.name, err)
+				continue
+			}
+			if info.IsDir() != tc.isDir {
+				t.Errorf("Stat(%q).IsDir() = %v, want %v", tc.name, info.IsDir(), tc.isDir)
+			}
+			if !tc.isDir && info.Size() != tc.size {
+				t.Errorf("Stat(%q).Size() = %d, want %d", tc.name, info.Size(), tc.size)
+			}
+		}
+	})
+
+	t.Run("readdir", func(t *testing.T) {
+		tests := []struct {
+			name string
+			// Directories end with a `/`.
+			want    []string
+			missing bool
+		}{
+			{name: ".", want: []string{"save/", "top.txt", "with space/"}},
+			{name: "save", want: []string{"d-1/", "other.txt"}},
+			{name: "save/d-1", want: []string{"mapshot.json", "zoom_0/"}},
+			{name: "save/d-1/zoom_0", want: []string{"tile_0_0.jpg", "tile_1_0.jpg"}},
+			{name: "missing", missing: true},
+		}
+		for _, tc := range tests {
+			entries, err := store.ReadDir(tc.name)
+			if tc.missing {
+				if !errors.Is(err, fs.ErrNotExist) {
+					t.Errorf("ReadDir(%q) = %v, want fs.ErrNotExist", tc.name, err)
+				}
+				continue
+			}
+			if err != nil {
+				t.Errorf("ReadDir(%q) failed: %v", tc.name, err)
+				continue
+			}
+			var got []string
+			for _, e := range entries {
+				n := e.Name()
+				if e.IsDir() {
+					n += "/"
+				}
+				got = append(got, n)
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("ReadDir(%q) = %q, want %q", tc.name, got, tc.want)
+			}
+		}
+	})
+
+	t.Run("walk", func(t *testing.T) {
+		found := map[string]bool{}
+		err := fs.WalkDir(store, ".", func(name string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if !d.IsDir() {
+				found[name] = true
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatalf("WalkDir() failed: %v", err)
+		}
+		for name := range files {
+			if !found[name] {
+				t.Errorf("WalkDir() did not find %q", name)
+			}
+		}
+		if len(found) != len(files) {
+			t.Errorf("WalkDir() found %d files, want %d", len(found), len(files))
+		}
+	})
+
+	t.Run("replace", func(t *testing.T) {
+		if err := store.Put(ctx, "top.txt", strings.NewReader("new content"), 11); err != nil {
+			t.Fatal(err)
+		}
+		got, err := fs.ReadFile(store, "top.txt")
+		if err != nil || string(got) != "new content" {
+			t.Errorf("after replacing, ReadFile() = %q, %v; want \"new content\"", got, err)
+		}
+	})
+
+	t.Run("remove", func(t *testing.T) {
+		if err := store.Remove(ctx, "save/other.txt"); err != nil {
+			t.Fatalf("Remove() failed: %v", err)
+		}
+		if _, err := store.Stat("save/other.txt"); !errors.Is(err, fs.ErrNotExist) {
+			t.Errorf("Stat() after Remove() = %v, want fs.ErrNotExist", err)
+		}
+		// Removing again is not an error.
+		if err := store.Remove(ctx, "save/other.txt"); err != nil {
+			t.Errorf("Remove() of a missing file failed: %v", err)
+		}
+		// The directory is still there thanks to other files.
+		if info, err := store.Stat("save"); err != nil || !info.IsDir() {
+			t.Errorf("Stat(save) after Remove() = %v, %v; want a directory", info, err)
+		}
+	})
+
+	t.Run("invalid paths", func(t *testing.T) {
+		for _, name := range []string{"../escape", "/absolute", "a//b", "a/../b", "a/"} {
+			if _, err := store.Open(name); !errors.Is(err, fs.ErrInvalid) {
+				t.Errorf("Open(%q) = %v, want fs.ErrInvalid", name, err)
+			}
+			if _, err := store.Stat(name); !errors.Is(err, fs.ErrInvalid) {
+				t.Errorf("Stat(%q) = %v, want fs.ErrInvalid", name, err)
+			}
+			if err := store.Put(ctx, name, strings.NewReader(""), 0); !errors.Is(err, fs.ErrInvalid) {
+				t.Errorf("Put(%q) = %v, want fs.ErrInvalid", name, err)
+			}
+			if err := store.Remove(ctx, name); !errors.Is(err, fs.ErrInvalid) {
+				t.Errorf("Remove(%q) = %v, want fs.ErrInvalid", name, err)
+			}
+		}
+		if err := store.Remove(ctx, "."); !errors.Is(err, fs.ErrInvalid) {
+			t.Errorf("Remove(.) = %v, want fs.ErrInvalid", err)
+		}
+	})
+}